@@ -0,0 +1,422 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/mparq/lsptrace/internal"
+	"github.com/mparq/lsptrace/internal/pipeline"
+	"github.com/mparq/lsptrace/internal/redact"
+	"github.com/mparq/lsptrace/internal/rotate"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	DAEMON_HELP_MESSAGE = `Usage:
+  $ ./lsptrace daemon [flags] --listen <endpoint> <language-server-exe> [...args]
+  $ ./lsptrace daemon [flags] --listen <endpoint> --forward <endpoint>
+
+Every client connecting to --listen is a session. A language server is
+launched for each session, or with --forward each session gets its own
+connection to an already running server, which has to accept a connection
+per client. Sessions are never multiplexed onto one server connection.
+Traces are tagged with a sessionId and written to --trace_output or to a
+file per session in --trace_dir.
+`
+)
+
+// runDaemon traces multiple concurrent client sessions.
+func runDaemon(args []string) error {
+	flags := flag.NewFlagSet("daemon", flag.ExitOnError)
+	flags.Usage = func() {
+		flags.Output().Write([]byte(DAEMON_HELP_MESSAGE))
+		flags.PrintDefaults()
+	}
+	listen := flags.String("listen", LISTEN, "endpoint to accept clients on, unix:<path> or tcp:<host>:<port>.")
+	forward := flags.String("forward", FORWARD, "endpoint of an already running language server which each session opens its own connection to.")
+	traceOutput := flags.String("trace_output", TRACE_OUTPUT, "filepath to write the traces of all sessions to.")
+	traceDir := flags.String("trace_dir", "", "directory to write a trace file per session to.")
+	traceMaxSize := flags.String("trace_max_size", TRACE_MAX_SIZE, "rotate trace files before they get bigger than this e.g. 100M.")
+	traceMaxAge := flags.Duration("trace_max_age", TRACE_MAX_AGE, "rotate trace files once they are this old e.g. 24h.")
+	traceMaxFiles := flags.Int("trace_max_files", TRACE_MAX_FILES, "how many rotated segments of each trace file to keep. all are kept if 0.")
+	traceCompress := flags.Bool("trace_compress", TRACE_COMPRESS, "gzip rotated trace segments.")
+	debugOutput := flags.String("debug_output", DEBUG_OUTPUT, "filepath to write debug logs to.")
+	includeMethods := flags.String("include_methods", INCLUDE_METHODS, "comma-separated globs of lsp methods to trace. all methods are traced if empty.")
+	excludeMethods := flags.String("exclude_methods", EXCLUDE_METHODS, "comma-separated globs of lsp methods to leave out of the trace.")
+	redactRules := flags.String("redact", REDACT, "comma-separated redaction rules <method-glob>:<params|result|error>.<path>=<blank|hash> or <method-glob>:raw=<blank|hash> for unparsed bodies. 'defaults' redacts source text, initialize options, workspace roots and unparsed bodies.")
+	redactUriRoot := flags.String("redact_uri_root", REDACT_URI_ROOT, "rewrite file:// uris under this directory to file:///$ROOT/...")
+	queueSize := flags.Int("queue_size", QUEUE_SIZE, "how many reads in each direction of a session may be waiting to be traced.")
+	queuePolicy := flags.String("queue_policy", QUEUE_POLICY, "'block' | 'drop'. whether to wait for the tracer or leave messages out of the trace when the queue is full.")
+	serverEnv := flags.String("server_env", LANGUAGE_SERVER_ENV, "environment variables to set for each language server e.g. 'DOTNET_ROOT=~/.dotnet LOG_LEVEL=debug'.")
+	flags.Parse(args)
+	if len(*listen) == 0 {
+		flags.Usage()
+		return errors.New("daemon: --listen is required")
+	}
+	if (len(*forward) > 0) == (flags.NArg() > 0) {
+		flags.Usage()
+		return errors.New("daemon: expected either a language server command or --forward")
+	}
+	if (len(*traceOutput) > 0) == (len(*traceDir) > 0) {
+		flags.Usage()
+		return errors.New("daemon: expected either --trace_output or --trace_dir")
+	}
+
+	logCloser, err := setupSubcommandLogger(*debugOutput)
+	if err != nil {
+		return err
+	}
+	defer logCloser()
+
+	redactor, err := redact.New(*redactRules, *redactUriRoot)
+	if err != nil {
+		return err
+	}
+	rotateOptions, err := traceRotateOptions(*traceMaxSize, *traceMaxAge, *traceMaxFiles, *traceCompress)
+	if err != nil {
+		return err
+	}
+	env, err := languageServerEnv(*serverEnv)
+	if err != nil {
+		return err
+	}
+	d := &Daemon{
+		forward:      *forward,
+		serverArgs:   flags.Args(),
+		serverEnv:    env,
+		redactor:     redactor,
+		rotate:       rotateOptions,
+		methodFilter: internal.NewMethodFilter(*includeMethods, *excludeMethods),
+		queueSize:    *queueSize,
+		queuePolicy:  *queuePolicy,
+		startTime:    time.Now(),
+		active:       make(map[string]*DaemonSession),
+	}
+	// checked up front rather than when the first client connects
+	if err := pipeline.ValidateQueue(d.queueSize, d.queuePolicy); err != nil {
+		return err
+	}
+	if len(*traceDir) > 0 {
+		d.traceDir, err = resolveLocalPath(*traceDir)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(d.traceDir, 0777); err != nil {
+			return errors.Join(errors.New("daemon: could not create trace directory"), err)
+		}
+	} else {
+		tracePath, err := resolveLocalPath(*traceOutput)
+		if err != nil {
+			return err
+		}
+		traceOut, err := rotate.Open(tracePath, d.rotate)
+		if err != nil {
+			return errors.Join(errors.New("daemon: error opening trace output file"), err)
+		}
+		defer traceOut.Close()
+		d.traceWriter = pipeline.NewTraceWriter(traceOut)
+	}
+
+	network, address, err := parseEndpoint(*listen)
+	if err != nil {
+		return err
+	}
+	if network == "unix" {
+		if err := removeStaleSocket(address); err != nil {
+			return err
+		}
+	}
+	l, err := net.Listen(network, address)
+	if err != nil {
+		return errors.Join(errors.New("daemon: could not listen for clients"), err)
+	}
+	signals := notifyShutdownSignals()
+	defer signal.Stop(signals)
+	go func() {
+		sig, ok := <-signals
+		if ok {
+			log.Printf("daemon: received %s. ending sessions\n", sig)
+			d.Shutdown(l)
+		}
+	}()
+	fmt.Fprintf(os.Stderr, "lsptrace daemon listening on %s\n", *listen)
+	return d.Serve(l)
+}
+
+// Daemon accepts client connections and traces each as its own session.
+type Daemon struct {
+	// endpoint of a running server or empty to launch serverArgs per session
+	forward    string
+	serverArgs []string
+	serverEnv  []string
+
+	// writer shared by all sessions or directory for a trace file per session
+	traceWriter *pipeline.TraceWriter
+	traceDir    string
+	rotate      rotate.Options
+
+	redactor     *redact.Redactor
+	methodFilter *internal.MethodFilter
+	queueSize    int
+	queuePolicy  string
+
+	// session ids are unique across daemon restarts
+	startTime time.Time
+	sessions  int
+	wg        sync.WaitGroup
+
+	activeMutex  sync.Mutex
+	active       map[string]*DaemonSession
+	shuttingDown bool
+}
+
+// Serve runs a session for every connection accepted on l until l is closed.
+func (d *Daemon) Serve(l net.Listener) error {
+	defer d.wg.Wait()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return errors.Join(errors.New("daemon: error accepting client"), err)
+		}
+		d.sessions++
+		sessionId := fmt.Sprintf("%s-%d", d.startTime.Format("20060102T150405"), d.sessions)
+		d.wg.Add(1)
+		go func() {
+			defer d.wg.Done()
+			if err := d.runSession(sessionId, conn); err != nil {
+				log.Printf("daemon: session %s: %s\n", sessionId, err)
+			}
+		}()
+	}
+}
+
+// Shutdown stops accepting clients and disconnects the active sessions. Serve
+// returns once their traces are written.
+func (d *Daemon) Shutdown(l net.Listener) {
+	l.Close()
+	d.activeMutex.Lock()
+	defer d.activeMutex.Unlock()
+	d.shuttingDown = true
+	for _, session := range d.active {
+		// the session ends like it does when the client disconnects
+		session.clientConnection.Close()
+	}
+}
+
+func (d *Daemon) runSession(sessionId string, conn net.Conn) error {
+	defer conn.Close()
+	log.Printf("daemon: session %s connected\n", sessionId)
+	defer log.Printf("daemon: session %s ended\n", sessionId)
+
+	traceWriter := d.traceWriter
+	if len(d.traceDir) > 0 {
+		f, err := rotate.Open(filepath.Join(d.traceDir, "session-"+sessionId+".lsptrace"), d.rotate)
+		if err != nil {
+			return errors.Join(errors.New("error opening session trace file"), err)
+		}
+		defer f.Close()
+		traceWriter = pipeline.NewTraceWriter(f)
+	}
+
+	session := &DaemonSession{clientConnection: conn}
+	if len(d.forward) > 0 {
+		network, address, err := parseEndpoint(d.forward)
+		if err != nil {
+			return err
+		}
+		serverConnection, err := net.DialTimeout(network, address, SOCKET_CONNECT_TIMEOUT)
+		if err != nil {
+			return errors.Join(errors.New("could not connect to server"), err)
+		}
+		session.serverConnection = serverConnection
+		session.sIn, session.sOut = serverConnection, serverConnection
+	} else {
+		session.execCmd = setupLanguageServerCommand(d.serverArgs, d.serverEnv)
+		sIn, err := session.execCmd.StdinPipe()
+		if err != nil {
+			return err
+		}
+		sOut, err := session.execCmd.StdoutPipe()
+		if err != nil {
+			return err
+		}
+		stderr, err := session.execCmd.StderrPipe()
+		if err != nil {
+			return err
+		}
+		session.sIn, session.sOut, session.stderr = sIn, sOut, stderr
+		if err := session.execCmd.Start(); err != nil {
+			return errors.Join(errors.New("error starting lsp command"), err)
+		}
+	}
+	defer session.Close()
+	d.activeMutex.Lock()
+	d.active[sessionId] = session
+	if d.shuttingDown {
+		// accepted right before shutting down
+		conn.Close()
+	}
+	d.activeMutex.Unlock()
+	defer func() {
+		d.activeMutex.Lock()
+		delete(d.active, sessionId)
+		d.activeMutex.Unlock()
+	}()
+
+	// each session has its own request maps since ids are only unique per session
+	lspTracer := internal.NewLSPTracer(internal.NewRequestMap())
+	lspTracer.SetMethodFilter(d.methodFilter)
+	lspTracer.SetSessionId(sessionId)
+	// only used to tell whether the server exit was expected
+	sessionState := internal.NewSessionState(false)
+	lspTracer.SetSessionState(sessionState)
+	clientPipeline := pipeline.NewPipeline(session.COut(), session.SIn(), traceWriter, lspTracer, "client")
+	serverPipeline := pipeline.NewPipeline(session.SOut(), session.CIn(), traceWriter, lspTracer, "server")
+	clientPipeline.SetRedactor(d.redactor)
+	serverPipeline.SetRedactor(d.redactor)
+	if err := clientPipeline.SetQueue(d.queueSize, d.queuePolicy); err != nil {
+		return err
+	}
+	if err := serverPipeline.SetQueue(d.queueSize, d.queuePolicy); err != nil {
+		return err
+	}
+	stopMetrics := logMetrics(0, map[string]*pipeline.Pipeline{
+		sessionId + " client": clientPipeline,
+		sessionId + " server": serverPipeline,
+	})
+	defer stopMetrics()
+	clientDone, serverDone := clientPipeline.Run(), serverPipeline.Run()
+	var stderrDone chan int
+	if session.stderr != nil {
+		// the daemon's own stderr is shared by all sessions so stderr is only traced
+		stderrDone = pipeline.RunStderrStage(session.stderr, nil, traceWriter, lspTracer, d.redactor)
+	}
+	pending := session.Wait(clientDone, serverDone)
+	if stderrDone != nil {
+		select {
+		case <-stderrDone:
+			stderrDone = nil
+		case <-time.After(STDERR_CLOSE_TIMEOUT):
+			log.Printf("daemon: session %s: timed out waiting for the language server to close stderr\n", sessionId)
+		}
+	}
+	// closing the session ends whatever didn't end in time. everything
+	// still tracing has to be done before the session's trace file is closed
+	session.Close()
+	clientPipeline.Stop()
+	serverPipeline.Stop()
+	if pending != nil {
+		<-pending
+	}
+	if stderrDone != nil {
+		<-stderrDone
+	}
+	if session.execCmd != nil {
+		exit := serverExit(session.execCmd.ProcessState, !sessionState.ShuttingDown())
+		traceWriter.Trace(func() *internal.LSPTrace {
+			return lspTracer.MakeServerExitTrace(exit)
+		}, d.redactor)
+	}
+	return nil
+}
+
+// DaemonSession is the LSPPipe of a single client connection to the daemon.
+type DaemonSession struct {
+	clientConnection net.Conn
+	// set when the session has its own server process
+	execCmd *exec.Cmd
+	// set when the session is forwarded to a running server
+	serverConnection net.Conn
+
+	sIn  io.WriteCloser
+	sOut io.Reader
+	// set when the session has its own server process
+	stderr io.Reader
+
+	closeOnce sync.Once
+}
+
+// Wait blocks until both pipelines are done. When one side closes the
+// other side sees the end of the stream too. If the other side doesn't close
+// in time its done channel is returned, otherwise nil.
+func (s *DaemonSession) Wait(clientDone chan int, serverDone chan int) (pending chan int) {
+	var otherDone chan int
+	select {
+	case <-clientDone:
+		s.CloseServerInput()
+		otherDone = serverDone
+	case <-serverDone:
+		closeWrite(s.clientConnection)
+		otherDone = clientDone
+	}
+	select {
+	case <-otherDone:
+		return nil
+	case <-time.After(PROXY_CLOSE_TIMEOUT):
+		log.Println("daemon: timed out waiting for the other side to close")
+		return otherDone
+	}
+}
+
+func (s *DaemonSession) CIn() io.Writer {
+	return s.clientConnection
+}
+
+func (s *DaemonSession) COut() io.Reader {
+	return s.clientConnection
+}
+
+func (s *DaemonSession) SIn() io.Writer {
+	return s.sIn
+}
+
+func (s *DaemonSession) SOut() io.Reader {
+	return s.sOut
+}
+
+func (s *DaemonSession) CloseServerInput() {
+	// a launched server sees its stdin closed
+	if s.serverConnection != nil {
+		closeWrite(s.serverConnection)
+	} else {
+		s.sIn.Close()
+	}
+}
+
+// Close can be called more than once. The language server is killed if it
+// doesn't exit in time.
+func (s *DaemonSession) Close() {
+	s.closeOnce.Do(s.close)
+}
+
+func (s *DaemonSession) close() {
+	s.clientConnection.Close()
+	s.sIn.Close()
+	if s.serverConnection != nil {
+		s.serverConnection.Close()
+	}
+	if s.execCmd != nil {
+		exited := make(chan error, 1)
+		go func() {
+			exited <- s.execCmd.Wait()
+		}()
+		select {
+		case <-exited:
+		case <-time.After(PROXY_CLOSE_TIMEOUT):
+			log.Printf("daemon: killing language server %d which didn't exit\n", s.execCmd.Process.Pid)
+			s.execCmd.Process.Kill()
+			<-exited
+		}
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/mparq/lsptrace/internal"
+	"github.com/mparq/lsptrace/internal/pipeline"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeServer answers every request on every connection with the request's
+// method as the result.
+func fakeServer(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for {
+					_, msg, err := pipeline.ReadJsonRpcMessage(r)
+					if err != nil {
+						return
+					}
+					if internal.MessageKind(msg) != internal.REQUEST {
+						continue
+					}
+					result, _ := json.Marshal(*msg.Method)
+					body, _ := json.Marshal(internal.RawLSPMessage{JsonRpc: "2.0", Id: msg.Id, Result: result})
+					pipeline.WriteJsonRpcMessage(conn, body)
+				}
+			}()
+		}
+	}()
+	return l
+}
+
+// runClients connects a client per method to the daemon at the same time
+// and sends a request with the same id from each.
+func runClients(t *testing.T, d *Daemon, methods []string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- d.Serve(l)
+	}()
+	conns := make([]net.Conn, len(methods))
+	for i := range methods {
+		if conns[i], err = net.Dial("tcp", l.Addr().String()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var wg sync.WaitGroup
+	for i, method := range methods {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer conns[i].Close()
+			pipeline.WriteJsonRpcMessage(conns[i], []byte(fmt.Sprintf(`{"jsonrpc":"2.0","id":1,"method":%q}`, method)))
+			_, msg, err := pipeline.ReadJsonRpcMessage(bufio.NewReader(conns[i]))
+			if err != nil || string(msg.Result) != fmt.Sprintf("%q", method) {
+				t.Errorf("expected %s to be answered on its own session, got %v %v", method, msg, err)
+			}
+		}()
+	}
+	wg.Wait()
+	d.Shutdown(l)
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("expected the daemon to stop once its sessions ended")
+	}
+}
+
+func newTestDaemon(forward string) *Daemon {
+	return &Daemon{
+		forward:     "tcp:" + forward,
+		queueSize:   pipeline.DEFAULT_QUEUE_SIZE,
+		queuePolicy: pipeline.QUEUE_BLOCK,
+		startTime:   time.Now(),
+		active:      make(map[string]*DaemonSession),
+	}
+}
+
+// checkSession checks that traces are a request and its response tagged
+// with the same session.
+func checkSession(t *testing.T, traces []*internal.LSPTrace) (sessionId string, method string) {
+	if len(traces) != 2 || traces[0].MessageKind != internal.REQUEST || traces[1].MessageKind != internal.RESPONSE {
+		t.Fatalf("expected a request and its response, got %v", traces)
+	}
+	if len(traces[0].SessionId) == 0 || traces[0].SessionId != traces[1].SessionId {
+		t.Fatalf("expected both traces to be tagged with their session, got %q %q", traces[0].SessionId, traces[1].SessionId)
+	}
+	if *traces[1].Method != *traces[0].Method || traces[1].DurationMs == nil {
+		t.Fatalf("expected the response to be matched to its session's request, got %v", traces[1])
+	}
+	return traces[0].SessionId, *traces[0].Method
+}
+
+func TestDaemonSessionFiles(t *testing.T) {
+	server := fakeServer(t)
+	defer server.Close()
+	d := newTestDaemon(server.Addr().String())
+	d.traceDir = t.TempDir()
+	runClients(t, d, []string{"a/ping", "b/ping"})
+
+	files, err := filepath.Glob(filepath.Join(d.traceDir, "session-*.lsptrace"))
+	if err != nil || len(files) != 2 {
+		t.Fatalf("expected a trace file per session, got %v %v", files, err)
+	}
+	methods := make(map[string]bool)
+	for _, file := range files {
+		f, err := os.Open(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		traces, err := internal.ReadTraces(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		sessionId, method := checkSession(t, traces)
+		if filepath.Base(file) != "session-"+sessionId+".lsptrace" {
+			t.Fatalf("expected %s to only have traces of its session, got %s", file, sessionId)
+		}
+		methods[method] = true
+	}
+	if !methods["a/ping"] || !methods["b/ping"] {
+		t.Fatalf("expected each client in its own file, got %v", methods)
+	}
+}
+
+func TestDaemonSharedOutput(t *testing.T) {
+	server := fakeServer(t)
+	defer server.Close()
+	d := newTestDaemon(server.Addr().String())
+	traceOut := new(bytes.Buffer)
+	d.traceWriter = pipeline.NewTraceWriter(traceOut)
+	runClients(t, d, []string{"a/ping", "b/ping"})
+
+	traces, err := internal.ReadTraces(traceOut)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessions := make(map[string][]*internal.LSPTrace)
+	for i, trace := range traces {
+		if trace.Seq != int64(i+1) {
+			t.Fatalf("expected traces of all sessions to be numbered in order, got %v", traces)
+		}
+		sessions[trace.SessionId] = append(sessions[trace.SessionId], trace)
+	}
+	if len(sessions) != 2 {
+		t.Fatalf("expected traces of two sessions, got %v", traces)
+	}
+	methods := make([]string, 0)
+	for _, traces := range sessions {
+		_, method := checkSession(t, traces)
+		methods = append(methods, method)
+	}
+	if joined := strings.Join(methods, ","); joined != "a/ping,b/ping" && joined != "b/ping,a/ping" {
+		t.Fatalf("expected each client in its own session, got %v", methods)
+	}
+}
+
+func TestDaemonServerExit(t *testing.T) {
+	d := newTestDaemon("")
+	d.forward = ""
+	d.serverArgs = []string{os.Args[0]}
+	d.serverEnv = []string{FAKE_SERVER_ENV + "=1"}
+	traceOut := new(bytes.Buffer)
+	d.traceWriter = pipeline.NewTraceWriter(traceOut)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- d.Serve(l)
+	}()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write(frames(t,
+		`{"jsonrpc":"2.0","id":1,"method":"initialize","params":{}}`,
+		`{"jsonrpc":"2.0","id":2,"method":"shutdown"}`,
+		`{"jsonrpc":"2.0","method":"exit"}`,
+	))
+	// the client closing ends the session once the server exited
+	closeWrite(conn)
+	io.Copy(io.Discard, conn)
+	conn.Close()
+	d.Shutdown(l)
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("expected the daemon to stop once its session ended")
+	}
+
+	traces, err := internal.ReadTraces(traceOut)
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := traces[len(traces)-1]
+	if last.MessageKind != internal.SERVER_EXIT || last.Exit.Code != 0 || last.Exit.Crashed || len(last.SessionId) == 0 {
+		t.Fatalf("expected the session to end with the server exiting after shutdown, got %v", last)
+	}
+}
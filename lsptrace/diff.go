@@ -0,0 +1,59 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"github.com/mparq/lsptrace/internal/diff"
+	"os"
+	"strings"
+)
+
+const (
+	DIFF_HELP_MESSAGE = `Usage:
+  $ ./lsptrace diff [flags] <a-trace-file> <b-trace-file>
+`
+)
+
+var (
+	// returned by runDiff once the differences are written. lsptrace exits
+	// with status 1 like diff without printing it
+	ETRACESDIFFER = errors.New("diff: traces differ")
+)
+
+// runDiff compares two trace files ignoring timestamps, ids and volatile
+// fields. Returns ETRACESDIFFER if the traces differ.
+func runDiff(args []string) error {
+	flags := flag.NewFlagSet("diff", flag.ExitOnError)
+	flags.Usage = func() {
+		flags.Output().Write([]byte(DIFF_HELP_MESSAGE))
+		flags.PrintDefaults()
+	}
+	ignore := flags.String("ignore", strings.Join(diff.DEFAULT_IGNORED_KEYS, ","), "comma-separated json keys or paths e.g. 'params.rootUri' to ignore when comparing params/result.")
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		flags.Usage()
+		return errors.New("diff: expected two trace files")
+	}
+	a, err := readTraceFile(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	b, err := readTraceFile(flags.Arg(1))
+	if err != nil {
+		return err
+	}
+	ignoredKeys := make([]string, 0)
+	for _, key := range strings.Split(*ignore, ",") {
+		if key = strings.TrimSpace(key); len(key) > 0 {
+			ignoredKeys = append(ignoredKeys, key)
+		}
+	}
+	result := diff.Compare(a, b, ignoredKeys)
+	if err := result.Write(os.Stdout, flags.Arg(0), flags.Arg(1)); err != nil {
+		return err
+	}
+	if !result.Equal() {
+		return ETRACESDIFFER
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// RawCapture is a chunk of bytes read from one side of the connection
+// exactly as it was received, before any jsonrpc parsing is done.
+// A capture file has one json encoded RawCapture per line.
+type RawCapture struct {
+	// Where the chunk was sent from 'client' | 'server'
+	SentFrom string `json:"from"`
+	// UTC timestamp the chunk was read by the tracer
+	Timestamp time.Time `json:"timestamp"`
+	// The raw bytes (base64 encoded in json)
+	Data []byte `json:"data"`
+}
+
+// ReadCaptures reads all chunks from a capture file.
+func ReadCaptures(r io.Reader) ([]*RawCapture, error) {
+	reader := bufio.NewReader(r)
+	captures := make([]*RawCapture, 0)
+	for lineNo := 1; ; lineNo++ {
+		line, err := reader.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			capture := new(RawCapture)
+			if jsonErr := json.Unmarshal(line, capture); jsonErr != nil {
+				return captures, errors.Join(fmt.Errorf("capture file: could not parse line %d", lineNo), jsonErr)
+			}
+			captures = append(captures, capture)
+		}
+		if err == io.EOF {
+			return captures, nil
+		}
+		if err != nil {
+			return captures, err
+		}
+	}
+}
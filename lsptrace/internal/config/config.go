@@ -0,0 +1,148 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+var (
+	ENOPROFILE = errors.New("config: no such profile")
+)
+
+// Config is the lsptrace config file. It holds named profiles, one per
+// language server, which can be selected instead of passing every option.
+//
+//	{
+//	  "profiles": {
+//	    "gopls": {
+//	      "command": "gopls serve",
+//	      "env": {"GOFLAGS": "-mod=mod"},
+//	      "trace_output": "~/.lsptrace/{server}-{date}-{pid}.lsptrace",
+//	      "exclude_methods": ["$/progress", "window/logMessage"],
+//	      "redact": "defaults"
+//	    }
+//	  }
+//	}
+type Config struct {
+	Profiles map[string]*Profile `json:"profiles"`
+}
+
+// Profile is how to run and trace one language server.
+type Profile struct {
+	// command to run the language server, split like a shell would, or the
+	// exact argv. at most one is set
+	Command string
+	Argv    []string
+	// environment variables to set for the language server
+	Env map[string]string
+	// values of lsptrace options keyed by flag name e.g. 'trace_output'.
+	// lists are joined with commas
+	Options map[string]string
+}
+
+func (p *Profile) UnmarshalJSON(data []byte) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	*p = Profile{Env: make(map[string]string), Options: make(map[string]string)}
+	for name, value := range fields {
+		var err error
+		switch name {
+		case "command":
+			err = json.Unmarshal(value, &p.Command)
+		case "argv":
+			err = json.Unmarshal(value, &p.Argv)
+		case "env":
+			err = json.Unmarshal(value, &p.Env)
+		default:
+			p.Options[name], err = optionValue(value)
+		}
+		if err != nil {
+			return fmt.Errorf("config: invalid %q: %w", name, err)
+		}
+	}
+	if len(p.Command) > 0 && len(p.Argv) > 0 {
+		return errors.New("config: only one of 'command' and 'argv' can be set")
+	}
+	return nil
+}
+
+// optionValue turns a json string, number, bool or list of strings into
+// the value of a flag.
+func optionValue(value json.RawMessage) (string, error) {
+	value = bytes.TrimSpace(value)
+	switch {
+	case bytes.HasPrefix(value, []byte(`"`)):
+		var s string
+		err := json.Unmarshal(value, &s)
+		return s, err
+	case bytes.HasPrefix(value, []byte("[")):
+		var list []string
+		err := json.Unmarshal(value, &list)
+		return strings.Join(list, ","), err
+	case bytes.HasPrefix(value, []byte("{")) || bytes.Equal(value, []byte("null")):
+		return "", errors.New("expected a string, number, bool or list of strings")
+	default:
+		// numbers and bools are parsed by the flag
+		return string(value), nil
+	}
+}
+
+// HasCommand reports whether the profile says how to run the server.
+func (p *Profile) HasCommand() bool {
+	return len(p.Command) > 0 || len(p.Argv) > 0
+}
+
+// EnvList returns the environment variables as KEY=VALUE sorted by key.
+func (p *Profile) EnvList() []string {
+	env := make([]string, 0, len(p.Env))
+	for key, value := range p.Env {
+		env = append(env, key+"="+value)
+	}
+	sort.Strings(env)
+	return env
+}
+
+// Load reads the config file at path.
+func Load(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c := new(Config)
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, errors.Join(fmt.Errorf("config: could not parse %s", path), err)
+	}
+	return c, nil
+}
+
+// Profile returns the profile called name.
+func (c *Config) Profile(name string) (*Profile, error) {
+	profile, ok := c.Profiles[name]
+	if !ok || profile == nil {
+		names := make([]string, 0, len(c.Profiles))
+		for name := range c.Profiles {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, errors.Join(ENOPROFILE, fmt.Errorf("%q, expected one of %s", name, strings.Join(names, ", ")))
+	}
+	return profile, nil
+}
+
+// DefaultPath is config.json in $XDG_CONFIG_HOME/lsptrace, or in
+// ~/.config/lsptrace if XDG_CONFIG_HOME isn't set, on every platform.
+func DefaultPath(home string) string {
+	configHome := os.Getenv("XDG_CONFIG_HOME")
+	if len(configHome) == 0 {
+		configHome = filepath.Join(home, ".config")
+	}
+	return filepath.Join(configHome, "lsptrace", "config.json")
+}
@@ -0,0 +1,92 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(content), 0666); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoad(t *testing.T) {
+	path := writeConfig(t, `{
+  "profiles": {
+    "gopls": {
+      "command": "gopls serve",
+      "env": {"GOFLAGS": "-mod=mod", "A": "1"},
+      "trace_output": "~/.lsptrace/{server}.lsptrace",
+      "exclude_methods": ["$/progress", "window/logMessage"],
+      "queue_size": 64,
+      "handle_named_pipes": false
+    },
+    "roslyn": {"argv": ["dotnet", "/path with spaces/roslyn.dll"]}
+  }
+}`)
+	c, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gopls, err := c.Profile("gopls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gopls.Command != "gopls serve" || !gopls.HasCommand() {
+		t.Fatalf("expected the command to be read, got %q", gopls.Command)
+	}
+	if env := gopls.EnvList(); !slices.Equal(env, []string{"A=1", "GOFLAGS=-mod=mod"}) {
+		t.Fatalf("expected sorted env, got %v", env)
+	}
+	expected := map[string]string{
+		"trace_output":       "~/.lsptrace/{server}.lsptrace",
+		"exclude_methods":    "$/progress,window/logMessage",
+		"queue_size":         "64",
+		"handle_named_pipes": "false",
+	}
+	for name, value := range expected {
+		if gopls.Options[name] != value {
+			t.Errorf("expected %s to be %q, got %q", name, value, gopls.Options[name])
+		}
+	}
+	if len(gopls.Options) != len(expected) {
+		t.Errorf("expected only options to be kept in Options, got %v", gopls.Options)
+	}
+	roslyn, err := c.Profile("roslyn")
+	if err != nil || !slices.Equal(roslyn.Argv, []string{"dotnet", "/path with spaces/roslyn.dll"}) {
+		t.Fatalf("expected the argv to be read, got %v %v", roslyn, err)
+	}
+	if _, err := c.Profile("rust-analyzer"); !errors.Is(err, ENOPROFILE) {
+		t.Fatalf("expected a missing profile error, got %v", err)
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	for _, content := range []string{
+		`{"profiles": {"a": {"command": "a", "argv": ["a"]}}}`,
+		`{"profiles": {"a": {"trace_output": {"path": "x"}}}}`,
+		`{"profiles": {"a": {"env": ["A=1"]}}}`,
+		`{"profiles": [`,
+	} {
+		if _, err := Load(writeConfig(t, content)); err == nil {
+			t.Errorf("expected %s to be invalid", content)
+		}
+	}
+}
+
+func TestDefaultPath(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", "")
+	if path := DefaultPath("/home/me"); path != filepath.Join("/home/me", ".config", "lsptrace", "config.json") {
+		t.Fatalf("unexpected default path %s", path)
+	}
+	t.Setenv("XDG_CONFIG_HOME", "/xdg")
+	if path := DefaultPath("/home/me"); path != filepath.Join("/xdg", "lsptrace", "config.json") {
+		t.Fatalf("unexpected default path %s", path)
+	}
+}
@@ -0,0 +1,357 @@
+package diff
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/mparq/lsptrace/internal"
+	"io"
+	"maps"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+const (
+	// values longer than this are shortened in the text output
+	MAX_VALUE_LENGTH = 80
+)
+
+var (
+	// json keys which are expected to change between sessions
+	DEFAULT_IGNORED_KEYS = []string{"processId", "workDoneToken", "partialResultToken"}
+	// methods whose params.token is a progress token made up by the sender,
+	// which is ignored like workDoneToken
+	PROGRESS_METHODS = map[string]bool{
+		"$/progress":                     true,
+		"window/workDoneProgress/create": true,
+		"window/workDoneProgress/cancel": true,
+	}
+)
+
+// Flow is a client or server message along with the response to it if
+// it was a request. Flows are what is aligned between two traces.
+type Flow struct {
+	// index of the message in its trace file
+	Index    int
+	Trace    *internal.LSPTrace
+	Response *internal.LSPTrace
+}
+
+// Key identifies which flows can be aligned with each other.
+func (f *Flow) Key() string {
+	method := ""
+	if f.Trace.Method != nil {
+		method = *f.Trace.Method
+	}
+	return fmt.Sprintf("%s %s %s", f.Trace.SentFrom, f.Trace.MessageKind, method)
+}
+
+// Change is a json level difference between two aligned flows.
+type Change struct {
+	Path string
+	A    string
+	B    string
+}
+
+// Pair is a flow from a aligned with a flow from b.
+type Pair struct {
+	A *Flow
+	B *Flow
+	// true if the flow is in a different position relative to the
+	// other aligned flows
+	Reordered bool
+	Changes   []Change
+}
+
+type Result struct {
+	// flows in a without a counterpart in b
+	Missing []*Flow
+	// flows in b without a counterpart in a
+	Added []*Flow
+	Pairs []*Pair
+}
+
+// Equal reports whether no differences were found.
+func (r *Result) Equal() bool {
+	if len(r.Missing) > 0 || len(r.Added) > 0 {
+		return false
+	}
+	for _, pair := range r.Pairs {
+		if pair.Reordered || len(pair.Changes) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Flows groups traces into flows pairing requests with their responses.
+// Responses without a request in the trace are kept as their own flow.
+// Only lsp messages are compared: stderr lines, server exits, dropped
+// markers, unparsed messages and messages lsptrace sent itself are left out.
+func Flows(traces []*internal.LSPTrace) []*Flow {
+	flows := make([]*Flow, 0)
+	pending := make(map[string]*Flow)
+	for i, trace := range traces {
+		if trace.Injected {
+			continue
+		}
+		switch trace.MessageKind {
+		case internal.REQUEST, internal.NOTIFICATION, internal.RESPONSE, internal.ERROR:
+		default:
+			continue
+		}
+		switch trace.MessageKind {
+		case internal.RESPONSE, internal.ERROR:
+			if trace.Id != nil {
+				key := trace.RequestKey()
+				if flow, ok := pending[key]; ok {
+					flow.Response = trace
+					delete(pending, key)
+					continue
+				}
+			}
+			flows = append(flows, &Flow{Index: i, Trace: trace})
+		default:
+			flow := &Flow{Index: i, Trace: trace}
+			flows = append(flows, flow)
+			if trace.MessageKind == internal.REQUEST && trace.Id != nil {
+				pending[trace.RequestKey()] = flow
+			}
+		}
+	}
+	return flows
+}
+
+// Compare aligns the flows of a and b. The n-th flow of a with a given key
+// is aligned with the n-th flow of b with the same key. ignoredKeys are
+// json object keys, or paths like 'params.rootUri', which are not compared.
+func Compare(a, b []*internal.LSPTrace, ignoredKeys []string) *Result {
+	ignored := make(map[string]bool)
+	for _, key := range ignoredKeys {
+		ignored[key] = true
+	}
+	aFlows, bFlows := Flows(a), Flows(b)
+	bByKey := make(map[string][]*Flow)
+	for _, flow := range bFlows {
+		bByKey[flow.Key()] = append(bByKey[flow.Key()], flow)
+	}
+
+	result := &Result{Missing: make([]*Flow, 0), Added: make([]*Flow, 0), Pairs: make([]*Pair, 0)}
+	matched := make(map[*Flow]bool)
+	for _, aFlow := range aFlows {
+		candidates := bByKey[aFlow.Key()]
+		if len(candidates) == 0 {
+			result.Missing = append(result.Missing, aFlow)
+			continue
+		}
+		bFlow := candidates[0]
+		bByKey[aFlow.Key()] = candidates[1:]
+		matched[bFlow] = true
+		pair := &Pair{A: aFlow, B: bFlow}
+		pair.Changes = compareFlows(aFlow, bFlow, ignored)
+		result.Pairs = append(result.Pairs, pair)
+	}
+	for _, bFlow := range bFlows {
+		if !matched[bFlow] {
+			result.Added = append(result.Added, bFlow)
+		}
+	}
+	markReordered(result.Pairs)
+	return result
+}
+
+// markReordered flags the pairs which are not part of the longest run of
+// pairs that keep the same relative order in both traces.
+func markReordered(pairs []*Pair) {
+	// patience sorting for the longest increasing subsequence of b indexes
+	tails := make([]int, 0)
+	prev := make([]int, len(pairs))
+	for i, pair := range pairs {
+		pos := sort.Search(len(tails), func(j int) bool {
+			return pairs[tails[j]].B.Index >= pair.B.Index
+		})
+		if pos > 0 {
+			prev[i] = tails[pos-1]
+		} else {
+			prev[i] = -1
+		}
+		if pos == len(tails) {
+			tails = append(tails, i)
+		} else {
+			tails[pos] = i
+		}
+	}
+	inOrder := make(map[int]bool)
+	if len(tails) > 0 {
+		for i := tails[len(tails)-1]; i >= 0; i = prev[i] {
+			inOrder[i] = true
+		}
+	}
+	for i, pair := range pairs {
+		pair.Reordered = !inOrder[i]
+	}
+}
+
+func compareFlows(a, b *Flow, ignored map[string]bool) []Change {
+	if a.Trace.Method != nil && PROGRESS_METHODS[*a.Trace.Method] {
+		ignored = maps.Clone(ignored)
+		ignored["params.token"] = true
+	}
+	changes := make([]Change, 0)
+	changes = compareRaw("params", a.Trace.Message.Params, b.Trace.Message.Params, ignored, changes)
+	changes = compareRaw("result", a.Trace.Message.Result, b.Trace.Message.Result, ignored, changes)
+	changes = compareRaw("error", a.Trace.Message.Error, b.Trace.Message.Error, ignored, changes)
+	var aResponse, bResponse internal.RawLSPMessage
+	if a.Response != nil {
+		aResponse = a.Response.Message
+	}
+	if b.Response != nil {
+		bResponse = b.Response.Message
+	}
+	if (a.Response == nil) != (b.Response == nil) {
+		changes = append(changes, Change{"response", describePresence(a.Response), describePresence(b.Response)})
+	}
+	changes = compareRaw("response.result", aResponse.Result, bResponse.Result, ignored, changes)
+	changes = compareRaw("response.error", aResponse.Error, bResponse.Error, ignored, changes)
+	return changes
+}
+
+func describePresence(trace *internal.LSPTrace) string {
+	if trace == nil {
+		return "<missing>"
+	}
+	return "<" + trace.MessageKind + ">"
+}
+
+func compareRaw(path string, a, b json.RawMessage, ignored map[string]bool, changes []Change) []Change {
+	if a == nil && b == nil {
+		return changes
+	}
+	var aValue, bValue any
+	aOk := a != nil && json.Unmarshal(a, &aValue) == nil
+	bOk := b != nil && json.Unmarshal(b, &bValue) == nil
+	if !aOk || !bOk {
+		if string(a) != string(b) {
+			changes = append(changes, Change{path, rawOrMissing(a), rawOrMissing(b)})
+		}
+		return changes
+	}
+	return compareValues(path, aValue, bValue, ignored, changes)
+}
+
+func compareValues(path string, a, b any, ignored map[string]bool, changes []Change) []Change {
+	switch av := a.(type) {
+	case map[string]any:
+		bv, ok := b.(map[string]any)
+		if !ok {
+			break
+		}
+		keys := make([]string, 0, len(av)+len(bv))
+		for key := range av {
+			keys = append(keys, key)
+		}
+		for key := range bv {
+			if _, ok := av[key]; !ok {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			childPath := path + "." + key
+			if ignored[key] || ignored[childPath] {
+				continue
+			}
+			aChild, aOk := av[key]
+			bChild, bOk := bv[key]
+			switch {
+			case !aOk:
+				changes = append(changes, Change{childPath, "<missing>", encode(bChild)})
+			case !bOk:
+				changes = append(changes, Change{childPath, encode(aChild), "<missing>"})
+			default:
+				changes = compareValues(childPath, aChild, bChild, ignored, changes)
+			}
+		}
+		return changes
+	case []any:
+		bv, ok := b.([]any)
+		if !ok {
+			break
+		}
+		for i := 0; i < len(av) || i < len(bv); i++ {
+			childPath := fmt.Sprintf("%s[%d]", path, i)
+			switch {
+			case i >= len(av):
+				changes = append(changes, Change{childPath, "<missing>", encode(bv[i])})
+			case i >= len(bv):
+				changes = append(changes, Change{childPath, encode(av[i]), "<missing>"})
+			default:
+				changes = compareValues(childPath, av[i], bv[i], ignored, changes)
+			}
+		}
+		return changes
+	}
+	if !reflect.DeepEqual(a, b) {
+		changes = append(changes, Change{path, encode(a), encode(b)})
+	}
+	return changes
+}
+
+// Write prints the result in a diff-like text format.
+func (r *Result) Write(w io.Writer, aName, bName string) error {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "--- %s\n+++ %s\n", aName, bName)
+	fmt.Fprintf(&sb, "%d aligned, %d missing, %d added\n", len(r.Pairs), len(r.Missing), len(r.Added))
+	for _, flow := range r.Missing {
+		fmt.Fprintf(&sb, "- %s (a:%d)\n", describe(flow), flow.Index+1)
+	}
+	for _, flow := range r.Added {
+		fmt.Fprintf(&sb, "+ %s (b:%d)\n", describe(flow), flow.Index+1)
+	}
+	for _, pair := range r.Pairs {
+		if pair.Reordered {
+			fmt.Fprintf(&sb, "~ %s (a:%d b:%d) reordered\n", describe(pair.A), pair.A.Index+1, pair.B.Index+1)
+		}
+	}
+	for _, pair := range r.Pairs {
+		if len(pair.Changes) == 0 {
+			continue
+		}
+		fmt.Fprintf(&sb, "! %s (a:%d b:%d)\n", describe(pair.A), pair.A.Index+1, pair.B.Index+1)
+		for _, change := range pair.Changes {
+			fmt.Fprintf(&sb, "    %s: %s -> %s\n", change.Path, shorten(change.A), shorten(change.B))
+		}
+	}
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+func describe(flow *Flow) string {
+	description := flow.Key()
+	if flow.Trace.Id != nil {
+		description += " id=" + flow.Trace.Id.String()
+	}
+	return description
+}
+
+func encode(value any) string {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprintf("%v", value)
+	}
+	return string(encoded)
+}
+
+func rawOrMissing(raw json.RawMessage) string {
+	if raw == nil {
+		return "<missing>"
+	}
+	return string(raw)
+}
+
+func shorten(value string) string {
+	if len(value) <= MAX_VALUE_LENGTH {
+		return value
+	}
+	return value[:MAX_VALUE_LENGTH-3] + "..."
+}
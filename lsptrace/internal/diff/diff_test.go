@@ -0,0 +1,117 @@
+package diff
+
+import (
+	"bytes"
+	"github.com/mparq/lsptrace/internal"
+	"strings"
+	"testing"
+)
+
+var (
+	aTrace = strings.Join([]string{
+		`{"msgKind":"request","from":"client","method":"initialize","id":1,"timestamp":"2024-11-28T12:01:45.000Z","msg":{"jsonrpc":"2.0","id":1,"method":"initialize","params":{"processId":100,"rootUri":"file:///a"}}}`,
+		`{"msgKind":"response","from":"server","method":"initialize","id":1,"timestamp":"2024-11-28T12:01:45.100Z","msg":{"jsonrpc":"2.0","id":1,"result":{"capabilities":{"hoverProvider":true}}}}`,
+		`{"msgKind":"notification","from":"client","method":"initialized","timestamp":"2024-11-28T12:01:45.200Z","msg":{"jsonrpc":"2.0","method":"initialized","params":{}}}`,
+		`{"msgKind":"notification","from":"client","method":"textDocument/didOpen","timestamp":"2024-11-28T12:01:45.300Z","msg":{"jsonrpc":"2.0","method":"textDocument/didOpen","params":{}}}`,
+		`{"msgKind":"notification","from":"server","method":"window/logMessage","timestamp":"2024-11-28T12:01:45.400Z","msg":{"jsonrpc":"2.0","method":"window/logMessage","params":{}}}`,
+	}, "\n")
+	bTrace = strings.Join([]string{
+		`{"msgKind":"request","from":"client","method":"initialize","id":"x","timestamp":"2025-01-01T00:00:00.000Z","msg":{"jsonrpc":"2.0","id":"x","method":"initialize","params":{"processId":200,"rootUri":"file:///a"}}}`,
+		`{"msgKind":"response","from":"server","method":"initialize","id":"x","timestamp":"2025-01-01T00:00:00.100Z","msg":{"jsonrpc":"2.0","id":"x","result":{"capabilities":{"hoverProvider":false}}}}`,
+		`{"msgKind":"notification","from":"client","method":"textDocument/didOpen","timestamp":"2025-01-01T00:00:00.200Z","msg":{"jsonrpc":"2.0","method":"textDocument/didOpen","params":{}}}`,
+		`{"msgKind":"notification","from":"client","method":"initialized","timestamp":"2025-01-01T00:00:00.300Z","msg":{"jsonrpc":"2.0","method":"initialized","params":{}}}`,
+		`{"msgKind":"notification","from":"server","method":"$/progress","timestamp":"2025-01-01T00:00:00.400Z","msg":{"jsonrpc":"2.0","method":"$/progress","params":{}}}`,
+	}, "\n")
+)
+
+func TestCompare(t *testing.T) {
+	a, err := internal.ReadTraces(strings.NewReader(aTrace))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := internal.ReadTraces(strings.NewReader(bTrace))
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := Compare(a, b, DEFAULT_IGNORED_KEYS)
+	out := new(bytes.Buffer)
+	result.Write(out, "a", "b")
+	t.Logf("diff:\n%s", out)
+
+	if result.Equal() {
+		t.Fatal("expected traces to differ")
+	}
+	if len(result.Missing) != 1 || *result.Missing[0].Trace.Method != "window/logMessage" {
+		t.Fatalf("expected logMessage to be missing in b, got %+v", result.Missing)
+	}
+	if len(result.Added) != 1 || *result.Added[0].Trace.Method != "$/progress" {
+		t.Fatalf("expected $/progress to be added in b, got %+v", result.Added)
+	}
+	reordered := 0
+	for _, pair := range result.Pairs {
+		if pair.Reordered {
+			reordered++
+		}
+		if *pair.A.Trace.Method == "initialize" {
+			if len(pair.Changes) != 1 || pair.Changes[0].Path != "response.result.capabilities.hoverProvider" {
+				t.Fatalf("expected only hoverProvider to change ignoring processId and ids, got %+v", pair.Changes)
+			}
+		}
+	}
+	if reordered != 1 {
+		t.Fatalf("expected a single reordered flow, got %d", reordered)
+	}
+}
+
+func TestCompareSameTrace(t *testing.T) {
+	a, _ := internal.ReadTraces(strings.NewReader(aTrace))
+	b, _ := internal.ReadTraces(strings.NewReader(aTrace))
+	if result := Compare(a, b, nil); !result.Equal() {
+		t.Fatal("expected a trace to be equal to itself")
+	}
+}
+
+func TestCompareSkipsVolatile(t *testing.T) {
+	a, _ := internal.ReadTraces(strings.NewReader(strings.Join([]string{
+		`{"msgKind":"request","from":"server","method":"window/workDoneProgress/create","id":1,"timestamp":"2024-11-28T12:01:45.000Z","msg":{"jsonrpc":"2.0","id":1,"method":"window/workDoneProgress/create","params":{"token":"a-1"}}}`,
+		`{"msgKind":"stderr","from":"server","timestamp":"2024-11-28T12:01:45.010Z","line":"starting","msg":{"jsonrpc":""}}`,
+		`{"msgKind":"notification","from":"server","method":"$/progress","timestamp":"2024-11-28T12:01:45.020Z","msg":{"jsonrpc":"2.0","method":"$/progress","params":{"token":"a-1","value":{"kind":"begin"}}}}`,
+		`{"msgKind":"dropped","from":"client","timestamp":"2024-11-28T12:01:45.030Z","droppedMessages":3,"msg":{"jsonrpc":""}}`,
+	}, "\n")))
+	b, _ := internal.ReadTraces(strings.NewReader(strings.Join([]string{
+		`{"msgKind":"request","from":"server","method":"window/workDoneProgress/create","id":7,"timestamp":"2025-01-01T00:00:00.000Z","msg":{"jsonrpc":"2.0","id":7,"method":"window/workDoneProgress/create","params":{"token":"b-9"}}}`,
+		`{"msgKind":"notification","from":"server","method":"$/progress","timestamp":"2025-01-01T00:00:00.020Z","msg":{"jsonrpc":"2.0","method":"$/progress","params":{"token":"b-9","value":{"kind":"begin"}}}}`,
+		`{"msgKind":"request","from":"client","method":"initialize","id":"lsptrace-restart-1","timestamp":"2025-01-01T00:00:00.030Z","injected":true,"msg":{"jsonrpc":"2.0","id":"lsptrace-restart-1","method":"initialize","params":{}}}`,
+		`{"msgKind":"server-exit","from":"server","timestamp":"2025-01-01T00:00:00.040Z","exit":{"code":1,"crashed":true},"msg":{"jsonrpc":""}}`,
+	}, "\n")))
+	result := Compare(a, b, DEFAULT_IGNORED_KEYS)
+	if !result.Equal() {
+		out := new(bytes.Buffer)
+		result.Write(out, "a", "b")
+		t.Fatalf("expected progress tokens and non-lsp traces to be ignored, got\n%s", out)
+	}
+	if len(result.Pairs) != 2 {
+		t.Fatalf("expected only the progress messages to be aligned, got %d pairs", len(result.Pairs))
+	}
+}
+
+func TestFlowsPairWithinSessions(t *testing.T) {
+	traces, err := internal.ReadTraces(strings.NewReader(strings.Join([]string{
+		`{"msgKind":"request","from":"client","method":"textDocument/hover","id":1,"sessionId":"a","timestamp":"2024-11-28T12:01:45.000Z","msg":{"jsonrpc":"2.0","id":1,"method":"textDocument/hover"}}`,
+		`{"msgKind":"request","from":"client","method":"textDocument/completion","id":1,"sessionId":"b","timestamp":"2024-11-28T12:01:45.010Z","msg":{"jsonrpc":"2.0","id":1,"method":"textDocument/completion"}}`,
+		`{"msgKind":"response","from":"server","method":"textDocument/completion","id":1,"sessionId":"b","timestamp":"2024-11-28T12:01:45.030Z","msg":{"jsonrpc":"2.0","id":1,"result":[]}}`,
+		`{"msgKind":"response","from":"server","method":"textDocument/hover","id":1,"sessionId":"a","timestamp":"2024-11-28T12:01:45.100Z","msg":{"jsonrpc":"2.0","id":1,"result":null}}`,
+	}, "\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	flows := Flows(traces)
+	if len(flows) != 2 {
+		t.Fatalf("expected a flow per request, got %d", len(flows))
+	}
+	for _, flow := range flows {
+		if flow.Response == nil || flow.Response.SessionId != flow.Trace.SessionId || *flow.Response.Method != *flow.Trace.Method {
+			t.Fatalf("expected each request to be paired with the response of its session, got %+v", flow)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package internal
+
+import (
+	"regexp"
+	"strings"
+)
+
+// MethodFilter decides which lsp methods are written to the trace using
+// glob patterns. '*' matches any characters (including '/') and '?' matches
+// a single character e.g. '$/*' or 'textDocument/did*'.
+type MethodFilter struct {
+	include []*regexp.Regexp
+	exclude []*regexp.Regexp
+}
+
+// NewMethodFilter creates a filter from comma-separated glob lists. If include
+// is empty all methods are included. exclude is applied after include.
+func NewMethodFilter(include, exclude string) *MethodFilter {
+	return &MethodFilter{include: compileGlobs(include), exclude: compileGlobs(exclude)}
+}
+
+// Allows reports whether messages for method should be traced. Messages
+// without a method (e.g. responses to unknown requests) are always traced.
+func (f *MethodFilter) Allows(method string) bool {
+	if f == nil || len(method) == 0 {
+		return true
+	}
+	if len(f.include) > 0 && !matchAny(f.include, method) {
+		return false
+	}
+	return !matchAny(f.exclude, method)
+}
+
+func matchAny(globs []*regexp.Regexp, method string) bool {
+	for _, glob := range globs {
+		if glob.MatchString(method) {
+			return true
+		}
+	}
+	return false
+}
+
+func compileGlobs(globs string) []*regexp.Regexp {
+	compiled := make([]*regexp.Regexp, 0)
+	for _, glob := range strings.Split(globs, ",") {
+		glob = strings.TrimSpace(glob)
+		if len(glob) == 0 {
+			continue
+		}
+		compiled = append(compiled, CompileGlob(glob))
+	}
+	return compiled
+}
+
+// CompileGlob converts a method glob into a regexp matching the whole method.
+func CompileGlob(glob string) *regexp.Regexp {
+	var sb strings.Builder
+	sb.WriteString("^")
+	for _, r := range glob {
+		switch r {
+		case '*':
+			sb.WriteString(".*")
+		case '?':
+			sb.WriteString(".")
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	sb.WriteString("$")
+	return regexp.MustCompile(sb.String())
+}
@@ -0,0 +1,50 @@
+package internal
+
+import "testing"
+
+func TestMethodFilter(t *testing.T) {
+	filter := NewMethodFilter("", "$/progress, window/*")
+	for method, expected := range map[string]bool{
+		"$/progress":          false,
+		"window/logMessage":   false,
+		"textDocument/hover":  true,
+		"$/cancelRequest":     true,
+		"":                    true,
+		"window/":             false,
+		"textDocument/window": true,
+	} {
+		if filter.Allows(method) != expected {
+			t.Errorf("expected Allows(%q) to be %v", method, expected)
+		}
+	}
+
+	filter = NewMethodFilter("textDocument/*,initialize", "textDocument/did*")
+	for method, expected := range map[string]bool{
+		"initialize":              true,
+		"textDocument/completion": true,
+		"textDocument/didOpen":    false,
+		"workspace/configuration": false,
+		"initialized":             false,
+	} {
+		if filter.Allows(method) != expected {
+			t.Errorf("expected Allows(%q) to be %v", method, expected)
+		}
+	}
+}
+
+func TestResponseFollowsRequestFilter(t *testing.T) {
+	tracer := NewLSPTracer(NewRequestMap())
+	tracer.SetMethodFilter(NewMethodFilter("", "workspace/configuration"))
+	method := "workspace/configuration"
+	request := tracer.MakeTrace(&RawLSPMessage{Id: NewIntId(1), Method: &method}, "server")
+	response := tracer.MakeTrace(&RawLSPMessage{Id: NewIntId(1), Result: []byte("[]")}, "client")
+	if !request.Excluded || !response.Excluded {
+		t.Fatal("expected request and its response to be excluded")
+	}
+	other := "textDocument/hover"
+	request = tracer.MakeTrace(&RawLSPMessage{Id: NewIntId(2), Method: &other}, "client")
+	response = tracer.MakeTrace(&RawLSPMessage{Id: NewIntId(2), Result: []byte("null")}, "server")
+	if request.Excluded || response.Excluded {
+		t.Fatal("expected hover request and its response to be traced")
+	}
+}
@@ -12,48 +12,127 @@ const (
 	NOTIFICATION = "notification"
 	RESPONSE     = "response"
 	ERROR        = "error"
+	// bytes from the stream which could not be parsed as a lsp message
+	PROTOCOL_ERROR = "protocolError"
+	// a framed body which isn't a json object
+	MALFORMED = "malformed"
+	// a json object which isn't a request, response or notification
+	UNKNOWN = "unknown"
+	// marks where messages were left out because the tracer fell behind
+	DROPPED = "dropped"
+	// a line the language server wrote to stderr
+	STDERR = "stderr"
+	// the language server process exited
+	SERVER_EXIT = "server-exit"
 )
 
+// ProtocolError describes input which didn't follow the lsp base protocol.
+type ProtocolError struct {
+	Reason string `json:"reason"`
+	// the offending bytes, possibly truncated
+	Data string `json:"data,omitempty"`
+}
+
+// ServerExit describes how the language server process exited.
+type ServerExit struct {
+	// -1 if the server was killed by a signal
+	Code   int    `json:"code"`
+	Signal string `json:"signal,omitempty"`
+	// whether the server exited before the client asked it to shut down
+	Crashed bool `json:"crashed"`
+}
+
 // Represents the raw jsonrpc message sent b/w client and server
 // as part of the LSP.
 type RawLSPMessage struct {
-	JsonRpc string  `json:"jsonrpc"`
-	Id      *int64  `json:"id,omitempty"`
-	Method  *string `json:"method,omitempty"`
+	JsonRpc string     `json:"jsonrpc"`
+	Id      *RequestId `json:"id,omitempty"`
+	Method  *string    `json:"method,omitempty"`
 	// NOTE: json.RawMessage used here to differentiate between null value and empty
 	// if field is empty, then json.RawMessage will be nil. If field is json null then
 	// the RawMessage will be the string "null"
 	Params json.RawMessage `json:"params,omitempty"`
 	Result json.RawMessage `json:"result,omitempty"`
 	Error  json.RawMessage `json:"error,omitempty"`
+	// Set instead of the fields above when the stream couldn't be parsed
+	ProtocolError *ProtocolError `json:"-"`
+	// For malformed and unknown messages, the body as it was received and
+	// for malformed messages why it couldn't be parsed
+	RawBody    []byte `json:"-"`
+	ParseError string `json:"-"`
+	// Set for messages which were sent as part of a jsonrpc batch array
+	BatchId int `json:"-"`
+	// Set instead of the fields above to the number of messages which
+	// were not traced
+	DroppedMessages int `json:"-"`
+	// When the tracer read the end of the message. The message is stamped
+	// with the time it is traced if unset
+	ReceivedAt time.Time `json:"-"`
 }
 
 func MessageKind(lspMessage *RawLSPMessage) string {
+	hasMethod := lspMessage.Method != nil && len(*lspMessage.Method) > 0
 	switch {
-	case lspMessage.Id != nil && lspMessage.Method != nil:
-		return "request"
+	case lspMessage.DroppedMessages > 0:
+		return DROPPED
+	case lspMessage.ProtocolError != nil:
+		return PROTOCOL_ERROR
+	case len(lspMessage.ParseError) > 0:
+		return MALFORMED
+	case lspMessage.Id != nil && hasMethod:
+		return REQUEST
 	case lspMessage.Id != nil && lspMessage.Method == nil && lspMessage.Result != nil:
-		return "response"
+		return RESPONSE
 	case lspMessage.Id != nil && lspMessage.Method == nil && lspMessage.Error != nil:
-		return "error"
-	case lspMessage.Id == nil && lspMessage.Method != nil:
-		return "notification"
+		return ERROR
+	case lspMessage.Id == nil && hasMethod:
+		return NOTIFICATION
 	}
-	return "unknown"
+	return UNKNOWN
 }
 
 type LSPTrace struct {
-	// LSP message kind: 'request' | 'response' | 'error' | 'notification'
+	// Order the trace was written in, shared by both directions
+	Seq int64 `json:"seq,omitempty"`
+	// LSP message kind: 'request' | 'response' | 'error' | 'notification' |
+	// 'protocolError' | 'malformed' | 'unknown' | 'dropped' | 'stderr' |
+	// 'server-exit'
 	MessageKind string `json:"msgKind"`
 	// Where the message was sent from 'client' | 'server'
 	SentFrom string `json:"from"`
 	// The LSP method. Empty for notifications, will be looked up for lsp responses
-	Method *string `json:"method,omitempty"`
-	Id     *int64  `json:"id,omitempty"`
+	Method *string    `json:"method,omitempty"`
+	Id     *RequestId `json:"id,omitempty"`
 	// UTC timestamp the message was received by the tracer
 	Timestamp time.Time `json:"timestamp"`
+	// For responses and errors, the UTC timestamp the matching request was
+	// received by the tracer and the time in ms it took to respond to it
+	RequestTimestamp *time.Time `json:"requestTimestamp,omitempty"`
+	DurationMs       *float64   `json:"durationMs,omitempty"`
 	// The parsed raw json message ('params' and 'result' will be here)
 	Message RawLSPMessage `json:"msg"`
+	// For protocol errors, what couldn't be parsed
+	ProtocolError *ProtocolError `json:"protocolError,omitempty"`
+	// For malformed and unknown messages, the body as it was received
+	RawBody string `json:"rawBody,omitempty"`
+	// For malformed messages, why the body couldn't be parsed
+	ParseError string `json:"parseError,omitempty"`
+	// Shared by messages which were sent in the same jsonrpc batch array
+	BatchId int `json:"batchId,omitempty"`
+	// For dropped markers, about how many messages were not traced
+	DroppedMessages int `json:"droppedMessages,omitempty"`
+	// For stderr entries, the line without its line ending
+	Line string `json:"line,omitempty"`
+	// For server-exit entries, how the server exited
+	Exit *ServerExit `json:"exit,omitempty"`
+	// Set for messages which lsptrace sent itself when restarting the
+	// language server rather than the client or server
+	Injected bool `json:"injected,omitempty"`
+	// The client session the message belongs to when tracing several
+	// sessions through the daemon
+	SessionId string `json:"sessionId,omitempty"`
+	// Set when the trace should not be written because of the method filter
+	Excluded bool `json:"-"`
 }
 
 // Convert Raw LSP JSON body into LSPTrace.
@@ -61,15 +140,31 @@ type LSPTrace struct {
 func (t *LSPTrace) FromRaw(rawLSPMessage *RawLSPMessage, sentFrom string) {
 	messageKind := MessageKind(rawLSPMessage)
 	*t = LSPTrace{
-		MessageKind: messageKind,
-		Method:      rawLSPMessage.Method,
-		Id:          rawLSPMessage.Id,
-		Message:     *rawLSPMessage,
-		SentFrom:    sentFrom,
-		Timestamp:   time.Now().UTC(),
+		MessageKind:     messageKind,
+		Method:          rawLSPMessage.Method,
+		Id:              rawLSPMessage.Id,
+		Message:         *rawLSPMessage,
+		ProtocolError:   rawLSPMessage.ProtocolError,
+		RawBody:         string(rawLSPMessage.RawBody),
+		ParseError:      rawLSPMessage.ParseError,
+		BatchId:         rawLSPMessage.BatchId,
+		DroppedMessages: rawLSPMessage.DroppedMessages,
+		SentFrom:        sentFrom,
+		Timestamp:       rawLSPMessage.ReceivedAt.UTC(),
+	}
+	if rawLSPMessage.ReceivedAt.IsZero() {
+		t.Timestamp = time.Now().UTC()
 	}
 }
 
+// Record the timestamp of the request t responds to and the time
+// elapsed between the request and t.
+func (t *LSPTrace) SetRequestTimestamp(requestTimestamp time.Time) {
+	durationMs := float64(t.Timestamp.Sub(requestTimestamp).Microseconds()) / 1000
+	t.RequestTimestamp = &requestTimestamp
+	t.DurationMs = &durationMs
+}
+
 func (m RawLSPMessage) String() string {
 	fields := make([]string, 0)
 	if m.Method != nil {
@@ -87,6 +182,12 @@ func (m RawLSPMessage) String() string {
 	if m.Error != nil {
 		fields = append(fields, fmt.Sprintf("Error=%v", string(m.Error)))
 	}
+	if m.ProtocolError != nil {
+		fields = append(fields, fmt.Sprintf("ProtocolError=%s", m.ProtocolError.Reason))
+	}
+	if len(m.ParseError) > 0 {
+		fields = append(fields, fmt.Sprintf("ParseError=%s", m.ParseError))
+	}
 	return fmt.Sprintf("RawLSPMessage[%s]", strings.Join(fields[0:], "|"))
 }
 
@@ -103,7 +204,36 @@ func (t LSPTrace) String() string {
 		fields = append(fields, df("Id", *t.Id))
 	}
 	fields = append(fields, df("Message", t.Message))
+	if t.ProtocolError != nil {
+		fields = append(fields, df("ProtocolError", t.ProtocolError.Reason))
+	}
 	fields = append(fields, df("Timestamp", t.Timestamp))
+	if t.DurationMs != nil {
+		fields = append(fields, df("DurationMs", *t.DurationMs))
+	}
+	if t.BatchId > 0 {
+		fields = append(fields, df("BatchId", t.BatchId))
+	}
 
 	return fmt.Sprintf("LSPTrace[%s]", strings.Join(fields, "|"))
 }
+
+// OtherSide is where a message sent from sentFrom went: 'client' for
+// 'server' and the other way around.
+func OtherSide(sentFrom string) string {
+	if sentFrom == "client" {
+		return "server"
+	}
+	return "client"
+}
+
+// RequestKey pairs a request with its response or error. Ids are only
+// unique per side and per session, and a daemon trace has the sessions of
+// several clients which all start counting at 1. Id must be set.
+func (t *LSPTrace) RequestKey() string {
+	requestFrom := t.SentFrom
+	if t.MessageKind == RESPONSE || t.MessageKind == ERROR {
+		requestFrom = OtherSide(t.SentFrom)
+	}
+	return t.SessionId + "/" + requestFrom + "/" + t.Id.String()
+}
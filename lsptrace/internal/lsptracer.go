@@ -1,49 +1,136 @@
 package internal
 
-import "log"
+import (
+	"log"
+	"time"
+)
 
 type LSPTracer struct {
 	clientReqMap *RequestMap
 	serverReqMap *RequestMap
+	// optional filter marking traces which should be left out
+	methodFilter *MethodFilter
+	// optional id of the session all traces belong to
+	sessionId string
+	// optional state which client messages are recorded to
+	sessionState *SessionState
 }
 
 func NewLSPTracer(reqMap *RequestMap) *LSPTracer {
 	clientReqMap := NewRequestMap()
 	serverReqMap := NewRequestMap()
-	return &LSPTracer{clientReqMap, serverReqMap}
+	return &LSPTracer{clientReqMap: clientReqMap, serverReqMap: serverReqMap}
+}
+
+// SetMethodFilter marks traces whose method isn't allowed by filter as
+// excluded. Responses are excluded whenever their request was.
+func (t *LSPTracer) SetMethodFilter(filter *MethodFilter) {
+	t.methodFilter = filter
+}
+
+// SetSessionId tags every trace with sessionId.
+func (t *LSPTracer) SetSessionId(sessionId string) {
+	t.sessionId = sessionId
+}
+
+// SetSessionState records every client message to state.
+func (t *LSPTracer) SetSessionState(state *SessionState) {
+	t.sessionState = state
+}
+
+// PendingClientRequests returns the ids of client requests which haven't
+// been responded to.
+func (t *LSPTracer) PendingClientRequests() []RequestId {
+	return t.clientReqMap.Ids()
+}
+
+// ObserveRaw passes a chunk read from the client to the session state, if
+// any, before it is queued to be traced.
+func (t *LSPTracer) ObserveRaw(chunk []byte, sentFrom string) {
+	if t != nil && sentFrom == "client" {
+		t.sessionState.ObserveRaw(chunk)
+	}
 }
 
 func (t *LSPTracer) MakeTrace(msg *RawLSPMessage, sentFrom string) (trace *LSPTrace) {
+	if sentFrom == "client" {
+		t.sessionState.Observe(msg)
+	}
+	return t.makeTrace(msg, sentFrom)
+}
+
+// MakeInjectedTrace makes a trace of a message lsptrace sent in place of
+// the client or server. It isn't recorded to the session state.
+func (t *LSPTracer) MakeInjectedTrace(msg *RawLSPMessage, sentFrom string) *LSPTrace {
+	trace := t.makeTrace(msg, sentFrom)
+	trace.Injected = true
+	return trace
+}
+
+func (t *LSPTracer) makeTrace(msg *RawLSPMessage, sentFrom string) (trace *LSPTrace) {
 	if sentFrom != "client" && sentFrom != "server" {
 		panic("assert: lsp tracer must specify valid 'sentFrom' source.")
 	}
 	log.Printf("lsptracer(%s): msg received from in channel\n", sentFrom)
 	trace = new(LSPTrace)
 	trace.FromRaw(msg, sentFrom)
+	trace.SessionId = t.sessionId
 	switch trace.MessageKind {
-	case "request":
+	case REQUEST:
+		trace.Excluded = !t.methodFilter.Allows(*trace.Method)
 		t.saveRequestMethod(trace, sentFrom)
-	case "response", "error":
-		method := t.popRequestMethod(trace, sentFrom)
-		trace.Method = &method
+	case RESPONSE, ERROR:
+		request, ok := t.popRequestMethod(trace, sentFrom)
+		trace.Method = &request.Method
+		if ok {
+			trace.SetRequestTimestamp(request.Timestamp)
+			trace.Excluded = request.Excluded
+		}
+	default:
+		if trace.Method != nil {
+			trace.Excluded = !t.methodFilter.Allows(*trace.Method)
+		}
 	}
 	log.Printf("lsptracer(%s): sending lsptrace method to out channel", sentFrom)
 	return trace
 }
 
+// MakeStderrTrace makes a trace of a line the language server wrote to
+// stderr.
+func (t *LSPTracer) MakeStderrTrace(line string) *LSPTrace {
+	return &LSPTrace{
+		MessageKind: STDERR,
+		SentFrom:    "server",
+		Timestamp:   time.Now().UTC(),
+		Line:        line,
+		SessionId:   t.sessionId,
+	}
+}
+
+// MakeServerExitTrace makes a trace of the language server exiting.
+func (t *LSPTracer) MakeServerExitTrace(exit *ServerExit) *LSPTrace {
+	return &LSPTrace{
+		MessageKind: SERVER_EXIT,
+		SentFrom:    "server",
+		Timestamp:   time.Now().UTC(),
+		Exit:        exit,
+		SessionId:   t.sessionId,
+	}
+}
+
 func (t *LSPTracer) saveRequestMethod(trace *LSPTrace, sentFrom string) {
 	if sentFrom == "client" {
 		log.Printf("push to client reqmap: %v\n", *trace.Id)
-		t.clientReqMap.PushRequest(*trace.Id, *trace.Method)
+		t.clientReqMap.PushRequest(*trace.Id, RequestInfo{Method: *trace.Method, Timestamp: trace.Timestamp, Excluded: trace.Excluded})
 		log.Printf("%v %s\n", &t.clientReqMap, t.clientReqMap)
 	} else {
 		log.Printf("push to server reqmap: %v\n", *trace.Id)
-		t.serverReqMap.PushRequest(*trace.Id, *trace.Method)
+		t.serverReqMap.PushRequest(*trace.Id, RequestInfo{Method: *trace.Method, Timestamp: trace.Timestamp, Excluded: trace.Excluded})
 		log.Printf("%v %s\n", &t.serverReqMap, t.serverReqMap)
 	}
 }
 
-func (t *LSPTracer) popRequestMethod(trace *LSPTrace, sentFrom string) string {
+func (t *LSPTracer) popRequestMethod(trace *LSPTrace, sentFrom string) (RequestInfo, bool) {
 	if sentFrom == "client" {
 		log.Printf("pop from server reqmap: %v\n", *trace.Id)
 		log.Printf("%v %s\n", &t.serverReqMap, t.serverReqMap)
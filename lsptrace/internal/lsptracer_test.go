@@ -2,15 +2,16 @@ package internal
 
 import (
 	"encoding/json"
+	"strings"
 	"testing"
 )
 
 func TestParse(t *testing.T) {
 
 	tracer := NewLSPTracer(NewRequestMap())
-	id := int64(64)
+	id := NewIntId(64)
 	method := "initialize"
-	msg := &RawLSPMessage{Id: &id, Method: &method, Params: json.RawMessage{}}
+	msg := &RawLSPMessage{Id: id, Method: &method, Params: json.RawMessage{}}
 	actual := tracer.MakeTrace(msg, "client")
 	t.Logf("actual: %s\n", actual)
 
@@ -19,21 +20,18 @@ func TestParse(t *testing.T) {
 func TestParseReqResponse(t *testing.T) {
 	reqMap := NewRequestMap()
 	tracer := NewLSPTracer(reqMap)
-	id := new(int64)
-	*id = 64
+	id := NewIntId(64)
 	var method *string
 	method = new(string)
 	*method = "initialize"
 	t.Logf("addr of method: %v", method)
 	clientTrace := tracer.MakeTrace(&RawLSPMessage{Id: id, Method: method, Params: json.RawMessage{}}, "client")
-	id = new(int64)
-	*id = 70
+	id = NewIntId(70)
 	method = new(string)
 	*method = "other-method"
 	t.Logf("addr of method after re-assign: %v", method)
 	otherTrace := tracer.MakeTrace(&RawLSPMessage{Id: id, Method: method, Params: []byte("{}")}, "client")
-	id = new(int64)
-	*id = int64(64)
+	id = NewIntId(64)
 	serverTrace := tracer.MakeTrace(&RawLSPMessage{Id: id, Result: json.RawMessage{}}, "server")
 	t.Log(clientTrace)
 	t.Log(otherTrace)
@@ -46,21 +44,18 @@ func TestParseReqResponse(t *testing.T) {
 func TestErrorMatchesRequest(t *testing.T) {
 	reqMap := NewRequestMap()
 	tracer := NewLSPTracer(reqMap)
-	id := new(int64)
-	*id = 64
+	id := NewIntId(64)
 	var method *string
 	method = new(string)
 	*method = "initialize"
 	t.Logf("addr of method: %v", method)
 	clientTrace := tracer.MakeTrace(&RawLSPMessage{Id: id, Method: method, Params: json.RawMessage{}}, "client")
-	id = new(int64)
-	*id = 70
+	id = NewIntId(70)
 	method = new(string)
 	*method = "other-method"
 	t.Logf("addr of method after re-assign: %v", method)
 	otherTrace := tracer.MakeTrace(&RawLSPMessage{Id: id, Method: method, Params: []byte("{}")}, "client")
-	id = new(int64)
-	*id = int64(64)
+	id = NewIntId(64)
 	serverTrace := tracer.MakeTrace(&RawLSPMessage{Id: id, Error: json.RawMessage{}}, "server")
 	t.Log(clientTrace)
 	t.Log(otherTrace)
@@ -70,3 +65,70 @@ func TestErrorMatchesRequest(t *testing.T) {
 	}
 
 }
+
+func TestStringIdMatchesRequest(t *testing.T) {
+	tracer := NewLSPTracer(NewRequestMap())
+	intMethod := "workspace/configuration"
+	stringMethod := "window/workDoneProgress/create"
+	tracer.MakeTrace(&RawLSPMessage{Id: NewIntId(1), Method: &intMethod}, "server")
+	tracer.MakeTrace(&RawLSPMessage{Id: NewStringId("1"), Method: &stringMethod}, "server")
+	stringTrace := tracer.MakeTrace(&RawLSPMessage{Id: NewStringId("1"), Result: []byte("null")}, "client")
+	if stringTrace.Method == nil || *stringTrace.Method != stringMethod {
+		t.Fatalf("string id \"1\" response should be matched to the string id request, got %v", stringTrace.Method)
+	}
+	intTrace := tracer.MakeTrace(&RawLSPMessage{Id: NewIntId(1), Result: []byte("[]")}, "client")
+	if intTrace.Method == nil || *intTrace.Method != intMethod {
+		t.Fatalf("number id 1 response should be matched to the number id request, got %v", intTrace.Method)
+	}
+}
+
+func TestResponseDuration(t *testing.T) {
+	tracer := NewLSPTracer(NewRequestMap())
+	method := "textDocument/completion"
+	clientTrace := tracer.MakeTrace(&RawLSPMessage{Id: NewIntId(3), Method: &method}, "client")
+	serverTrace := tracer.MakeTrace(&RawLSPMessage{Id: NewIntId(3), Result: []byte("[]")}, "server")
+	if serverTrace.RequestTimestamp == nil || !serverTrace.RequestTimestamp.Equal(clientTrace.Timestamp) {
+		t.Fatal("response trace should carry the timestamp of its request.")
+	}
+	expected := float64(serverTrace.Timestamp.Sub(clientTrace.Timestamp).Microseconds()) / 1000
+	if serverTrace.DurationMs == nil || *serverTrace.DurationMs != expected {
+		t.Fatalf("expected duration %v, got %v", expected, serverTrace.DurationMs)
+	}
+	if clientTrace.DurationMs != nil {
+		t.Fatal("request trace should not carry a duration.")
+	}
+
+	orphan := tracer.MakeTrace(&RawLSPMessage{Id: NewIntId(4), Result: []byte("[]")}, "server")
+	if orphan.DurationMs != nil || orphan.RequestTimestamp != nil {
+		t.Fatal("response without a matching request should not carry a duration.")
+	}
+}
+
+func TestMalformedTrace(t *testing.T) {
+	tracer := NewLSPTracer(NewRequestMap())
+	trace := tracer.MakeTrace(&RawLSPMessage{RawBody: []byte(`{"id":`), ParseError: "unexpected end of JSON input"}, "server")
+	if trace.MessageKind != MALFORMED || trace.RawBody != `{"id":` {
+		t.Fatalf("unexpected trace %s", trace)
+	}
+	traceJson, _ := json.Marshal(trace)
+	if !strings.Contains(string(traceJson), `"rawBody":"{\"id\":","parseError":"unexpected end of JSON input"`) {
+		t.Fatalf("expected raw body and parse error in trace json: %s", traceJson)
+	}
+
+	// an empty method can't be matched to a response
+	method := ""
+	trace = tracer.MakeTrace(&RawLSPMessage{Id: NewIntId(1), Method: &method}, "client")
+	if trace.MessageKind != UNKNOWN {
+		t.Fatalf("expected unknown kind, got %s", trace.MessageKind)
+	}
+}
+
+func TestSessionId(t *testing.T) {
+	tracer := NewLSPTracer(NewRequestMap())
+	tracer.SetSessionId("1")
+	method := "initialized"
+	trace := tracer.MakeTrace(&RawLSPMessage{Method: &method}, "client")
+	if trace.SessionId != "1" {
+		t.Fatalf("expected trace to be tagged with the session id, got %s", trace)
+	}
+}
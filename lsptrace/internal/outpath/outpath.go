@@ -0,0 +1,79 @@
+package outpath
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const (
+	// name of the link to the newest output file in its directory
+	LATEST = "latest"
+)
+
+var (
+	EUNKNOWNPLACEHOLDER = errors.New("outpath: unknown placeholder")
+	ENOTLINK            = errors.New("outpath: not a symlink")
+
+	placeholder = regexp.MustCompile(`\{([a-z]+)\}`)
+)
+
+// Expand replaces the {name} placeholders in path with their values in
+// vars e.g. '~/.lsptrace/{server}-{date}-{pid}.lsptrace'. Placeholders which
+// aren't in vars are an error so that a typo doesn't end up in a file name.
+func Expand(path string, vars map[string]string) (string, error) {
+	var err error
+	expanded := placeholder.ReplaceAllStringFunc(path, func(match string) string {
+		name := match[1 : len(match)-1]
+		value, ok := vars[name]
+		if !ok {
+			err = errors.Join(EUNKNOWNPLACEHOLDER, fmt.Errorf("{%s} in %q", name, path))
+			return match
+		}
+		return value
+	})
+	return expanded, err
+}
+
+// HasPlaceholders reports whether path contains any {name} placeholder.
+func HasPlaceholders(path string) bool {
+	return placeholder.MatchString(path)
+}
+
+// Sanitize makes value safe to use as part of a file name by replacing path
+// separators, spaces and other characters which need quoting with '_'.
+func Sanitize(value string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_', r == '.':
+			return r
+		default:
+			return '_'
+		}
+	}, value)
+}
+
+// LinkLatest points the 'latest' symlink in the directory of path at path.
+// The link is relative so that the directory can be moved, and it is
+// replaced with a rename so that readers never see it missing. A 'latest'
+// which isn't a symlink is left alone.
+func LinkLatest(path string) error {
+	dir, target := filepath.Split(path)
+	link := filepath.Join(dir, LATEST)
+	if info, err := os.Lstat(link); err == nil && info.Mode()&os.ModeSymlink == 0 {
+		return errors.Join(ENOTLINK, fmt.Errorf("%s already exists", link))
+	}
+	tmp := filepath.Join(dir, fmt.Sprintf(".%s.%d.tmp", LATEST, os.Getpid()))
+	os.Remove(tmp)
+	if err := os.Symlink(target, tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, link); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
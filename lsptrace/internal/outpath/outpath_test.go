@@ -0,0 +1,61 @@
+package outpath
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExpand(t *testing.T) {
+	vars := map[string]string{"server": "gopls", "date": "2024-11-28", "pid": "42"}
+	expanded, err := Expand("~/.lsptrace/{server}-{date}-{pid}.lsptrace", vars)
+	if err != nil || expanded != "~/.lsptrace/gopls-2024-11-28-42.lsptrace" {
+		t.Fatalf("expected placeholders to be replaced, got %q %v", expanded, err)
+	}
+	expanded, err = Expand("/tmp/{Server}/{}.lsptrace", vars)
+	if err != nil || expanded != "/tmp/{Server}/{}.lsptrace" {
+		t.Fatalf("expected text which isn't a placeholder to be kept, got %q %v", expanded, err)
+	}
+	if _, err := Expand("/tmp/{sever}.lsptrace", vars); !errors.Is(err, EUNKNOWNPLACEHOLDER) {
+		t.Fatalf("expected an unknown placeholder error, got %v", err)
+	}
+}
+
+func TestSanitize(t *testing.T) {
+	if sanitized := Sanitize("my project/v1.2"); sanitized != "my_project_v1.2" {
+		t.Fatalf("expected separators and spaces to be replaced, got %q", sanitized)
+	}
+	if !HasPlaceholders("/tmp/{session}.lsptrace") || HasPlaceholders("/tmp/trace.lsptrace") {
+		t.Fatal("expected only paths with a placeholder to be templated")
+	}
+}
+
+func TestLinkLatest(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"first.lsptrace", "second.lsptrace"} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(name), 0666); err != nil {
+			t.Fatal(err)
+		}
+		if err := LinkLatest(path); err != nil {
+			t.Fatalf("expected latest to be linked to %s, got %v", name, err)
+		}
+		target, err := os.Readlink(filepath.Join(dir, LATEST))
+		if err != nil || target != name {
+			t.Fatalf("expected latest to point at %s, got %q %v", name, target, err)
+		}
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil || len(entries) != 3 {
+		t.Fatalf("expected no temporary links to be left behind, got %v %v", entries, err)
+	}
+
+	other := t.TempDir()
+	if err := os.WriteFile(filepath.Join(other, LATEST), nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := LinkLatest(filepath.Join(other, "trace.lsptrace")); !errors.Is(err, ENOTLINK) {
+		t.Fatalf("expected a file called latest to be kept, got %v", err)
+	}
+}
@@ -1,24 +1,42 @@
 package pipeline
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/mparq/lsptrace/internal"
+	"io"
 	"log"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 )
 
 const (
 	SCANBUF_SIZE = 8 * 1024
+	// header sections longer than this are treated as garbage
+	MAX_HEADER_SIZE = 4 * 1024
+	// protocol error traces keep at most this many of the offending bytes
+	MAX_PROTOCOL_ERROR_DATA = 1024
+
+	// lower case header names including the separator
+	CONTENT_LENGTH_HEADER = "content-length:"
+	CONTENT_TYPE_HEADER   = "content-type:"
+	CONTENT_TYPE          = "application/vscode-jsonrpc"
 )
 
 var (
 	EPARSE             = errors.New("interceptor: could not parse json into lsp message")
 	EBUFREAD           = errors.New("interceptor: error occurred when parsing new line")
 	EREADCONTENTLENGTH = errors.New("interceptor: unexpected error reading content length header")
+	EEMPTYBATCH        = errors.New("interceptor: empty batch array")
+
+	// batch ids are shared by the client and server stages so that they
+	// are unique within a trace
+	lastBatchId atomic.Int64
 )
 
 // JsonRpcStage is designed to by streamed to as an io.Writer
@@ -32,6 +50,10 @@ type JsonRpcStage struct {
 	scanBuf           *bytes.Buffer
 
 	readingChunk bool
+	// set after input was lost until the next header is found
+	resyncing bool
+	// when the chunk being parsed was read
+	receivedAt time.Time
 }
 
 func NewJsonRpcStage() *JsonRpcStage {
@@ -43,27 +65,7 @@ func (t *JsonRpcStage) Run(in chan []byte) chan *internal.RawLSPMessage {
 	out := make(chan *internal.RawLSPMessage)
 	go func() {
 		for read := range in {
-			if t.readingChunk {
-				panic("unexpected: reading chunk in parallel")
-			}
-			t.readingChunk = true
-			log.Printf("pre scanbuf write: jsonrpc input: %s\n", string(read))
-			// write to scan buffer
-			t.scanBuf.Write(read)
-			var err error
-			var more bool
-			for {
-				log.Printf("post scanbuf write: attempt next")
-				// try to read as much as possible
-				more, err = t.next(out)
-				if err != nil || !more {
-					break
-				}
-			}
-			if err != nil {
-				log.Printf("interceptor:run Error parsing next %s \n", err)
-			}
-			t.readingChunk = false
+			t.Parse(read, out)
 		}
 		// close out channel after in closes
 		close(out)
@@ -71,6 +73,52 @@ func (t *JsonRpcStage) Run(in chan []byte) chan *internal.RawLSPMessage {
 	return out
 }
 
+// Parse appends chunk to the stream and sends every message which is
+// complete to out.
+func (t *JsonRpcStage) Parse(chunk []byte, out chan *internal.RawLSPMessage) {
+	t.ParseReceived(chunk, time.Now(), out)
+}
+
+// ParseReceived is Parse for a chunk which was read at receivedAt, e.g.
+// before it waited in a queue. The messages it completes are stamped with
+// receivedAt.
+func (t *JsonRpcStage) ParseReceived(chunk []byte, receivedAt time.Time, out chan *internal.RawLSPMessage) {
+	if t.readingChunk {
+		panic("unexpected: reading chunk in parallel")
+	}
+	t.readingChunk = true
+	t.receivedAt = receivedAt
+	log.Printf("pre scanbuf write: jsonrpc input: %s\n", string(chunk))
+	// write to scan buffer
+	t.scanBuf.Write(chunk)
+	var err error
+	var more bool
+	for {
+		log.Printf("post scanbuf write: attempt next")
+		// try to read as much as possible
+		more, err = t.next(out)
+		if err != nil || !more {
+			break
+		}
+	}
+	if err != nil {
+		log.Printf("interceptor:run Error parsing next %s \n", err)
+	}
+	t.readingChunk = false
+}
+
+// Resync discards the partially read message after a part of the stream
+// was lost. Everything up to the next header is then skipped without being
+// reported. Returns true if a partially read message was discarded.
+func (t *JsonRpcStage) Resync() bool {
+	discarded := t.gotHeader || len(bytes.TrimSpace(t.scanBuf.Bytes())) > 0
+	t.scanBuf.Reset()
+	t.gotHeader = false
+	t.nextContentLength = 0
+	t.resyncing = true
+	return discarded
+}
+
 // next advances in the rpc protocol read state
 // will return true if something was done (implies
 // that the caller should keep calling in case there
@@ -78,8 +126,33 @@ func (t *JsonRpcStage) Run(in chan []byte) chan *internal.RawLSPMessage {
 func (t *JsonRpcStage) next(out chan *internal.RawLSPMessage) (bool, error) {
 	switch {
 	case !t.gotHeader:
+		// resync: anything in front of the first header is skipped
+		start := headerStart(t.scanBuf.Bytes())
+		if start < 0 {
+			if t.scanBuf.Len() > MAX_HEADER_SIZE {
+				// keep the start of a header name split across reads
+				skip := t.scanBuf.Len() - partialHeaderLen(t.scanBuf.Bytes())
+				t.skip(out, skip, "no header found")
+				return true, nil
+			}
+			return false, nil
+		}
+		if start > 0 {
+			t.skip(out, start, "unexpected data before header")
+			return true, nil
+		}
+		t.resyncing = false
 		nl := bytes.Index(t.scanBuf.Bytes(), []byte("\r\n\r\n"))
-		if nl < 0 {
+		if nl < 0 || nl > MAX_HEADER_SIZE {
+			if nl > MAX_HEADER_SIZE || t.scanBuf.Len() > MAX_HEADER_SIZE {
+				// skip to the next header name after this one
+				skip := t.scanBuf.Len() - partialHeaderLen(t.scanBuf.Bytes())
+				if next := headerStart(t.scanBuf.Bytes()[1:]); next >= 0 {
+					skip = next + 1
+				}
+				t.skip(out, skip, "header section too long")
+				return true, nil
+			}
 			return false, nil
 		}
 		log.Printf("found header: %s\n", string(t.scanBuf.Bytes()[0:nl]))
@@ -91,25 +164,14 @@ func (t *JsonRpcStage) next(out chan *internal.RawLSPMessage) (bool, error) {
 			return false, err
 		}
 
-		// split header section by \r\n excluding the last \r\n\r\n (nl)
-		headers := strings.Split(string(readBuf[0:nl]), "\r\n")
-		contentLength := 0
-		for _, header := range headers {
-			// HACK: handle garbage in front of content-length header which is seen in wild
-			clIndex := strings.Index(header, "Content-Length: ")
-			if clIndex >= 0 {
-				clValue := header[clIndex+len("Content-Length: "):]
-				contentLength, err = strconv.Atoi(clValue)
-				if err != nil {
-					log.Printf("error converting content-length value [%s]: %s", clValue, err)
-					break
-				}
-			}
+		contentLength, err := parseHeaders(string(readBuf[0:nl]))
+		if contentLength <= 0 {
+			t.protocolError(out, err.Error(), readBuf)
+			return true, nil
 		}
-		if contentLength == 0 {
-			err = errors.Join(err, EREADCONTENTLENGTH)
-			panic(fmt.Sprintf("err:%s === headers:%s", err, string(readBuf[0:nl])))
-			// return false, err
+		if err != nil {
+			// the body can still be read, report the header problem and carry on
+			t.protocolError(out, err.Error(), readBuf)
 		}
 
 		t.nextContentLength = contentLength
@@ -122,23 +184,199 @@ func (t *JsonRpcStage) next(out chan *internal.RawLSPMessage) (bool, error) {
 		if t.scanBuf.Len() >= t.nextContentLength {
 			readBuf := make([]byte, t.nextContentLength)
 			t.scanBuf.Read(readBuf)
-
-			// parse raw json message
-			lspMessage := new(internal.RawLSPMessage)
-			err := json.Unmarshal(readBuf, lspMessage)
-			if err != nil {
-				log.Printf("unmarshall: err on %s", string(readBuf))
-				err = errors.Join(err, EPARSE)
-				t.nextContentLength = 0
-				t.gotHeader = false
-				return false, err
-			}
-			out <- lspMessage
 			// reset rpc read state
 			t.nextContentLength = 0
 			t.gotHeader = false
+
+			if bytes.HasPrefix(bytes.TrimSpace(readBuf), []byte("[")) {
+				t.parseBatch(out, readBuf)
+				return true, nil
+			}
+			t.send(out, parseMessage(readBuf))
 			return true, nil
 		}
 	}
 	return false, nil
 }
+
+// parseBatch sends each message of a jsonrpc batch array tagged with a
+// new batch id.
+func (t *JsonRpcStage) parseBatch(out chan *internal.RawLSPMessage, body []byte) {
+	var batch []json.RawMessage
+	err := json.Unmarshal(body, &batch)
+	if err == nil && len(batch) == 0 {
+		err = EEMPTYBATCH
+	}
+	if err != nil {
+		log.Printf("unmarshall: %s: err on %s", errors.Join(EPARSE, err), string(body))
+		t.send(out, &internal.RawLSPMessage{RawBody: body, ParseError: err.Error()})
+		return
+	}
+	batchId := int(lastBatchId.Add(1))
+	for _, raw := range batch {
+		lspMessage := parseMessage(raw)
+		lspMessage.BatchId = batchId
+		t.send(out, lspMessage)
+	}
+}
+
+// parseMessage parses a single jsonrpc message. Bodies which can't be
+// parsed are returned as malformed messages.
+func parseMessage(body []byte) *internal.RawLSPMessage {
+	lspMessage := new(internal.RawLSPMessage)
+	err := json.Unmarshal(body, lspMessage)
+	if err != nil {
+		log.Printf("unmarshall: %s: err on %s", errors.Join(EPARSE, err), string(body))
+		return &internal.RawLSPMessage{RawBody: body, ParseError: err.Error()}
+	}
+	if internal.MessageKind(lspMessage) == internal.UNKNOWN {
+		lspMessage.RawBody = body
+	}
+	return lspMessage
+}
+
+// skip drops n bytes from the scan buffer. Anything other than whitespace
+// is reported as a protocol error unless the stage is resyncing.
+func (t *JsonRpcStage) skip(out chan *internal.RawLSPMessage, n int, reason string) {
+	skipped := t.scanBuf.Next(n)
+	if !t.resyncing && len(bytes.TrimSpace(skipped)) > 0 {
+		t.protocolError(out, reason, skipped)
+	}
+}
+
+func (t *JsonRpcStage) protocolError(out chan *internal.RawLSPMessage, reason string, data []byte) {
+	log.Printf("interceptor: protocol error: %s: %q\n", reason, data)
+	// joined errors are reported on one line
+	reason = strings.ReplaceAll(reason, "\n", "; ")
+	if len(data) > MAX_PROTOCOL_ERROR_DATA {
+		data = data[:MAX_PROTOCOL_ERROR_DATA]
+	}
+	t.send(out, &internal.RawLSPMessage{ProtocolError: &internal.ProtocolError{Reason: reason, Data: string(data)}})
+}
+
+func (t *JsonRpcStage) send(out chan *internal.RawLSPMessage, msg *internal.RawLSPMessage) {
+	msg.ReceivedAt = t.receivedAt
+	out <- msg
+}
+
+// headerStart returns the index of the first known header name in buf
+// ignoring case or -1 if there is none.
+func headerStart(buf []byte) int {
+	lower := bytes.ToLower(buf)
+	start := -1
+	for _, name := range []string{CONTENT_LENGTH_HEADER, CONTENT_TYPE_HEADER} {
+		i := bytes.Index(lower, []byte(name))
+		if i >= 0 && (start < 0 || i < start) {
+			start = i
+		}
+	}
+	return start
+}
+
+// partialHeaderLen returns the length of the longest suffix of buf which is
+// the start of a known header name ignoring case.
+func partialHeaderLen(buf []byte) int {
+	lower := bytes.ToLower(buf[max(len(buf)-len(CONTENT_LENGTH_HEADER), 0):])
+	for i := range lower {
+		for _, name := range []string{CONTENT_LENGTH_HEADER, CONTENT_TYPE_HEADER} {
+			if bytes.HasPrefix([]byte(name), lower[i:]) {
+				return len(lower) - i
+			}
+		}
+	}
+	return 0
+}
+
+// parseHeaders parses a header section without the trailing \r\n\r\n.
+// Header names are case insensitive. The content length is returned along
+// with an error describing any problems with the headers, if the content
+// length is not positive the body can't be read.
+func parseHeaders(section string) (int, error) {
+	contentLength := 0
+	errs := make([]error, 0)
+	for _, header := range strings.Split(section, "\r\n") {
+		name, value, ok := strings.Cut(header, ":")
+		if !ok {
+			errs = append(errs, fmt.Errorf("malformed header %q", header))
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch strings.ToLower(strings.TrimSpace(name)) + ":" {
+		case CONTENT_LENGTH_HEADER:
+			length, err := strconv.Atoi(value)
+			if err != nil || length <= 0 {
+				errs = append(errs, errors.Join(EREADCONTENTLENGTH, fmt.Errorf("invalid content length %q", value)))
+				continue
+			}
+			contentLength = length
+		case CONTENT_TYPE_HEADER:
+			if err := checkContentType(value); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	if contentLength == 0 && len(errs) == 0 {
+		errs = append(errs, EREADCONTENTLENGTH)
+	}
+	return contentLength, errors.Join(errs...)
+}
+
+func checkContentType(value string) error {
+	params := strings.Split(value, ";")
+	if !strings.EqualFold(strings.TrimSpace(params[0]), CONTENT_TYPE) {
+		return fmt.Errorf("unsupported content type %q", value)
+	}
+	for _, param := range params[1:] {
+		key, charset, _ := strings.Cut(param, "=")
+		if !strings.EqualFold(strings.TrimSpace(key), "charset") {
+			continue
+		}
+		// utf8 is accepted for backwards compatibility
+		charset = strings.Trim(strings.TrimSpace(charset), `"`)
+		if !strings.EqualFold(charset, "utf-8") && !strings.EqualFold(charset, "utf8") {
+			return fmt.Errorf("unsupported charset %q", charset)
+		}
+	}
+	return nil
+}
+
+// WriteJsonRpcMessage writes body to w framed with a Content-Length header
+// as expected by the lsp base protocol.
+func WriteJsonRpcMessage(w io.Writer, body []byte) error {
+	frame := make([]byte, 0, len(body)+32)
+	frame = fmt.Appendf(frame, "Content-Length: %d\r\n\r\n", len(body))
+	frame = append(frame, body...)
+	_, err := w.Write(frame)
+	return err
+}
+
+// ReadJsonRpcMessage reads the next message framed as expected by the lsp
+// base protocol from r. The frame is returned as it was read along with
+// the parsed message so that it can be passed on unchanged.
+func ReadJsonRpcMessage(r *bufio.Reader) (frame []byte, msg *internal.RawLSPMessage, err error) {
+	headers := make([]string, 0)
+	for {
+		line, err := r.ReadString('\n')
+		frame = append(frame, line...)
+		if err != nil {
+			return frame, nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if len(line) == 0 {
+			break
+		}
+		headers = append(headers, line)
+		if len(frame) > MAX_HEADER_SIZE {
+			return frame, nil, errors.New("header section too long")
+		}
+	}
+	contentLength, err := parseHeaders(strings.Join(headers, "\r\n"))
+	if contentLength <= 0 {
+		return frame, nil, err
+	}
+	body := make([]byte, contentLength)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return frame, nil, err
+	}
+	return append(frame, body...), parseMessage(body), nil
+}
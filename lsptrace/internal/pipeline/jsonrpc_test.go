@@ -1,9 +1,14 @@
 package pipeline
 
 import (
+	"bufio"
 	"bytes"
+	"fmt"
+	"github.com/mparq/lsptrace/internal"
 	"io"
 	"os"
+	"slices"
+	"strings"
 	"testing"
 )
 
@@ -90,3 +95,166 @@ func TestRaw(t *testing.T) {
 		t.Logf("jsonrpcrawtest: %s", msg)
 	}
 }
+
+func runChunks(chunks ...string) []*internal.RawLSPMessage {
+	in := make(chan []byte)
+	out := NewJsonRpcStage().Run(in)
+	go func() {
+		defer close(in)
+		for _, chunk := range chunks {
+			in <- []byte(chunk)
+		}
+	}()
+	msgs := make([]*internal.RawLSPMessage, 0)
+	for msg := range out {
+		msgs = append(msgs, msg)
+	}
+	return msgs
+}
+
+func frame(body string) string {
+	return fmt.Sprintf("Content-Length: %d\r\n\r\n%s", len(body), body)
+}
+
+func TestHeaderNamesIgnoreCase(t *testing.T) {
+	body := `{"jsonrpc":"2.0","method":"initialized"}`
+	msgs := runChunks(fmt.Sprintf("content-length: %d\r\nCONTENT-TYPE: application/vscode-jsonrpc; charset=utf8\r\n\r\n%s", len(body), body))
+	if len(msgs) != 1 || internal.MessageKind(msgs[0]) != internal.NOTIFICATION {
+		t.Fatalf("expected a single notification, got %v", msgs)
+	}
+}
+
+func TestProtocolErrors(t *testing.T) {
+	body := `{"jsonrpc":"2.0","method":"initialized"}`
+	tests := []struct {
+		name   string
+		chunks []string
+		// expected kinds in order
+		kinds []string
+		// substring of the first protocol error reason
+		reason string
+	}{
+		{"garbage before header", []string{"log output\n", frame(body)},
+			[]string{internal.PROTOCOL_ERROR, internal.NOTIFICATION}, "before header"},
+		{"garbage on header line", []string{"junk" + frame(body)},
+			[]string{internal.PROTOCOL_ERROR, internal.NOTIFICATION}, "before header"},
+		{"missing content length", []string{"Content-Type: application/vscode-jsonrpc\r\n\r\n", frame(body)},
+			[]string{internal.PROTOCOL_ERROR, internal.NOTIFICATION}, "content length"},
+		{"invalid content length", []string{"Content-Length: abc\r\n\r\n", frame(body)},
+			[]string{internal.PROTOCOL_ERROR, internal.NOTIFICATION}, "invalid content length"},
+		{"bad charset", []string{fmt.Sprintf("Content-Length: %d\r\nContent-Type: application/vscode-jsonrpc; charset=latin1\r\n\r\n%s", len(body), body)},
+			[]string{internal.PROTOCOL_ERROR, internal.NOTIFICATION}, "charset"},
+		{"bad content type", []string{fmt.Sprintf("Content-Length: %d\r\nContent-Type: text/plain\r\n\r\n%s", len(body), body)},
+			[]string{internal.PROTOCOL_ERROR, internal.NOTIFICATION}, "content type"},
+		{"no header", []string{strings.Repeat("x", MAX_HEADER_SIZE+1), frame(body)},
+			[]string{internal.PROTOCOL_ERROR, internal.NOTIFICATION}, "no header"},
+		{"header too long", []string{"Content-Length: 10\r\n" + strings.Repeat("x", MAX_HEADER_SIZE), frame(body)},
+			[]string{internal.PROTOCOL_ERROR, internal.NOTIFICATION}, "too long"},
+		{"whitespace is skipped", []string{"\r\n", frame(body), "\n"},
+			[]string{internal.NOTIFICATION}, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			msgs := runChunks(test.chunks...)
+			kinds := make([]string, len(msgs))
+			for i, msg := range msgs {
+				kinds[i] = internal.MessageKind(msg)
+			}
+			if !slices.Equal(kinds, test.kinds) {
+				t.Fatalf("expected kinds %v, got %v", test.kinds, kinds)
+			}
+			if len(test.reason) > 0 && !strings.Contains(msgs[0].ProtocolError.Reason, test.reason) {
+				t.Fatalf("expected reason to contain %q, got %q", test.reason, msgs[0].ProtocolError.Reason)
+			}
+		})
+	}
+}
+
+func TestHeaderSplitAfterGarbage(t *testing.T) {
+	body := `{"jsonrpc":"2.0","method":"initialized"}`
+	framed := frame(body)
+	msgs := runChunks(strings.Repeat("x", MAX_HEADER_SIZE)+framed[:5], framed[5:])
+	if len(msgs) != 2 || internal.MessageKind(msgs[1]) != internal.NOTIFICATION {
+		t.Fatalf("expected a protocol error and a notification, got %v", msgs)
+	}
+}
+
+func TestMalformedAndUnknownBodies(t *testing.T) {
+	msgs := runChunks(frame(`{"jsonrpc":`), frame(`"text"`), frame(`{"jsonrpc":"2.0","id":1}`), frame(`{"jsonrpc":"2.0","id":2,"method":""}`))
+	expected := []struct {
+		kind string
+		body string
+	}{
+		{internal.MALFORMED, `{"jsonrpc":`},
+		{internal.MALFORMED, `"text"`},
+		{internal.UNKNOWN, `{"jsonrpc":"2.0","id":1}`},
+		{internal.UNKNOWN, `{"jsonrpc":"2.0","id":2,"method":""}`},
+	}
+	if len(msgs) != len(expected) {
+		t.Fatalf("expected %d messages, got %v", len(expected), msgs)
+	}
+	for i, msg := range msgs {
+		if kind := internal.MessageKind(msg); kind != expected[i].kind || string(msg.RawBody) != expected[i].body {
+			t.Errorf("expected %s %s, got %s %s", expected[i].kind, expected[i].body, kind, msg.RawBody)
+		}
+		if expected[i].kind == internal.MALFORMED && len(msg.ParseError) == 0 {
+			t.Errorf("expected a parse error for %s", msg.RawBody)
+		}
+	}
+}
+
+func TestInvalidBatches(t *testing.T) {
+	msgs := runChunks(frame(`[]`), frame(`[1,{"jsonrpc":"2.0","method":"initialized"}]`), frame(`[{"jsonrpc":`))
+	kinds := make([]string, len(msgs))
+	for i, msg := range msgs {
+		kinds[i] = internal.MessageKind(msg)
+	}
+	expected := []string{internal.MALFORMED, internal.MALFORMED, internal.NOTIFICATION, internal.MALFORMED}
+	if !slices.Equal(kinds, expected) {
+		t.Fatalf("expected kinds %v, got %v", expected, kinds)
+	}
+	if msgs[0].BatchId != 0 || msgs[1].BatchId == 0 || msgs[1].BatchId != msgs[2].BatchId || string(msgs[1].RawBody) != "1" {
+		t.Fatalf("unexpected batch messages %v", msgs)
+	}
+}
+
+func TestResync(t *testing.T) {
+	lost := frame(`{"jsonrpc":"2.0","method":"lost"}`)
+	next := frame(`{"jsonrpc":"2.0","method":"next"}`)
+	stage := NewJsonRpcStage()
+	out := make(chan *internal.RawLSPMessage, 10)
+	stage.Parse([]byte(lost[:30]), out)
+	if !stage.Resync() {
+		t.Fatal("expected the partially read message to be discarded")
+	}
+	// the rest of the lost message is skipped without a protocol error
+	stage.Parse([]byte(lost[40:]+next), out)
+	close(out)
+	msgs := make([]*internal.RawLSPMessage, 0)
+	for msg := range out {
+		msgs = append(msgs, msg)
+	}
+	if len(msgs) != 1 || *msgs[0].Method != "next" {
+		t.Fatalf("expected only the message after the gap, got %v", msgs)
+	}
+	if stage.Resync() {
+		t.Fatal("expected nothing to discard between messages")
+	}
+}
+
+func TestReadJsonRpcMessage(t *testing.T) {
+	first := frame(`{"jsonrpc":"2.0","id":"a","result":null}`)
+	second := "content-length: 40\r\nContent-Type: application/vscode-jsonrpc\r\n\r\n" + `{"jsonrpc":"2.0","method":"initialized"}`
+	r := bufio.NewReader(strings.NewReader(first + second + "Content-Length: 10\r\n\r\n{}"))
+	readFrame, msg, err := ReadJsonRpcMessage(r)
+	if err != nil || string(readFrame) != first || internal.MessageKind(msg) != internal.RESPONSE || msg.Id.String() != `"a"` {
+		t.Fatalf("expected the first frame, got %q %v %v", readFrame, msg, err)
+	}
+	readFrame, msg, err = ReadJsonRpcMessage(r)
+	if err != nil || string(readFrame) != second || *msg.Method != "initialized" {
+		t.Fatalf("expected the second frame, got %q %v %v", readFrame, msg, err)
+	}
+	if _, _, err := ReadJsonRpcMessage(r); err == nil {
+		t.Fatal("expected an error for a truncated body")
+	}
+}
@@ -3,52 +3,123 @@ package pipeline
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"github.com/mparq/lsptrace/internal"
+	"github.com/mparq/lsptrace/internal/redact"
 	"io"
 	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
 )
 
+// syncMarker is passed from the jsonrpc stage to the trace stage when the
+// stream is synced by Hold.
+var syncMarker = new(internal.RawLSPMessage)
+
 type Pipeline struct {
 	// inputs
-	rawIn    io.Reader
-	rawOut   io.Writer
-	traceOut io.Writer
+	rawIn  io.Reader
+	rawOut io.Writer
+	// shared with the pipeline of the other direction
+	traceWriter *TraceWriter
+	// optional output which raw chunks are recorded to before parsing
+	captureOut io.Writer
+	// optional redaction applied to traces before they are written
+	redactor *redact.Redactor
 	// label representing the source of the pipeline (client | server)
 	sentFrom string
 	// the work node which has an input channel expecting raw jsonrpc message
 	// and output channel which it will send processed LSPTrace items to
 	lspTracer *internal.LSPTracer
+
+	// bounded queue of chunks which were forwarded but not yet traced
+	queueSize   int
+	queuePolicy string
+
+	// guards the queue so that Stop can close it
+	inputMutex sync.Mutex
+	queue      chan queuedChunk
+	stopped    bool
+	// set between Hold and Resume, when chunks are kept instead of being
+	// forwarded to rawOut
+	holding bool
+	held    bytes.Buffer
+	// set when chunks were dropped since the last dropped marker was queued
+	gap bool
+	// headers seen in those chunks
+	gapHeaders int
+	// why reading rawIn failed, if it didn't end normally
+	readErr error
+
+	metrics queueMetrics
 }
 
-func NewPipeline(rawIn io.Reader, rawOut io.Writer, traceOut io.Writer, lspTracer *internal.LSPTracer, sentFrom string) *Pipeline {
+func NewPipeline(rawIn io.Reader, rawOut io.Writer, traceWriter *TraceWriter, lspTracer *internal.LSPTracer, sentFrom string) *Pipeline {
 	log.Printf("%s pipeline lspTracer addr %v\n", sentFrom, lspTracer)
-	return &Pipeline{rawIn, rawOut, traceOut, sentFrom, lspTracer}
+	p := &Pipeline{
+		rawIn:       rawIn,
+		rawOut:      rawOut,
+		traceWriter: traceWriter,
+		sentFrom:    sentFrom,
+		lspTracer:   lspTracer,
+		queueSize:   DEFAULT_QUEUE_SIZE,
+		queuePolicy: QUEUE_BLOCK,
+	}
+	p.metrics.capacity = DEFAULT_QUEUE_SIZE
+	return p
+}
+
+// SetCaptureOutput enables recording every raw chunk read from rawIn,
+// along with its direction and timestamp, as json lines to captureOut.
+// Must be called before Run.
+func (p *Pipeline) SetCaptureOutput(captureOut io.Writer) {
+	p.captureOut = captureOut
+}
+
+// SetQueue sets how many chunks may be waiting to be traced and what
+// happens to further chunks when that many are waiting. Either way chunks
+// are forwarded to rawOut right away. Must be called before Run.
+func (p *Pipeline) SetQueue(size int, policy string) error {
+	if err := ValidateQueue(size, policy); err != nil {
+		return err
+	}
+	p.queueSize, p.queuePolicy = size, policy
+	p.metrics.capacity = size
+	return nil
+}
+
+// SetRedactor redacts every trace with redactor before it is written.
+// Must be called before Run.
+func (p *Pipeline) SetRedactor(redactor *redact.Redactor) {
+	p.redactor = redactor
 }
 
 func (p *Pipeline) Run() (done chan int) {
 	inputOut, start := p.RunInputStage(p.rawIn, p.rawOut)
 	jsonRpcOut := p.RunJsonRpcStage(inputOut)
 	runTraceOut := p.RunLSPTraceStage(jsonRpcOut, p.lspTracer)
-	done = p.RunOutputStage(runTraceOut, p.traceOut)
+	done = p.RunOutputStage(runTraceOut, p.traceWriter)
 	// wait to hook up all channels and then send start signal to pipeline input stage
 	start <- 1
 	return done
 }
 
 // InputStage: streams data from raw input to raw output and the returned out channel
-func (p *Pipeline) RunInputStage(rawIn io.Reader, rawOut io.Writer) (out chan []byte, start chan int) {
+func (p *Pipeline) RunInputStage(rawIn io.Reader, rawOut io.Writer) (out chan queuedChunk, start chan int) {
 	// TODO: start is used to "wait" for the other stages to be set up to start the pipeline (reading from rawIn)
 	// should be a cleaner way to do this
 	start = make(chan int)
-	out = make(chan []byte)
-	// cw := channel.NewWriter(out)
+	out = make(chan queuedChunk, p.queueSize)
+	p.queue = out
+	p.rawOut = rawOut
 	// do work
 	go func() {
-		defer close(out)
+		defer p.closeInput()
 		<-start
 		buf := make([]byte, 16*1024)
 		s := 0
-		// TODO: channel writer is choking the copy
 		var err error
 		for {
 			var nr int
@@ -58,12 +129,9 @@ func (p *Pipeline) RunInputStage(rawIn io.Reader, rawOut io.Writer) (out chan []
 			}
 			if nr > 0 {
 				e := s + nr
-				// TODO: error case
-				// NOTE: do we need to clone here? or should consuming channels
-				// be expected to block this?
-				outClone := bytes.Clone(buf[s:e])
-				rawOut.Write(outClone)
-				out <- outClone
+				if !p.forward(bytes.Clone(buf[s:e])) {
+					return
+				}
 				if e >= len(buf) {
 					s = 0
 				} else {
@@ -71,16 +139,189 @@ func (p *Pipeline) RunInputStage(rawIn io.Reader, rawOut io.Writer) (out chan []
 				}
 			}
 		}
-		if err != io.EOF {
-			log.Fatalf("error reading file %s", err)
+		if err != io.EOF && !errors.Is(err, net.ErrClosed) && !errors.Is(err, os.ErrClosed) {
+			// other pipelines (e.g. other daemon sessions) keep running
+			log.Printf("pipeline: input stage: error reading %s input: %s\n", p.sentFrom, err)
+			p.readErr = err
 		}
 	}()
 	return out, start
 }
 
-func (p *Pipeline) RunJsonRpcStage(in chan []byte) chan *internal.RawLSPMessage {
+// forward writes a chunk read from the input to the raw output and queues
+// it to be traced. When the queue is full the chunk waits for room or, with
+// the drop policy, is dropped. Returns false if the pipeline was stopped.
+func (p *Pipeline) forward(chunk []byte) bool {
+	readAt := time.Now()
+	p.inputMutex.Lock()
+	defer p.inputMutex.Unlock()
+	if p.stopped {
+		return false
+	}
+	// captured before anything can be dropped so that the capture is the
+	// exact stream whatever the queue policy
+	if p.captureOut != nil {
+		p.captureChunk(chunk, readAt)
+	}
+	// shutdown has to be seen even if it is dropped or still queued when
+	// the server exits
+	p.lspTracer.ObserveRaw(chunk, p.sentFrom)
+	if p.holding {
+		p.held.Write(chunk)
+	} else {
+		p.rawOut.Write(chunk)
+	}
+	item := queuedChunk{data: chunk, queuedAt: readAt}
+	if p.queuePolicy == QUEUE_BLOCK {
+		p.metrics.queued(item)
+		p.queue <- item
+		return true
+	}
+	// the marker has to come before the next chunk so that the parser
+	// knows to resync
+	if p.gap && p.tryQueue(p.gapMarker()) {
+		p.gap, p.gapHeaders = false, 0
+	}
+	if p.gap || !p.tryQueue(item) {
+		p.drop(chunk)
+	}
+	return true
+}
+
+func (p *Pipeline) captureChunk(chunk []byte, readAt time.Time) {
+	capture := internal.RawCapture{SentFrom: p.sentFrom, Timestamp: readAt.UTC(), Data: chunk}
+	captureJson, err := json.Marshal(capture)
+	if err != nil {
+		log.Printf("pipeline: input stage: unexpected error marshalling raw capture: %s\n", err)
+		return
+	}
+	// write as a single line so that chunks from both pipelines don't interleave
+	p.captureOut.Write(append(captureJson, '\n'))
+}
+
+func (p *Pipeline) tryQueue(item queuedChunk) bool {
+	p.metrics.queued(item)
+	select {
+	case p.queue <- item:
+		return true
+	default:
+		p.metrics.unqueued(item)
+		return false
+	}
+}
+
+// drop records a gap in the traced stream. Messages with a header in chunk
+// are counted as dropped, the parser counts the message it was reading.
+func (p *Pipeline) drop(chunk []byte) {
+	p.gap = true
+	p.gapHeaders += bytes.Count(bytes.ToLower(chunk), []byte(CONTENT_LENGTH_HEADER))
+	p.metrics.droppedChunks.Add(1)
+	log.Printf("pipeline: %s queue full, dropped %d bytes\n", p.sentFrom, len(chunk))
+}
+
+func (p *Pipeline) closeInput() {
+	p.inputMutex.Lock()
+	defer p.inputMutex.Unlock()
+	if !p.stopped {
+		p.stopped = true
+		if p.gap {
+			// the consumer is still draining the queue
+			marker := p.gapMarker()
+			p.metrics.queued(marker)
+			p.queue <- marker
+			p.gap, p.gapHeaders = false, 0
+		}
+		close(p.queue)
+	}
+}
+
+// Hold keeps everything read from now on instead of forwarding it to rawOut
+// until Resume is called. synced is called once every message which was
+// forwarded was traced and before any held message is traced, so that what
+// the other side received can be looked at while nothing else is traced.
+// Returns false if the pipeline was stopped.
+func (p *Pipeline) Hold(synced func()) bool {
+	p.inputMutex.Lock()
+	defer p.inputMutex.Unlock()
+	if p.stopped {
+		return false
+	}
+	p.holding = true
+	if p.gap {
+		marker := p.gapMarker()
+		p.metrics.queued(marker)
+		p.queue <- marker
+		p.gap, p.gapHeaders = false, 0
+	}
+	// the sync marker can't be dropped whatever the queue policy
+	marker := queuedChunk{synced: synced, queuedAt: time.Now()}
+	p.metrics.queued(marker)
+	p.queue <- marker
+	return true
+}
+
+// Resume writes what was held to rawOut and forwards to it from now on.
+func (p *Pipeline) Resume(rawOut io.Writer) {
+	p.inputMutex.Lock()
+	defer p.inputMutex.Unlock()
+	if p.held.Len() > 0 {
+		rawOut.Write(p.held.Bytes())
+	}
+	p.held.Reset()
+	p.rawOut = rawOut
+	p.holding = false
+}
+
+func (p *Pipeline) gapMarker() queuedChunk {
+	return queuedChunk{gap: true, gapHeaders: p.gapHeaders, queuedAt: time.Now()}
+}
+
+// Err is the error reading the input failed with. It is nil if the input
+// ended or was closed. Only set once the done channel returned by Run is
+// signaled.
+func (p *Pipeline) Err() error {
+	return p.readErr
+}
+
+// Stop ends the pipeline without waiting for the end of rawIn, which may
+// never come. Everything read so far is still traced before the done channel
+// returned by Run is signaled.
+func (p *Pipeline) Stop() {
+	p.closeInput()
+}
+
+// RunJsonRpcStage parses the queued chunks. Messages are stamped with the
+// time their last chunk was read rather than the time it was dequeued, so
+// that timestamps and latencies don't include the queue lag.
+func (p *Pipeline) RunJsonRpcStage(in chan queuedChunk) chan *internal.RawLSPMessage {
 	jsonRpcStage := NewJsonRpcStage()
-	return jsonRpcStage.Run(in)
+	out := make(chan *internal.RawLSPMessage)
+	go func() {
+		for item := range in {
+			p.metrics.dequeued(item)
+			if item.synced != nil {
+				// the trace stage only takes the marker once it is done
+				// with the message in front of it
+				out <- syncMarker
+				item.synced()
+				continue
+			}
+			if item.gap {
+				dropped := item.gapHeaders
+				if jsonRpcStage.Resync() {
+					dropped++
+				}
+				// at least part of a message was lost
+				dropped = max(dropped, 1)
+				p.metrics.droppedMessages.Add(int64(dropped))
+				out <- &internal.RawLSPMessage{DroppedMessages: dropped, ReceivedAt: item.queuedAt}
+				continue
+			}
+			jsonRpcStage.ParseReceived(item.data, item.queuedAt, out)
+		}
+		close(out)
+	}()
+	return out
 }
 
 func (p *Pipeline) RunLSPTraceStage(in chan *internal.RawLSPMessage, lspTracer *internal.LSPTracer) chan *internal.LSPTrace {
@@ -88,7 +329,13 @@ func (p *Pipeline) RunLSPTraceStage(in chan *internal.RawLSPMessage, lspTracer *
 	// do work
 	go func() {
 		for jsonrpc := range in {
-			trace := lspTracer.MakeTrace(jsonrpc, p.sentFrom)
+			if jsonrpc == syncMarker {
+				continue
+			}
+			trace := p.traceWriter.Sequence(func() *internal.LSPTrace {
+				return lspTracer.MakeTrace(jsonrpc, p.sentFrom)
+			})
+			p.redactor.Apply(trace)
 			out <- trace
 		}
 		close(out)
@@ -96,18 +343,23 @@ func (p *Pipeline) RunLSPTraceStage(in chan *internal.RawLSPMessage, lspTracer *
 	return out
 }
 
-func (p *Pipeline) RunOutputStage(in chan *internal.LSPTrace, out io.Writer) (done chan int) {
-	done = make(chan int)
+func (p *Pipeline) RunOutputStage(in chan *internal.LSPTrace, out *TraceWriter) (done chan int) {
+	// buffered so that the stage can finish without anyone waiting on it
+	done = make(chan int, 1)
 	// do work
 	go func() {
 		for trace := range in {
+			if trace.Excluded {
+				continue
+			}
 			traceJson, err := json.Marshal(trace)
 			if err != nil {
-				// TODO: handle err
-				log.Println("pipeline: output stage: Unexpected error marshalling lsp trace.")
-				break
+				log.Printf("pipeline: output stage: unexpected error marshalling lsp trace: %s\n", err)
+				// the traces after this one still have to be written
+				out.Write(trace.Seq, nil)
+				continue
 			}
-			out.Write(append(traceJson, '\n'))
+			out.Write(trace.Seq, append(traceJson, '\n'))
 		}
 		done <- 1
 	}()
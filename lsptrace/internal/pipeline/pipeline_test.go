@@ -2,10 +2,14 @@ package pipeline
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
 	"github.com/mparq/lsptrace/internal"
+	"io"
 	"os"
 	"strings"
 	"testing"
+	"time"
 )
 
 var (
@@ -25,7 +29,7 @@ func TestPipeline(t *testing.T) {
 	traceOut := new(bytes.Buffer)
 	reqMap := internal.NewRequestMap()
 	lspTracer := internal.NewLSPTracer(reqMap)
-	p := NewPipeline(in, out, traceOut, lspTracer, "client")
+	p := NewPipeline(in, out, NewTraceWriter(traceOut), lspTracer, "client")
 	done := p.Run()
 	<-done
 	t.Logf("out: %s", string(out.Bytes()))
@@ -39,13 +43,13 @@ func TestDoublePipeline(t *testing.T) {
 	out := new(bytes.Buffer)
 	traceOut := new(bytes.Buffer)
 	lspTracer := internal.NewLSPTracer(reqMap)
-	p := NewPipeline(in, out, traceOut, lspTracer, "client")
+	p := NewPipeline(in, out, NewTraceWriter(traceOut), lspTracer, "client")
 	done := p.Run()
 
 	serverIn := strings.NewReader(serverInput)
 	sOut := new(bytes.Buffer)
 	sTraceOut := new(bytes.Buffer)
-	sp := NewPipeline(serverIn, sOut, sTraceOut, lspTracer, "server")
+	sp := NewPipeline(serverIn, sOut, NewTraceWriter(sTraceOut), lspTracer, "server")
 	sdone := sp.Run()
 
 	go func() {
@@ -66,7 +70,241 @@ func TestBigPipeline(t *testing.T) {
 	out, _ := os.OpenFile("../testdata/client_out.raw", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
 	trace, _ := os.OpenFile("../testdata/client_trace.raw", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
 	lspTracer := internal.NewLSPTracer(reqMap)
-	p := NewPipeline(in, out, trace, lspTracer, "client")
+	p := NewPipeline(in, out, NewTraceWriter(trace), lspTracer, "client")
 	done := p.Run()
 	<-done
 }
+
+func TestCapturePipeline(t *testing.T) {
+	input := clientInput + "Content-Length: 5\r\n\r\nnope!"
+	out := new(bytes.Buffer)
+	traceOut := new(bytes.Buffer)
+	captureOut := new(bytes.Buffer)
+	lspTracer := internal.NewLSPTracer(internal.NewRequestMap())
+	p := NewPipeline(strings.NewReader(input), out, NewTraceWriter(traceOut), lspTracer, "client")
+	p.SetCaptureOutput(captureOut)
+	<-p.Run()
+
+	captures, err := internal.ReadCaptures(captureOut)
+	if err != nil {
+		t.Fatal(err)
+	}
+	captured := new(bytes.Buffer)
+	for _, capture := range captures {
+		if capture.SentFrom != "client" {
+			t.Fatalf("expected capture from client, got %s", capture.SentFrom)
+		}
+		captured.Write(capture.Data)
+	}
+	if captured.String() != input {
+		t.Fatalf("expected capture to contain the exact input stream, got %q", captured.String())
+	}
+}
+
+func TestPipelineMethodFilter(t *testing.T) {
+	progress := `{"jsonrpc":"2.0","method":"$/progress","params":{"a":1}}`
+	input := clientInput + fmt.Sprintf("Content-Length: %d\r\n\r\n", len(progress)) + progress
+	traceOut := new(bytes.Buffer)
+	lspTracer := internal.NewLSPTracer(internal.NewRequestMap())
+	lspTracer.SetMethodFilter(internal.NewMethodFilter("", "$/*"))
+	p := NewPipeline(strings.NewReader(input), new(bytes.Buffer), NewTraceWriter(traceOut), lspTracer, "client")
+	<-p.Run()
+	traces, err := internal.ReadTraces(traceOut)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(traces) != 1 || *traces[0].Method != "textDocument/codeLens" {
+		t.Fatalf("expected only the codeLens request to be traced, got %v", traces)
+	}
+}
+
+func TestPipelineBatch(t *testing.T) {
+	requests := `[{"jsonrpc":"2.0","id":1,"method":"sum","params":[1,2]},{"jsonrpc":"2.0","method":"log"},{"jsonrpc":"2.0","id":2,"method":"get"}]`
+	responses := `[{"jsonrpc":"2.0","id":2,"result":"x"},{"jsonrpc":"2.0","id":1,"result":3}]`
+	lspTracer := internal.NewLSPTracer(internal.NewRequestMap())
+	clientTraceOut, serverTraceOut := new(bytes.Buffer), new(bytes.Buffer)
+	cp := NewPipeline(strings.NewReader(fmt.Sprintf("Content-Length: %d\r\n\r\n%s", len(requests), requests)), new(bytes.Buffer), NewTraceWriter(clientTraceOut), lspTracer, "client")
+	<-cp.Run()
+	sp := NewPipeline(strings.NewReader(fmt.Sprintf("Content-Length: %d\r\n\r\n%s", len(responses), responses)), new(bytes.Buffer), NewTraceWriter(serverTraceOut), lspTracer, "server")
+	<-sp.Run()
+
+	clientTraces, _ := internal.ReadTraces(clientTraceOut)
+	serverTraces, _ := internal.ReadTraces(serverTraceOut)
+	if len(clientTraces) != 3 || len(serverTraces) != 2 {
+		t.Fatalf("expected batches to be split, got %v %v", clientTraces, serverTraces)
+	}
+	requestBatch := clientTraces[0].BatchId
+	for _, trace := range clientTraces {
+		if trace.BatchId == 0 || trace.BatchId != requestBatch {
+			t.Fatalf("expected requests to share a batch id, got %v", clientTraces)
+		}
+	}
+	if serverTraces[0].BatchId == requestBatch || serverTraces[0].BatchId != serverTraces[1].BatchId {
+		t.Fatalf("expected responses to share a new batch id, got %v", serverTraces)
+	}
+	if *serverTraces[0].Method != "get" || *serverTraces[1].Method != "sum" || serverTraces[1].DurationMs == nil {
+		t.Fatalf("expected responses to be matched to their requests, got %v", serverTraces)
+	}
+}
+
+func TestPipelineStop(t *testing.T) {
+	// the client side of a session may never see the end of its input
+	inReader, inWriter := io.Pipe()
+	defer inWriter.Close()
+	outReader, outWriter := io.Pipe()
+	traceOut := new(bytes.Buffer)
+	p := NewPipeline(inReader, outWriter, NewTraceWriter(traceOut), internal.NewLSPTracer(internal.NewRequestMap()), "client")
+	done := p.Run()
+	go inWriter.Write([]byte(clientInput))
+	// the message was read once it is forwarded
+	io.ReadFull(outReader, make([]byte, len(clientInput)))
+	p.Stop()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expected pipeline to stop without the end of its input")
+	}
+	traces, _ := internal.ReadTraces(traceOut)
+	if len(traces) != 1 {
+		t.Fatalf("expected the message read before stopping to be traced, got %v", traces)
+	}
+}
+
+func TestPipelineHold(t *testing.T) {
+	first := frame(`{"jsonrpc":"2.0","id":1,"method":"first"}`)
+	second := frame(`{"jsonrpc":"2.0","id":2,"method":"second"}`)
+	inReader, inWriter := io.Pipe()
+	outReader, outWriter := io.Pipe()
+	traceOut := new(bytes.Buffer)
+	lspTracer := internal.NewLSPTracer(internal.NewRequestMap())
+	p := NewPipeline(inReader, outWriter, NewTraceWriter(traceOut), lspTracer, "client")
+	done := p.Run()
+	go inWriter.Write([]byte(first))
+	io.ReadFull(outReader, make([]byte, len(first)))
+	var pending []internal.RequestId
+	synced := make(chan struct{})
+	ok := p.Hold(func() {
+		// nothing read after Hold is traced before this returns
+		pending = lspTracer.PendingClientRequests()
+		close(synced)
+	})
+	if !ok {
+		t.Fatal("expected a running pipeline to hold")
+	}
+	inWriter.Write([]byte(second))
+	<-synced
+	if len(pending) != 1 || !pending[0].Equal(*internal.NewIntId(1)) {
+		t.Fatalf("expected only the request before Hold to be traced when synced, got %v", pending)
+	}
+	resumed := new(bytes.Buffer)
+	p.Resume(resumed)
+	inWriter.Close()
+	<-done
+	if resumed.String() != second {
+		t.Fatalf("expected the held message to be forwarded on resume, got %q", resumed.String())
+	}
+	traces, _ := internal.ReadTraces(traceOut)
+	if len(traces) != 2 {
+		t.Fatalf("expected the held message to be traced, got %v", traces)
+	}
+}
+
+// gatedWriter blocks writes until the gate is opened.
+type gatedWriter struct {
+	gate chan struct{}
+	buf  bytes.Buffer
+}
+
+func (w *gatedWriter) Write(p []byte) (int, error) {
+	<-w.gate
+	return w.buf.Write(p)
+}
+
+func TestPipelineDropPolicy(t *testing.T) {
+	in := new(bytes.Buffer)
+	for i := range 20 {
+		in.WriteString(fmt.Sprintf("Content-Length: %d\r\n\r\n{\"jsonrpc\":\"2.0\",\"method\":\"m%02d\"}", 32, i))
+	}
+	inReader, inWriter := io.Pipe()
+	out := new(bytes.Buffer)
+	traceOut := &gatedWriter{gate: make(chan struct{})}
+	captureOut := new(bytes.Buffer)
+	p := NewPipeline(inReader, out, NewTraceWriter(traceOut), internal.NewLSPTracer(internal.NewRequestMap()), "client")
+	p.SetCaptureOutput(captureOut)
+	if err := p.SetQueue(1, QUEUE_DROP); err != nil {
+		t.Fatal(err)
+	}
+	done := p.Run()
+	// a message per read while the trace output is stuck
+	forwarded := make(chan struct{})
+	go func() {
+		defer close(forwarded)
+		for len(in.Bytes()) > 0 {
+			inWriter.Write(in.Next(54))
+		}
+		inWriter.Close()
+	}()
+	select {
+	case <-forwarded:
+	case <-time.After(time.Second):
+		t.Fatal("expected forwarding not to wait for the trace output")
+	}
+	opened := time.Now()
+	close(traceOut.gate)
+	<-done
+	if out.Len() != 20*54 {
+		t.Fatalf("expected every message to be forwarded, got %d bytes", out.Len())
+	}
+	captures, err := internal.ReadCaptures(captureOut)
+	if err != nil {
+		t.Fatal(err)
+	}
+	captured := new(bytes.Buffer)
+	for _, capture := range captures {
+		captured.Write(capture.Data)
+	}
+	if captured.String() != out.String() {
+		t.Fatalf("expected dropped chunks to be captured, got %d bytes", captured.Len())
+	}
+	traces, err := internal.ReadTraces(&traceOut.buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	traced, dropped := 0, 0
+	for _, trace := range traces {
+		if trace.MessageKind == internal.DROPPED {
+			dropped += trace.DroppedMessages
+		} else {
+			traced++
+		}
+	}
+	if dropped == 0 || traced+dropped != 20 {
+		t.Fatalf("expected traced and dropped messages to add up to 20, got %d traced %d dropped", traced, dropped)
+	}
+	for _, trace := range traces {
+		// the last dropped marker may only be queued when the input ends
+		if trace.MessageKind != internal.DROPPED && !trace.Timestamp.Before(opened) {
+			t.Fatalf("expected traces to be stamped when read rather than after waiting in the queue, got %v", trace)
+		}
+	}
+	metrics := p.Metrics()
+	if metrics.DroppedMessages != int64(dropped) || metrics.DroppedChunks == 0 || metrics.Queued != 0 {
+		t.Fatalf("expected metrics to match the trace, got %s", metrics)
+	}
+}
+
+func TestSetQueue(t *testing.T) {
+	p := NewPipeline(nil, nil, nil, nil, "client")
+	if err := p.SetQueue(1, "spill"); !errors.Is(err, EQUEUEPOLICY) {
+		t.Fatalf("expected an invalid policy error, got %v", err)
+	}
+	if err := p.SetQueue(0, QUEUE_BLOCK); err == nil {
+		t.Fatal("expected an invalid size error")
+	}
+	if err := ValidateQueue(DEFAULT_QUEUE_SIZE, QUEUE_DROP); err != nil {
+		t.Fatalf("expected a valid queue, got %v", err)
+	}
+	if err := ValidateQueue(1, "spill"); !errors.Is(err, EQUEUEPOLICY) {
+		t.Fatalf("expected ValidateQueue to match SetQueue, got %v", err)
+	}
+}
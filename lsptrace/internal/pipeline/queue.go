@@ -0,0 +1,125 @@
+package pipeline
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// chunks are read 16KiB at a time so a full queue holds at most 4MiB
+	DEFAULT_QUEUE_SIZE = 256
+	// wait for room in the queue, which slows down forwarding until the
+	// tracer catches up
+	QUEUE_BLOCK = "block"
+	// drop chunks while the queue is full and record a dropped marker
+	QUEUE_DROP = "drop"
+)
+
+var (
+	EQUEUEPOLICY = errors.New("pipeline: queue policy must be 'block' or 'drop'")
+)
+
+// ValidateQueue checks the queue size and policy passed to SetQueue.
+func ValidateQueue(size int, policy string) error {
+	if size < 1 {
+		return fmt.Errorf("pipeline: queue size must be positive, got %d", size)
+	}
+	if policy != QUEUE_BLOCK && policy != QUEUE_DROP {
+		return fmt.Errorf("%w, got %q", EQUEUEPOLICY, policy)
+	}
+	return nil
+}
+
+// queuedChunk is a chunk which was forwarded and is waiting to be traced,
+// a marker for chunks which were dropped in front of the next one or a
+// marker for Hold.
+type queuedChunk struct {
+	data     []byte
+	queuedAt time.Time
+
+	gap bool
+	// headers seen in the dropped chunks
+	gapHeaders int
+
+	// set for the marker queued by Hold
+	synced func()
+}
+
+// QueueMetrics shows how far behind the tracer is.
+type QueueMetrics struct {
+	Capacity int
+	// chunks and bytes forwarded but not yet traced
+	Queued      int64
+	QueuedBytes int64
+	MaxQueued   int64
+	// how long the last traced chunk waited in the queue and the longest wait
+	LagMs    float64
+	MaxLagMs float64
+	// totals when the drop policy is used
+	DroppedChunks   int64
+	DroppedMessages int64
+}
+
+func (m QueueMetrics) String() string {
+	return fmt.Sprintf("queued=%d/%d queuedBytes=%d maxQueued=%d lagMs=%.1f maxLagMs=%.1f droppedChunks=%d droppedMessages=%d",
+		m.Queued, m.Capacity, m.QueuedBytes, m.MaxQueued, m.LagMs, m.MaxLagMs, m.DroppedChunks, m.DroppedMessages)
+}
+
+// queueMetrics is updated by the input stage and the stage draining the
+// queue, and can be read at any time.
+type queueMetrics struct {
+	capacity        int
+	queuedChunks    atomic.Int64
+	queuedBytes     atomic.Int64
+	maxQueued       atomic.Int64
+	lag             atomic.Int64
+	maxLag          atomic.Int64
+	droppedChunks   atomic.Int64
+	droppedMessages atomic.Int64
+}
+
+// queued is called before item is sent so that the count can't go
+// negative, and unqueued if it couldn't be sent after all.
+func (m *queueMetrics) queued(item queuedChunk) {
+	queued := m.queuedChunks.Add(1)
+	m.queuedBytes.Add(int64(len(item.data)))
+	storeMax(&m.maxQueued, min(queued, int64(m.capacity)))
+}
+
+func (m *queueMetrics) unqueued(item queuedChunk) {
+	m.queuedChunks.Add(-1)
+	m.queuedBytes.Add(-int64(len(item.data)))
+}
+
+func (m *queueMetrics) dequeued(item queuedChunk) {
+	m.unqueued(item)
+	lag := int64(time.Since(item.queuedAt))
+	m.lag.Store(lag)
+	storeMax(&m.maxLag, lag)
+}
+
+func storeMax(v *atomic.Int64, n int64) {
+	for {
+		old := v.Load()
+		if n <= old || v.CompareAndSwap(old, n) {
+			return
+		}
+	}
+}
+
+// Metrics returns a snapshot of the pipeline's queue.
+func (p *Pipeline) Metrics() QueueMetrics {
+	m := &p.metrics
+	return QueueMetrics{
+		Capacity:        m.capacity,
+		Queued:          m.queuedChunks.Load(),
+		QueuedBytes:     m.queuedBytes.Load(),
+		MaxQueued:       m.maxQueued.Load(),
+		LagMs:           float64(time.Duration(m.lag.Load()).Microseconds()) / 1000,
+		MaxLagMs:        float64(time.Duration(m.maxLag.Load()).Microseconds()) / 1000,
+		DroppedChunks:   m.droppedChunks.Load(),
+		DroppedMessages: m.droppedMessages.Load(),
+	}
+}
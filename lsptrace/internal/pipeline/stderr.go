@@ -0,0 +1,42 @@
+package pipeline
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"github.com/mparq/lsptrace/internal"
+	"github.com/mparq/lsptrace/internal/redact"
+	"io"
+	"log"
+	"os"
+)
+
+// RunStderrStage traces every line the language server writes to stderr
+// until it is closed. Lines are also copied to stderrOut if it isn't nil.
+func RunStderrStage(stderr io.Reader, stderrOut io.Writer, traceWriter *TraceWriter, lspTracer *internal.LSPTracer, redactor *redact.Redactor) (done chan int) {
+	// buffered so that the stage can finish without anyone waiting on it
+	done = make(chan int, 1)
+	go func() {
+		reader := bufio.NewReader(stderr)
+		for {
+			// a last line without a line ending is traced too
+			line, err := reader.ReadBytes('\n')
+			if len(line) > 0 {
+				if stderrOut != nil {
+					stderrOut.Write(line)
+				}
+				traceWriter.Trace(func() *internal.LSPTrace {
+					return lspTracer.MakeStderrTrace(string(bytes.TrimRight(line, "\r\n")))
+				}, redactor)
+			}
+			if err != nil {
+				if err != io.EOF && !errors.Is(err, os.ErrClosed) {
+					log.Printf("pipeline: stderr stage: error reading stderr: %s\n", err)
+				}
+				break
+			}
+		}
+		done <- 1
+	}()
+	return done
+}
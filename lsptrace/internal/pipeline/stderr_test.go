@@ -0,0 +1,33 @@
+package pipeline
+
+import (
+	"bytes"
+	"github.com/mparq/lsptrace/internal"
+	"strings"
+	"testing"
+)
+
+func TestStderrStage(t *testing.T) {
+	stderr := "starting\r\npanic: oops\nno line ending"
+	stderrOut := new(bytes.Buffer)
+	traceOut := new(bytes.Buffer)
+	lspTracer := internal.NewLSPTracer(internal.NewRequestMap())
+	lspTracer.SetSessionId("s1")
+	<-RunStderrStage(strings.NewReader(stderr), stderrOut, NewTraceWriter(traceOut), lspTracer, nil)
+	if stderrOut.String() != stderr {
+		t.Fatalf("expected stderr to be copied as is, got %q", stderrOut.String())
+	}
+	traces, err := internal.ReadTraces(traceOut)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := []string{"starting", "panic: oops", "no line ending"}
+	if len(traces) != len(lines) {
+		t.Fatalf("expected a trace per line, got %v", traces)
+	}
+	for i, trace := range traces {
+		if trace.MessageKind != internal.STDERR || trace.SentFrom != "server" || trace.Line != lines[i] || trace.Seq != int64(i+1) || trace.SessionId != "s1" {
+			t.Fatalf("expected stderr trace of %q, got %+v", lines[i], trace)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"github.com/mparq/lsptrace/internal"
+	"github.com/mparq/lsptrace/internal/redact"
+	"io"
+	"log"
+	"sync"
+)
+
+// TraceWriter is the single writer of a trace output shared by pipelines.
+// Every trace which is written gets a seq from Sequence and lines are
+// written in seq order, one line per write, whichever pipeline finishes
+// first.
+type TraceWriter struct {
+	out io.Writer
+
+	seqMutex sync.Mutex
+	lastSeq  int64
+
+	writeMutex sync.Mutex
+	nextSeq    int64
+	// lines which are done before the lines in front of them
+	pending map[int64][]byte
+}
+
+func NewTraceWriter(out io.Writer) *TraceWriter {
+	return &TraceWriter{out: out, nextSeq: 1, pending: make(map[int64][]byte)}
+}
+
+// Sequence makes a trace and numbers it unless it is excluded. Traces are
+// made one at a time so that seq order is the order they were made in.
+// Within one direction that is also timestamp order, but traces are stamped
+// when their message was read so a message from the other direction which
+// waited longer in its queue can have an earlier timestamp. Every numbered
+// trace must then be passed to Write.
+func (w *TraceWriter) Sequence(makeTrace func() *internal.LSPTrace) *internal.LSPTrace {
+	w.seqMutex.Lock()
+	defer w.seqMutex.Unlock()
+	trace := makeTrace()
+	if !trace.Excluded {
+		w.lastSeq++
+		trace.Seq = w.lastSeq
+	}
+	return trace
+}
+
+// Write writes the line of the trace numbered seq once every trace before
+// it is written. A nil line only lets the traces after it through.
+func (w *TraceWriter) Write(seq int64, line []byte) {
+	w.writeMutex.Lock()
+	defer w.writeMutex.Unlock()
+	if seq != w.nextSeq {
+		w.pending[seq] = line
+		return
+	}
+	w.writeLine(line)
+	w.nextSeq++
+	for {
+		line, ok := w.pending[w.nextSeq]
+		if !ok {
+			return
+		}
+		delete(w.pending, w.nextSeq)
+		w.writeLine(line)
+		w.nextSeq++
+	}
+}
+
+// Trace makes a trace with Sequence, redacts it and writes it, unless it is
+// excluded. For traces made outside of a pipeline.
+func (w *TraceWriter) Trace(makeTrace func() *internal.LSPTrace, redactor *redact.Redactor) {
+	trace := w.Sequence(makeTrace)
+	if trace.Excluded {
+		return
+	}
+	redactor.Apply(trace)
+	traceJson, err := json.Marshal(trace)
+	if err != nil {
+		log.Printf("trace writer: unexpected error marshalling lsp trace: %s\n", err)
+		// the traces after this one still have to be written
+		w.Write(trace.Seq, nil)
+		return
+	}
+	w.Write(trace.Seq, append(traceJson, '\n'))
+}
+
+func (w *TraceWriter) writeLine(line []byte) {
+	if line == nil {
+		return
+	}
+	if _, err := w.out.Write(line); err != nil {
+		log.Printf("trace writer: error writing trace: %s\n", err)
+	}
+}
@@ -0,0 +1,67 @@
+package pipeline
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/mparq/lsptrace/internal"
+	"strings"
+	"testing"
+)
+
+func TestTraceWriterOrder(t *testing.T) {
+	out := new(bytes.Buffer)
+	w := NewTraceWriter(out)
+	w.Write(3, []byte("3\n"))
+	w.Write(2, nil)
+	if out.Len() != 0 {
+		t.Fatalf("expected lines to wait for the first seq, got %q", out.String())
+	}
+	w.Write(1, []byte("1\n"))
+	w.Write(4, []byte("4\n"))
+	if out.String() != "1\n3\n4\n" {
+		t.Fatalf("expected lines in seq order without the skipped one, got %q", out.String())
+	}
+}
+
+func TestTraceWriterSequence(t *testing.T) {
+	w := NewTraceWriter(new(bytes.Buffer))
+	first := w.Sequence(func() *internal.LSPTrace { return &internal.LSPTrace{} })
+	excluded := w.Sequence(func() *internal.LSPTrace { return &internal.LSPTrace{Excluded: true} })
+	second := w.Sequence(func() *internal.LSPTrace { return &internal.LSPTrace{} })
+	if first.Seq != 1 || excluded.Seq != 0 || second.Seq != 2 {
+		t.Fatalf("expected excluded traces not to be numbered, got %d %d %d", first.Seq, excluded.Seq, second.Seq)
+	}
+}
+
+func TestSharedTraceWriter(t *testing.T) {
+	clientInput, serverInput := new(strings.Builder), new(strings.Builder)
+	for i := range 200 {
+		clientInput.WriteString(frame(fmt.Sprintf(`{"jsonrpc":"2.0","id":%d,"method":"m"}`, i)))
+		serverInput.WriteString(frame(fmt.Sprintf(`{"jsonrpc":"2.0","method":"n%d"}`, i)))
+	}
+	traceOut := new(bytes.Buffer)
+	w := NewTraceWriter(traceOut)
+	lspTracer := internal.NewLSPTracer(internal.NewRequestMap())
+	cp := NewPipeline(strings.NewReader(clientInput.String()), new(bytes.Buffer), w, lspTracer, "client")
+	sp := NewPipeline(strings.NewReader(serverInput.String()), new(bytes.Buffer), w, lspTracer, "server")
+	cdone, sdone := cp.Run(), sp.Run()
+	<-cdone
+	<-sdone
+	traces, err := internal.ReadTraces(traceOut)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(traces) != 400 {
+		t.Fatalf("expected 400 traces, got %d", len(traces))
+	}
+	last := make(map[string]*internal.LSPTrace)
+	for i, trace := range traces {
+		if trace.Seq != int64(i+1) {
+			t.Fatalf("expected trace %d to have seq %d, got %d", i, i+1, trace.Seq)
+		}
+		if previous := last[trace.SentFrom]; previous != nil && trace.Timestamp.Before(previous.Timestamp) {
+			t.Fatalf("expected %s traces in timestamp order, got %s before %s", trace.SentFrom, previous.Timestamp, trace.Timestamp)
+		}
+		last[trace.SentFrom] = trace
+	}
+}
@@ -0,0 +1,258 @@
+package redact
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/mparq/lsptrace/internal"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+const (
+	BLANK = "blank"
+	HASH  = "hash"
+	// field of rules for bodies which couldn't be parsed and the data of
+	// protocol errors. they can't be redacted by path
+	RAW = "raw"
+
+	// value which blanked fields are replaced with
+	BLANK_VALUE = "<redacted>"
+	// replaces the uri root in rewritten file:// uris
+	URI_ROOT_PLACEHOLDER = "$ROOT"
+)
+
+var (
+	EINVALIDRULE = errors.New("redact: rules must look like <method-glob>:<params|result|error>.<path>=<blank|hash> or <method-glob>:raw=<blank|hash>")
+
+	// rules for the usual places source text and local environment details are sent
+	DEFAULT_RULES = strings.Join([]string{
+		"textDocument/didOpen:params.textDocument.text=hash",
+		"textDocument/didChange:params.contentChanges.*.text=hash",
+		"initialize:params.initializationOptions=blank",
+		"initialize:params.rootPath=blank",
+		"initialize:params.rootUri=blank",
+		"initialize:params.workspaceFolders=blank",
+		"*:raw=hash",
+	}, ",")
+)
+
+// Rule redacts the value at a json path for messages of matching methods.
+type Rule struct {
+	method *regexp.Regexp
+	// 'params' | 'result' | 'error' | 'raw'
+	field string
+	// path below field. '*' matches every key or array element
+	path   []string
+	action string
+}
+
+// Redactor rewrites the params/result/error of traces before they are
+// written so that traces can be shared.
+type Redactor struct {
+	rules []*Rule
+	// file:// uri prefix which is replaced by the placeholder
+	uriRoot string
+}
+
+// New creates a Redactor from comma-separated rules of the form
+// <method-glob>:<params|result|error>.<path>=<blank|hash> e.g.
+// 'textDocument/didOpen:params.textDocument.text=hash'. The word 'defaults'
+// can be used in place of a rule to include DEFAULT_RULES. file:// uris
+// under uriRoot are rewritten to start with the placeholder instead.
+func New(rules string, uriRoot string) (*Redactor, error) {
+	r := &Redactor{rules: make([]*Rule, 0)}
+	for _, rule := range strings.Split(rules, ",") {
+		rule = strings.TrimSpace(rule)
+		if len(rule) == 0 {
+			continue
+		}
+		if rule == "defaults" {
+			defaults, _ := New(DEFAULT_RULES, "")
+			r.rules = append(r.rules, defaults.rules...)
+			continue
+		}
+		parsed, err := parseRule(rule)
+		if err != nil {
+			return nil, err
+		}
+		r.rules = append(r.rules, parsed)
+	}
+	if len(uriRoot) > 0 {
+		// uris are percent-encoded, e.g. a space in the root is %20 in them
+		r.uriRoot = (&url.URL{Scheme: "file", Path: strings.TrimSuffix(uriRoot, "/")}).String()
+	}
+	return r, nil
+}
+
+func parseRule(rule string) (*Rule, error) {
+	eq := strings.LastIndex(rule, "=")
+	colon := strings.Index(rule, ":")
+	if eq < 0 || colon < 0 || colon > eq {
+		return nil, errors.Join(EINVALIDRULE, fmt.Errorf("invalid rule %q", rule))
+	}
+	action := rule[eq+1:]
+	if action != BLANK && action != HASH {
+		return nil, errors.Join(EINVALIDRULE, fmt.Errorf("invalid action in rule %q", rule))
+	}
+	path := strings.Split(rule[colon+1:eq], ".")
+	field := path[0]
+	if (field != "params" && field != "result" && field != "error" && field != RAW) || (field == RAW && len(path) > 1) {
+		return nil, errors.Join(EINVALIDRULE, fmt.Errorf("invalid path in rule %q", rule))
+	}
+	return &Rule{method: internal.CompileGlob(rule[:colon]), field: field, path: path[1:], action: action}, nil
+}
+
+// Empty reports whether the redactor would never change anything.
+func (r *Redactor) Empty() bool {
+	return r == nil || (len(r.rules) == 0 && len(r.uriRoot) == 0)
+}
+
+// Apply redacts trace in place.
+func (r *Redactor) Apply(trace *internal.LSPTrace) {
+	if r.Empty() {
+		return
+	}
+	method := ""
+	if trace.Method != nil {
+		method = *trace.Method
+	}
+	trace.Message.Params = r.apply(method, "params", trace.Message.Params)
+	trace.Message.Result = r.apply(method, "result", trace.Message.Result)
+	trace.Message.Error = r.apply(method, "error", trace.Message.Error)
+	trace.RawBody = r.applyRaw(method, trace.RawBody)
+	if trace.ProtocolError != nil {
+		redacted := *trace.ProtocolError
+		redacted.Data = r.applyRaw(method, redacted.Data)
+		trace.ProtocolError = &redacted
+	}
+	// stderr lines are kept readable, e.g. for crash stack traces
+	trace.Line = r.rewriteRawUris(trace.Line)
+}
+
+// applyRaw redacts bytes which couldn't be parsed with the first matching
+// raw rule, or else only rewrites their uris.
+func (r *Redactor) applyRaw(method string, raw string) string {
+	if len(raw) == 0 {
+		return raw
+	}
+	for _, rule := range r.rules {
+		if rule.field != RAW || !rule.method.MatchString(method) {
+			continue
+		}
+		if rule.action == HASH {
+			return hash(raw)
+		}
+		return BLANK_VALUE
+	}
+	return r.rewriteRawUris(raw)
+}
+
+func (r *Redactor) rewriteRawUris(raw string) string {
+	if len(r.uriRoot) > 0 {
+		raw = strings.ReplaceAll(raw, r.uriRoot+"/", "file:///"+URI_ROOT_PLACEHOLDER+"/")
+	}
+	return raw
+}
+
+func (r *Redactor) apply(method string, field string, raw json.RawMessage) json.RawMessage {
+	if raw == nil {
+		return raw
+	}
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	var value any
+	if err := decoder.Decode(&value); err != nil {
+		return raw
+	}
+	changed := false
+	for _, rule := range r.rules {
+		if rule.field != field || !rule.method.MatchString(method) {
+			continue
+		}
+		value = rule.redact(value, rule.path, &changed)
+	}
+	if len(r.uriRoot) > 0 {
+		value = r.rewriteUris(value, &changed)
+	}
+	if !changed {
+		return raw
+	}
+	out := new(bytes.Buffer)
+	encoder := json.NewEncoder(out)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(value); err != nil {
+		return raw
+	}
+	return bytes.TrimSpace(out.Bytes())
+}
+
+func (rule *Rule) redact(value any, path []string, changed *bool) any {
+	if len(path) == 0 {
+		*changed = true
+		if rule.action == HASH {
+			return hash(value)
+		}
+		return BLANK_VALUE
+	}
+	switch v := value.(type) {
+	case map[string]any:
+		for key, child := range v {
+			if path[0] == "*" || path[0] == key {
+				v[key] = rule.redact(child, path[1:], changed)
+			}
+		}
+	case []any:
+		for i, child := range v {
+			if path[0] == "*" || path[0] == fmt.Sprint(i) {
+				v[i] = rule.redact(child, path[1:], changed)
+			}
+		}
+	}
+	return value
+}
+
+func (r *Redactor) rewriteUris(value any, changed *bool) any {
+	switch v := value.(type) {
+	case string:
+		return r.rewriteUri(v, changed)
+	case map[string]any:
+		// uris are also used as keys e.g. WorkspaceEdit.changes. keys are
+		// renamed after the loop since keys added while ranging over a map
+		// may or may not be visited
+		renamed := make(map[string]string)
+		for key, child := range v {
+			v[key] = r.rewriteUris(child, changed)
+			if newKey := r.rewriteUri(key, changed); newKey != key {
+				renamed[key] = newKey
+			}
+		}
+		for key, newKey := range renamed {
+			v[newKey] = v[key]
+			delete(v, key)
+		}
+	case []any:
+		for i, child := range v {
+			v[i] = r.rewriteUris(child, changed)
+		}
+	}
+	return value
+}
+
+func (r *Redactor) rewriteUri(uri string, changed *bool) string {
+	if strings.HasPrefix(uri, r.uriRoot) && (len(uri) == len(r.uriRoot) || uri[len(r.uriRoot)] == '/') {
+		*changed = true
+		return "file:///" + URI_ROOT_PLACEHOLDER + uri[len(r.uriRoot):]
+	}
+	return uri
+}
+
+func hash(value any) string {
+	encoded, _ := json.Marshal(value)
+	sum := sha256.Sum256(encoded)
+	return "sha256:" + hex.EncodeToString(sum[:8])
+}
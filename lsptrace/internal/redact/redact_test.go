@@ -0,0 +1,157 @@
+package redact
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/mparq/lsptrace/internal"
+	"strings"
+	"testing"
+)
+
+func makeTrace(t *testing.T, line string) *internal.LSPTrace {
+	trace := new(internal.LSPTrace)
+	if err := json.Unmarshal([]byte(line), trace); err != nil {
+		t.Fatal(err)
+	}
+	return trace
+}
+
+func TestDefaultRules(t *testing.T) {
+	redactor, err := New("defaults", "/Users/me/code")
+	if err != nil {
+		t.Fatal(err)
+	}
+	trace := makeTrace(t, `{"msgKind":"notification","from":"client","method":"textDocument/didChange","timestamp":"2024-11-28T12:01:45.000Z","msg":{"jsonrpc":"2.0","method":"textDocument/didChange","params":{"textDocument":{"uri":"file:///Users/me/code/proj/a.cs","version":2},"contentChanges":[{"text":"secret();"},{"text":"more <secret>"}]}}}`)
+	redactor.Apply(trace)
+	params := string(trace.Message.Params)
+	if strings.Contains(params, "secret") {
+		t.Fatalf("expected source text to be hashed: %s", params)
+	}
+	if !strings.Contains(params, `"uri":"file:///$ROOT/proj/a.cs"`) {
+		t.Fatalf("expected uri under root to be rewritten: %s", params)
+	}
+	if !strings.Contains(params, `"version":2`) {
+		t.Fatalf("expected other fields to be kept: %s", params)
+	}
+
+	trace = makeTrace(t, `{"msgKind":"request","from":"client","method":"initialize","id":1,"timestamp":"2024-11-28T12:01:45.000Z","msg":{"jsonrpc":"2.0","id":1,"method":"initialize","params":{"processId":1,"rootPath":"/Users/me/code/proj","rootUri":"file:///Users/me/code/proj","workspaceFolders":[{"uri":"file:///Users/me/code/proj","name":"proj"}],"initializationOptions":{"env":"x"}}}}`)
+	redactor.Apply(trace)
+	params = string(trace.Message.Params)
+	if strings.Contains(params, "/Users/me") || strings.Contains(params, "proj") || strings.Contains(params, `"env"`) || !strings.Contains(params, BLANK_VALUE) {
+		t.Fatalf("expected initialize details to be blanked: %s", params)
+	}
+}
+
+func TestRulesMatchResponses(t *testing.T) {
+	redactor, err := New("textDocument/*:result.items.*.documentation=blank", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	trace := makeTrace(t, `{"msgKind":"response","from":"server","method":"textDocument/completion","id":1,"timestamp":"2024-11-28T12:01:45.000Z","msg":{"jsonrpc":"2.0","id":1,"result":{"items":[{"label":"a","documentation":"docs"}]}}}`)
+	redactor.Apply(trace)
+	if string(trace.Message.Result) != `{"items":[{"documentation":"<redacted>","label":"a"}]}` {
+		t.Fatalf("unexpected result: %s", trace.Message.Result)
+	}
+}
+
+func TestUriKeysAreRewritten(t *testing.T) {
+	redactor, _ := New("", "/Users/me/code")
+	// keys and values are both rewritten, keys after ranging over the map
+	changes := make([]string, 0)
+	for i := 0; i < 50; i++ {
+		changes = append(changes, fmt.Sprintf(`"file:///Users/me/code/f%d.go":[{"newText":"file:///Users/me/code/f%d.go"}]`, i, i))
+	}
+	trace := makeTrace(t, `{"msgKind":"request","from":"server","method":"workspace/applyEdit","id":1,"timestamp":"2024-11-28T12:01:45.000Z","msg":{"jsonrpc":"2.0","id":1,"method":"workspace/applyEdit","params":{"edit":{"changes":{`+strings.Join(changes, ",")+`}}}}}`)
+	redactor.Apply(trace)
+	var params struct {
+		Edit struct {
+			Changes map[string][]struct {
+				NewText string `json:"newText"`
+			} `json:"changes"`
+		} `json:"edit"`
+	}
+	if err := json.Unmarshal(trace.Message.Params, &params); err != nil {
+		t.Fatal(err)
+	}
+	if len(params.Edit.Changes) != 50 {
+		t.Fatalf("expected every uri key to be kept, got %d", len(params.Edit.Changes))
+	}
+	for i := 0; i < 50; i++ {
+		uri := fmt.Sprintf("file:///$ROOT/f%d.go", i)
+		if edits, ok := params.Edit.Changes[uri]; !ok || edits[0].NewText != uri {
+			t.Fatalf("expected %s to be rewritten once, got %v", uri, params.Edit.Changes)
+		}
+	}
+}
+
+func TestUriRootIsEncoded(t *testing.T) {
+	redactor, _ := New("", "/Users/me/my code/")
+	trace := makeTrace(t, `{"msgKind":"notification","from":"client","method":"textDocument/didSave","timestamp":"2024-11-28T12:01:45.000Z","msg":{"jsonrpc":"2.0","method":"textDocument/didSave","params":{"textDocument":{"uri":"file:///Users/me/my%20code/a.go"}}}}`)
+	redactor.Apply(trace)
+	if string(trace.Message.Params) != `{"textDocument":{"uri":"file:///$ROOT/a.go"}}` {
+		t.Fatalf("expected the uri under the root with a space to be rewritten: %s", trace.Message.Params)
+	}
+}
+
+func TestUnchangedMessageIsKept(t *testing.T) {
+	redactor, _ := New("defaults", "/Users/me/code")
+	line := `{"msgKind":"request","from":"client","method":"textDocument/hover","id":1,"timestamp":"2024-11-28T12:01:45.000Z","msg":{"jsonrpc":"2.0","id":1,"method":"textDocument/hover","params":{"z":1,"a":1.50}}}`
+	trace := makeTrace(t, line)
+	redactor.Apply(trace)
+	if string(trace.Message.Params) != `{"z":1,"a":1.50}` {
+		t.Fatalf("expected params without matches to be untouched: %s", trace.Message.Params)
+	}
+}
+
+func TestRawBodies(t *testing.T) {
+	line := `{"msgKind":"malformed","from":"server","timestamp":"2024-11-28T12:01:45.000Z","msg":{"jsonrpc":""},"rawBody":"{\"uri\":\"file:///Users/me/code/a.cs\",","parseError":"unexpected end of JSON input"}`
+	redactor, _ := New("", "/Users/me/code")
+	trace := makeTrace(t, line)
+	redactor.Apply(trace)
+	if trace.RawBody != `{"uri":"file:///$ROOT/a.cs",` {
+		t.Fatalf("expected uris in raw body to be rewritten: %s", trace.RawBody)
+	}
+	redactor, _ = New("defaults", "")
+	trace = makeTrace(t, line)
+	redactor.Apply(trace)
+	if !strings.HasPrefix(trace.RawBody, "sha256:") {
+		t.Fatalf("expected raw body to be hashed: %s", trace.RawBody)
+	}
+	// raw bodies are only hashed by a raw rule
+	redactor, _ = New("textDocument/*:params.text=hash", "/Users/me/code")
+	trace = makeTrace(t, line)
+	redactor.Apply(trace)
+	if trace.RawBody != `{"uri":"file:///$ROOT/a.cs",` {
+		t.Fatalf("expected raw body without a raw rule to only have its uris rewritten: %s", trace.RawBody)
+	}
+	redactor, _ = New("*:raw=blank", "")
+	trace = makeTrace(t, line)
+	redactor.Apply(trace)
+	if trace.RawBody != BLANK_VALUE {
+		t.Fatalf("expected raw body to be blanked: %s", trace.RawBody)
+	}
+}
+
+func TestStderrLines(t *testing.T) {
+	line := `{"msgKind":"stderr","from":"server","timestamp":"2024-11-28T12:01:45.000Z","msg":{"jsonrpc":""},"line":"error in file:///Users/me/code/a.cs"}`
+	redactor, _ := New("", "/Users/me/code")
+	trace := makeTrace(t, line)
+	redactor.Apply(trace)
+	if trace.Line != "error in file:///$ROOT/a.cs" {
+		t.Fatalf("expected uris in stderr line to be rewritten: %s", trace.Line)
+	}
+	redactor, _ = New("defaults", "/Users/me/code")
+	trace = makeTrace(t, line)
+	redactor.Apply(trace)
+	if trace.Line != "error in file:///$ROOT/a.cs" {
+		t.Fatalf("expected stderr line to stay readable with rules: %s", trace.Line)
+	}
+}
+
+func TestInvalidRule(t *testing.T) {
+	for _, rule := range []string{"initialize", "initialize:params.x=drop", "initialize:foo.x=blank", "*:raw.x=hash"} {
+		if _, err := New(rule, ""); err == nil {
+			t.Errorf("expected rule %q to be invalid", rule)
+		}
+	}
+}
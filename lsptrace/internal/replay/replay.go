@@ -0,0 +1,230 @@
+package replay
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/mparq/lsptrace/internal"
+	"github.com/mparq/lsptrace/internal/pipeline"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+var (
+	ERESPONSETIMEOUT = errors.New("replay: timed out waiting for server response")
+)
+
+// Client plays the client side of a recorded trace against a language server.
+// Client requests and notifications are sent in their recorded order. Before
+// each message is sent, the client waits for the server responses which the
+// recorded client had already received at that point. Requests from the server
+// are answered with the client responses recorded for the same method.
+type Client struct {
+	traces    []*internal.LSPTrace
+	serverIn  io.Writer
+	serverOut io.Reader
+	// when true, the delays between recorded client messages are kept
+	KeepTiming bool
+	// how long to wait for a server response before giving up
+	ResponseTimeout time.Duration
+
+	writeMutex sync.Mutex
+
+	responseMutex sync.Mutex
+	// closed when the response to a client request id has been received
+	responses map[string]chan struct{}
+
+	answerMutex sync.Mutex
+	// recorded client responses to server requests keyed by method
+	answers map[string][]*internal.LSPTrace
+}
+
+func NewClient(traces []*internal.LSPTrace, serverIn io.Writer, serverOut io.Reader) *Client {
+	c := &Client{
+		traces:          traces,
+		serverIn:        serverIn,
+		serverOut:       serverOut,
+		ResponseTimeout: 30 * time.Second,
+		responses:       make(map[string]chan struct{}),
+		answers:         make(map[string][]*internal.LSPTrace),
+	}
+	for _, trace := range traces {
+		// messages lsptrace sent to a restarted server weren't the client's
+		if trace.SentFrom != "client" || trace.Method == nil || trace.Injected {
+			continue
+		}
+		switch trace.MessageKind {
+		case internal.REQUEST:
+			if trace.Id != nil {
+				c.responses[trace.Id.String()] = make(chan struct{})
+			}
+		case internal.RESPONSE, internal.ERROR:
+			c.answers[*trace.Method] = append(c.answers[*trace.Method], trace)
+		}
+	}
+	return c
+}
+
+// step is a recorded client message along with the responses the
+// recorded client had received before sending it.
+type step struct {
+	trace   *internal.LSPTrace
+	waitFor []string
+}
+
+func (c *Client) steps() []step {
+	steps := make([]step, 0)
+	waitFor := make([]string, 0)
+	for _, trace := range c.traces {
+		switch {
+		case trace.SentFrom == "server" && (trace.MessageKind == internal.RESPONSE || trace.MessageKind == internal.ERROR):
+			if trace.Id != nil {
+				waitFor = append(waitFor, trace.Id.String())
+			}
+		case trace.SentFrom == "client" && !trace.Injected && (trace.MessageKind == internal.REQUEST || trace.MessageKind == internal.NOTIFICATION):
+			steps = append(steps, step{trace, waitFor})
+			waitFor = make([]string, 0)
+		}
+	}
+	// responses recorded after the last client message are still waited for
+	if len(waitFor) > 0 {
+		steps = append(steps, step{nil, waitFor})
+	}
+	return steps
+}
+
+// Run sends all recorded client messages and returns once the last
+// expected response is received.
+func (c *Client) Run() error {
+	readDone := c.readServer()
+	var prev *internal.LSPTrace
+	var prevSent time.Time
+	for _, s := range c.steps() {
+		for _, id := range s.waitFor {
+			if err := c.waitForResponse(id, readDone); err != nil {
+				return err
+			}
+		}
+		if s.trace == nil {
+			break
+		}
+		if c.KeepTiming && prev != nil {
+			delay := s.trace.Timestamp.Sub(prev.Timestamp) - time.Since(prevSent)
+			if delay > 0 {
+				time.Sleep(delay)
+			}
+		}
+		log.Printf("replay: sending %s %s\n", s.trace.MessageKind, *s.trace.Method)
+		if err := c.send(&s.trace.Message); err != nil {
+			return err
+		}
+		prev, prevSent = s.trace, time.Now()
+	}
+	return nil
+}
+
+func (c *Client) waitForResponse(id string, readDone chan struct{}) error {
+	c.responseMutex.Lock()
+	received, ok := c.responses[id]
+	c.responseMutex.Unlock()
+	if !ok {
+		return nil
+	}
+	select {
+	case <-received:
+		return nil
+	case <-readDone:
+		return errors.Join(ERESPONSETIMEOUT, fmt.Errorf("server closed before responding to id %s", id))
+	case <-time.After(c.ResponseTimeout):
+		return errors.Join(ERESPONSETIMEOUT, fmt.Errorf("no response to id %s after %s", id, c.ResponseTimeout))
+	}
+}
+
+func (c *Client) send(msg *internal.RawLSPMessage) error {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	return pipeline.WriteJsonRpcMessage(c.serverIn, body)
+}
+
+// readServer parses messages from the server until it closes its output.
+// The returned channel is closed once there is nothing more to read.
+func (c *Client) readServer() (done chan struct{}) {
+	done = make(chan struct{})
+	in := make(chan []byte)
+	out := pipeline.NewJsonRpcStage().Run(in)
+	go func() {
+		defer close(in)
+		buf := make([]byte, 16*1024)
+		for {
+			nr, err := c.serverOut.Read(buf)
+			if nr > 0 {
+				in <- bytes.Clone(buf[:nr])
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	go func() {
+		defer close(done)
+		for msg := range out {
+			switch internal.MessageKind(msg) {
+			case internal.RESPONSE, internal.ERROR:
+				c.markReceived(msg.Id.String())
+			case internal.REQUEST:
+				if err := c.answer(msg); err != nil {
+					log.Printf("replay: error answering server request %s: %s\n", *msg.Method, err)
+				}
+			}
+		}
+	}()
+	return done
+}
+
+func (c *Client) markReceived(id string) {
+	c.responseMutex.Lock()
+	defer c.responseMutex.Unlock()
+	received, ok := c.responses[id]
+	if !ok {
+		return
+	}
+	select {
+	case <-received:
+	default:
+		close(received)
+	}
+}
+
+// answer responds to a server request with the next recorded client
+// response for the same method. The last recorded response is reused
+// if the server sends more requests than were recorded, and a null
+// result is sent if the method was never answered in the recording.
+func (c *Client) answer(request *internal.RawLSPMessage) error {
+	c.answerMutex.Lock()
+	recorded := c.answers[*request.Method]
+	var answer *internal.LSPTrace
+	if len(recorded) > 0 {
+		answer = recorded[0]
+		if len(recorded) > 1 {
+			c.answers[*request.Method] = recorded[1:]
+		}
+	}
+	c.answerMutex.Unlock()
+
+	response := &internal.RawLSPMessage{JsonRpc: "2.0", Id: request.Id}
+	if answer == nil {
+		log.Printf("replay: no recorded response for server request %s. responding with null\n", *request.Method)
+		response.Result = json.RawMessage("null")
+	} else {
+		response.Result = answer.Message.Result
+		response.Error = answer.Message.Error
+	}
+	return c.send(response)
+}
@@ -0,0 +1,95 @@
+package replay
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/mparq/lsptrace/internal"
+	"github.com/mparq/lsptrace/internal/pipeline"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+var recordedTrace = strings.Join([]string{
+	`{"msgKind":"request","from":"client","method":"initialize","id":1,"timestamp":"2024-11-28T12:01:45.000Z","msg":{"jsonrpc":"2.0","id":1,"method":"initialize","params":{}}}`,
+	`{"msgKind":"request","from":"server","method":"workspace/configuration","id":1,"timestamp":"2024-11-28T12:01:45.010Z","msg":{"jsonrpc":"2.0","id":1,"method":"workspace/configuration","params":{}}}`,
+	`{"msgKind":"response","from":"client","method":"workspace/configuration","id":1,"timestamp":"2024-11-28T12:01:45.015Z","msg":{"jsonrpc":"2.0","id":1,"result":[{"recorded":true}]}}`,
+	`{"msgKind":"response","from":"server","method":"initialize","id":1,"timestamp":"2024-11-28T12:01:45.100Z","msg":{"jsonrpc":"2.0","id":1,"result":{}}}`,
+	`{"msgKind":"notification","from":"client","method":"initialized","timestamp":"2024-11-28T12:01:45.200Z","msg":{"jsonrpc":"2.0","method":"initialized","params":{}}}`,
+	`{"msgKind":"request","from":"client","method":"shutdown","id":2,"timestamp":"2024-11-28T12:01:46.000Z","msg":{"jsonrpc":"2.0","id":2,"method":"shutdown"}}`,
+	`{"msgKind":"response","from":"server","method":"shutdown","id":2,"timestamp":"2024-11-28T12:01:46.100Z","msg":{"jsonrpc":"2.0","id":2,"result":null}}`,
+}, "\n")
+
+// fakeServer answers initialize only after its own configuration request
+// was answered, so the client must not send initialized before that.
+func fakeServer(in io.Reader, out io.Writer, received chan<- string) {
+	chunks := make(chan []byte)
+	msgs := pipeline.NewJsonRpcStage().Run(chunks)
+	go func() {
+		defer close(chunks)
+		buf := make([]byte, 1024)
+		for {
+			n, err := in.Read(buf)
+			if n > 0 {
+				chunks <- bytes.Clone(buf[:n])
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	send := func(body string) {
+		pipeline.WriteJsonRpcMessage(out, []byte(body))
+	}
+	for msg := range msgs {
+		switch internal.MessageKind(msg) {
+		case internal.REQUEST, internal.NOTIFICATION:
+			received <- *msg.Method
+			switch *msg.Method {
+			case "initialize":
+				send(`{"jsonrpc":"2.0","id":"cfg-1","method":"workspace/configuration","params":{}}`)
+			case "shutdown":
+				send(`{"jsonrpc":"2.0","id":2,"result":null}`)
+			}
+		case internal.RESPONSE:
+			received <- "response:" + msg.Id.String() + ":" + string(msg.Result)
+			send(`{"jsonrpc":"2.0","id":1,"result":{}}`)
+		}
+	}
+	close(received)
+}
+
+func TestReplay(t *testing.T) {
+	traces, err := internal.ReadTraces(strings.NewReader(recordedTrace))
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverInReader, serverInWriter := io.Pipe()
+	serverOutReader, serverOutWriter := io.Pipe()
+	received := make(chan string, 16)
+	go fakeServer(serverInReader, serverOutWriter, received)
+
+	client := NewClient(traces, serverInWriter, serverOutReader)
+	client.ResponseTimeout = 5 * time.Second
+	if err := client.Run(); err != nil {
+		t.Fatal(err)
+	}
+	serverInWriter.Close()
+
+	expected := []string{
+		"initialize",
+		`response:"cfg-1":[{"recorded":true}]`,
+		"initialized",
+		"shutdown",
+	}
+	actual := make([]string, 0)
+	for r := range received {
+		actual = append(actual, r)
+	}
+	expectedJson, _ := json.Marshal(expected)
+	actualJson, _ := json.Marshal(actual)
+	if string(expectedJson) != string(actualJson) {
+		t.Fatalf("expected server to receive %s, got %s", expectedJson, actualJson)
+	}
+}
@@ -0,0 +1,226 @@
+package replay
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/mparq/lsptrace/internal"
+	"github.com/mparq/lsptrace/internal/pipeline"
+	"io"
+	"log"
+	"reflect"
+	"sync"
+)
+
+const (
+	// jsonrpc error code sent when a request has no recorded response
+	METHOD_NOT_FOUND = -32601
+)
+
+// Server plays the server side of a recorded trace to a live client.
+// Each client request or notification is matched to the next unused recorded
+// client message with the same method (preferring one with the same params).
+// The server messages recorded after the matched message are then sent in
+// their recorded order with the response id rewritten to the live request id.
+type Server struct {
+	clientIn  io.Writer
+	clientOut io.Reader
+
+	writeMutex sync.Mutex
+
+	// server messages recorded before the first client message
+	initial []*internal.LSPTrace
+	script  []*scriptEntry
+}
+
+// scriptEntry is a recorded client message and what the server sent after it.
+type scriptEntry struct {
+	trace    *internal.LSPTrace
+	response *internal.LSPTrace
+	// server notifications, requests and the response to trace in the order
+	// they were recorded
+	emits []*internal.LSPTrace
+	used  bool
+}
+
+func NewServer(traces []*internal.LSPTrace, clientIn io.Writer, clientOut io.Reader) *Server {
+	s := &Server{clientIn: clientIn, clientOut: clientOut, initial: make([]*internal.LSPTrace, 0), script: make([]*scriptEntry, 0)}
+	requests := make(map[string]*scriptEntry)
+	var current *scriptEntry
+	for _, trace := range traces {
+		switch {
+		case trace.SentFrom == "client" && trace.Injected:
+			// sent by lsptrace to a restarted server, not by the client
+			continue
+		case trace.SentFrom == "client" && (trace.MessageKind == internal.REQUEST || trace.MessageKind == internal.NOTIFICATION):
+			current = &scriptEntry{trace: trace, emits: make([]*internal.LSPTrace, 0)}
+			s.script = append(s.script, current)
+			if trace.Id != nil {
+				requests[trace.RequestKey()] = current
+			}
+		case trace.SentFrom == "server" && (trace.MessageKind == internal.RESPONSE || trace.MessageKind == internal.ERROR):
+			if trace.Id == nil {
+				continue
+			}
+			entry, ok := requests[trace.RequestKey()]
+			if !ok {
+				continue
+			}
+			delete(requests, trace.RequestKey())
+			entry.response = trace
+			if entry == current {
+				current.emits = append(current.emits, trace)
+			}
+		case trace.SentFrom == "server" && (trace.MessageKind == internal.REQUEST || trace.MessageKind == internal.NOTIFICATION):
+			if current == nil {
+				s.initial = append(s.initial, trace)
+			} else {
+				current.emits = append(current.emits, trace)
+			}
+		}
+	}
+	// responses which were recorded after later client messages are sent
+	// right after the messages recorded directly after their request
+	for _, entry := range s.script {
+		if entry.response != nil && !containsTrace(entry.emits, entry.response) {
+			entry.emits = append(entry.emits, entry.response)
+		}
+	}
+	return s
+}
+
+// Run answers client messages until the client sends exit or closes
+// its output.
+func (s *Server) Run() error {
+	for _, trace := range s.initial {
+		if err := s.send(&trace.Message); err != nil {
+			return err
+		}
+	}
+	in := make(chan []byte)
+	out := pipeline.NewJsonRpcStage().Run(in)
+	readErr := make(chan error, 1)
+	go func() {
+		defer close(in)
+		buf := make([]byte, 16*1024)
+		for {
+			nr, err := s.clientOut.Read(buf)
+			if nr > 0 {
+				in <- bytes.Clone(buf[:nr])
+			}
+			if err != nil {
+				if err != io.EOF {
+					readErr <- err
+				}
+				return
+			}
+		}
+	}()
+	for msg := range out {
+		kind := internal.MessageKind(msg)
+		if kind != internal.REQUEST && kind != internal.NOTIFICATION {
+			log.Printf("serve-trace: ignoring client %s\n", kind)
+			continue
+		}
+		if err := s.handle(msg, kind); err != nil {
+			return err
+		}
+		if *msg.Method == "exit" {
+			return nil
+		}
+	}
+	select {
+	case err := <-readErr:
+		return err
+	default:
+		return nil
+	}
+}
+
+func (s *Server) handle(msg *internal.RawLSPMessage, kind string) error {
+	entry := s.match(msg)
+	if entry == nil {
+		log.Printf("serve-trace: no recorded %s for %s\n", kind, *msg.Method)
+		if kind != internal.REQUEST {
+			return nil
+		}
+		return s.sendNoResponse(msg)
+	}
+	log.Printf("serve-trace: matched %s %s\n", kind, *msg.Method)
+	for _, trace := range entry.emits {
+		emit := trace.Message
+		if trace == entry.response {
+			emit.Id = msg.Id
+		}
+		if err := s.send(&emit); err != nil {
+			return err
+		}
+	}
+	// e.g. the trace ended or the response was filtered out. the client
+	// still needs an answer
+	if kind == internal.REQUEST && entry.response == nil {
+		log.Printf("serve-trace: no recorded response for %s\n", *msg.Method)
+		return s.sendNoResponse(msg)
+	}
+	return nil
+}
+
+// sendNoResponse answers the request msg with an error.
+func (s *Server) sendNoResponse(msg *internal.RawLSPMessage) error {
+	lspError, _ := json.Marshal(map[string]any{
+		"code":    METHOD_NOT_FOUND,
+		"message": "lsptrace: no recorded response for " + *msg.Method,
+	})
+	return s.send(&internal.RawLSPMessage{JsonRpc: "2.0", Id: msg.Id, Error: lspError})
+}
+
+// match finds the next unused recorded client message for msg's method,
+// preferring one with the same params.
+func (s *Server) match(msg *internal.RawLSPMessage) *scriptEntry {
+	var first *scriptEntry
+	for _, entry := range s.script {
+		if entry.used || entry.trace.Method == nil || *entry.trace.Method != *msg.Method {
+			continue
+		}
+		if jsonEqual(entry.trace.Message.Params, msg.Params) {
+			entry.used = true
+			return entry
+		}
+		if first == nil {
+			first = entry
+		}
+	}
+	if first != nil {
+		first.used = true
+	}
+	return first
+}
+
+func (s *Server) send(msg *internal.RawLSPMessage) error {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+	return pipeline.WriteJsonRpcMessage(s.clientIn, body)
+}
+
+func containsTrace(traces []*internal.LSPTrace, trace *internal.LSPTrace) bool {
+	for _, t := range traces {
+		if t == trace {
+			return true
+		}
+	}
+	return false
+}
+
+func jsonEqual(a, b json.RawMessage) bool {
+	if bytes.Equal(a, b) {
+		return true
+	}
+	var av, bv any
+	if json.Unmarshal(a, &av) != nil || json.Unmarshal(b, &bv) != nil {
+		return false
+	}
+	return reflect.DeepEqual(av, bv)
+}
@@ -0,0 +1,131 @@
+package replay
+
+import (
+	"bytes"
+	"github.com/mparq/lsptrace/internal"
+	"github.com/mparq/lsptrace/internal/pipeline"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+var serverTrace = strings.Join([]string{
+	`{"msgKind":"request","from":"client","method":"textDocument/hover","id":1,"timestamp":"2024-11-28T12:01:45.000Z","msg":{"jsonrpc":"2.0","id":1,"method":"textDocument/hover","params":{"line":1}}}`,
+	`{"msgKind":"request","from":"client","method":"textDocument/hover","id":2,"timestamp":"2024-11-28T12:01:45.001Z","msg":{"jsonrpc":"2.0","id":2,"method":"textDocument/hover","params":{"line":2}}}`,
+	`{"msgKind":"response","from":"server","method":"textDocument/hover","id":2,"timestamp":"2024-11-28T12:01:45.010Z","msg":{"jsonrpc":"2.0","id":2,"result":"two"}}`,
+	`{"msgKind":"response","from":"server","method":"textDocument/hover","id":1,"timestamp":"2024-11-28T12:01:45.020Z","msg":{"jsonrpc":"2.0","id":1,"result":"one"}}`,
+	`{"msgKind":"notification","from":"client","method":"textDocument/didOpen","timestamp":"2024-11-28T12:01:46.000Z","msg":{"jsonrpc":"2.0","method":"textDocument/didOpen","params":{}}}`,
+	`{"msgKind":"notification","from":"server","method":"textDocument/publishDiagnostics","timestamp":"2024-11-28T12:01:46.100Z","msg":{"jsonrpc":"2.0","method":"textDocument/publishDiagnostics","params":{"diagnostics":[]}}}`,
+	`{"msgKind":"request","from":"client","method":"textDocument/references","id":3,"timestamp":"2024-11-28T12:01:46.500Z","msg":{"jsonrpc":"2.0","id":3,"method":"textDocument/references","params":{}}}`,
+	`{"msgKind":"notification","from":"client","method":"exit","timestamp":"2024-11-28T12:01:47.000Z","msg":{"jsonrpc":"2.0","method":"exit"}}`,
+}, "\n")
+
+func readMessages(r io.Reader) chan *internal.RawLSPMessage {
+	chunks := make(chan []byte)
+	go func() {
+		defer close(chunks)
+		buf := make([]byte, 1024)
+		for {
+			n, err := r.Read(buf)
+			if n > 0 {
+				chunks <- bytes.Clone(buf[:n])
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return pipeline.NewJsonRpcStage().Run(chunks)
+}
+
+func TestServerAnswersFromTrace(t *testing.T) {
+	traces, err := internal.ReadTraces(strings.NewReader(serverTrace))
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientInReader, clientInWriter := io.Pipe()
+	clientOutReader, clientOutWriter := io.Pipe()
+	server := NewServer(traces, clientInWriter, clientOutReader)
+	done := make(chan error)
+	go func() {
+		done <- server.Run()
+		clientInWriter.Close()
+	}()
+	msgs := readMessages(clientInReader)
+
+	// live client asks in a different order and with different ids
+	send := func(body string) {
+		go pipeline.WriteJsonRpcMessage(clientOutWriter, []byte(body))
+	}
+	send(`{"jsonrpc":"2.0","id":"b","method":"textDocument/hover","params":{"line":2}}`)
+	msg := <-msgs
+	if msg.Id.String() != `"b"` || string(msg.Result) != `"two"` {
+		t.Fatalf("expected response for line 2 with live id, got %s", msg)
+	}
+	send(`{"jsonrpc":"2.0","id":"a","method":"textDocument/hover","params":{"line":1}}`)
+	msg = <-msgs
+	if msg.Id.String() != `"a"` || string(msg.Result) != `"one"` {
+		t.Fatalf("expected response for line 1 with live id, got %s", msg)
+	}
+	send(`{"jsonrpc":"2.0","id":"c","method":"textDocument/definition","params":{}}`)
+	msg = <-msgs
+	if internal.MessageKind(msg) != internal.ERROR {
+		t.Fatalf("expected error for unrecorded request, got %s", msg)
+	}
+	send(`{"jsonrpc":"2.0","method":"textDocument/didOpen","params":{}}`)
+	msg = <-msgs
+	if *msg.Method != "textDocument/publishDiagnostics" {
+		t.Fatalf("expected recorded diagnostics after didOpen, got %s", msg)
+	}
+	send(`{"jsonrpc":"2.0","id":"d","method":"textDocument/references","params":{}}`)
+	msg = <-msgs
+	if internal.MessageKind(msg) != internal.ERROR || msg.Id.String() != `"d"` {
+		t.Fatalf("expected error for recorded request without a response, got %s", msg)
+	}
+	send(`{"jsonrpc":"2.0","method":"exit"}`)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected server to stop after exit")
+	}
+}
+
+func TestReplayAgainstServer(t *testing.T) {
+	traces, err := internal.ReadTraces(strings.NewReader(recordedTrace))
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverInReader, serverInWriter := io.Pipe()
+	serverOutReader, serverOutWriter := io.Pipe()
+	go NewServer(traces, serverOutWriter, serverInReader).Run()
+	client := NewClient(traces, serverInWriter, serverOutReader)
+	client.ResponseTimeout = 5 * time.Second
+	if err := client.Run(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServerPairsWithinSessions(t *testing.T) {
+	traces, err := internal.ReadTraces(strings.NewReader(strings.Join([]string{
+		`{"msgKind":"request","from":"client","method":"textDocument/hover","id":1,"sessionId":"a","timestamp":"2024-11-28T12:01:45.000Z","msg":{"jsonrpc":"2.0","id":1,"method":"textDocument/hover","params":{"line":1}}}`,
+		`{"msgKind":"request","from":"client","method":"textDocument/hover","id":1,"sessionId":"b","timestamp":"2024-11-28T12:01:45.010Z","msg":{"jsonrpc":"2.0","id":1,"method":"textDocument/hover","params":{"line":2}}}`,
+		`{"msgKind":"response","from":"server","method":"textDocument/hover","id":1,"sessionId":"b","timestamp":"2024-11-28T12:01:45.030Z","msg":{"jsonrpc":"2.0","id":1,"result":"two"}}`,
+		`{"msgKind":"response","from":"server","method":"textDocument/hover","id":1,"sessionId":"a","timestamp":"2024-11-28T12:01:45.100Z","msg":{"jsonrpc":"2.0","id":1,"result":"one"}}`,
+	}, "\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientInReader, clientInWriter := io.Pipe()
+	clientOutReader, clientOutWriter := io.Pipe()
+	go NewServer(traces, clientInWriter, clientOutReader).Run()
+	msgs := readMessages(clientInReader)
+	go pipeline.WriteJsonRpcMessage(clientOutWriter, []byte(`{"jsonrpc":"2.0","id":1,"method":"textDocument/hover","params":{"line":1}}`))
+	if msg := <-msgs; string(msg.Result) != `"one"` {
+		t.Fatalf("expected the response recorded for the request's session, got %s", msg)
+	}
+	clientOutWriter.Close()
+}
@@ -0,0 +1,105 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strconv"
+)
+
+var (
+	EINVALIDID = errors.New("jsonrpc: id must be a number or a string")
+)
+
+// RequestId is a jsonrpc request id. JSON-RPC 2.0 allows ids to be
+// either numbers or strings so the original json is kept around to
+// be written back out exactly as it was received.
+type RequestId struct {
+	// original json representation of the id e.g. `1` or `"abc"`
+	raw json.RawMessage
+	// decoded string value or number literal. used for comparing ids
+	value    string
+	isString bool
+}
+
+func NewIntId(id int64) *RequestId {
+	value := strconv.FormatInt(id, 10)
+	return &RequestId{raw: json.RawMessage(value), value: value}
+}
+
+func NewStringId(id string) *RequestId {
+	raw, _ := json.Marshal(id)
+	return &RequestId{raw: raw, value: id, isString: true}
+}
+
+func (id *RequestId) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && data[0] == '"' {
+		var s string
+		if err := json.Unmarshal(data, &s); err != nil {
+			return errors.Join(EINVALIDID, err)
+		}
+		*id = RequestId{raw: bytes.Clone(data), value: s, isString: true}
+		return nil
+	}
+	var n json.Number
+	if err := json.Unmarshal(data, &n); err != nil {
+		return errors.Join(EINVALIDID, err)
+	}
+	if n == "" {
+		return EINVALIDID
+	}
+	*id = RequestId{raw: bytes.Clone(data), value: n.String()}
+	return nil
+}
+
+func (id RequestId) MarshalJSON() ([]byte, error) {
+	if id.raw == nil {
+		return nil, EINVALIDID
+	}
+	return id.raw, nil
+}
+
+// IsString reports whether the id was sent as a json string.
+func (id RequestId) IsString() bool {
+	return id.isString
+}
+
+// Int64 returns the id as an int64 if it was sent as an integer.
+func (id RequestId) Int64() (int64, bool) {
+	if id.isString {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(id.value, 10, 64)
+	return n, err == nil
+}
+
+// Equal reports whether both ids have the same kind and value.
+func (id RequestId) Equal(other RequestId) bool {
+	return id.key() == other.key()
+}
+
+// key is the comparable form of the id. number 1 and string "1" are
+// different ids.
+func (id RequestId) key() requestKey {
+	return requestKey{value: id.value, isString: id.isString}
+}
+
+// String returns the json form of the id so that string and number ids
+// can be told apart in logs.
+func (id RequestId) String() string {
+	return string(id.raw)
+}
+
+type requestKey struct {
+	value    string
+	isString bool
+}
+
+// id turns the key back into the id it was made from.
+func (k requestKey) id() RequestId {
+	if k.isString {
+		return *NewStringId(k.value)
+	}
+	return RequestId{raw: json.RawMessage(k.value), value: k.value}
+}
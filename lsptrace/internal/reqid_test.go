@@ -0,0 +1,50 @@
+package internal
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestRequestIdRoundTrip(t *testing.T) {
+	for _, body := range []string{
+		`{"jsonrpc":"2.0","id":12,"method":"initialize"}`,
+		`{"jsonrpc":"2.0","id":"abc-1","method":"initialize"}`,
+		`{"jsonrpc":"2.0","id":"é","result":null}`,
+	} {
+		msg := new(RawLSPMessage)
+		if err := json.Unmarshal([]byte(body), msg); err != nil {
+			t.Fatalf("unmarshal %s: %s", body, err)
+		}
+		out, err := json.Marshal(msg.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var expected struct {
+			Id json.RawMessage `json:"id"`
+		}
+		json.Unmarshal([]byte(body), &expected)
+		if string(out) != string(expected.Id) {
+			t.Fatalf("expected id %s to round trip, got %s", expected.Id, out)
+		}
+	}
+}
+
+func TestRequestIdInvalid(t *testing.T) {
+	msg := new(RawLSPMessage)
+	err := json.Unmarshal([]byte(`{"jsonrpc":"2.0","id":{"a":1},"method":"initialize"}`), msg)
+	if err == nil {
+		t.Fatal("expected object id to fail to parse")
+	}
+}
+
+func TestRequestIdEqual(t *testing.T) {
+	if NewIntId(1).Equal(*NewStringId("1")) {
+		t.Fatal("number and string ids should not be equal")
+	}
+	if !NewStringId("a").Equal(*NewStringId("a")) {
+		t.Fatal("string ids with the same value should be equal")
+	}
+	if n, ok := NewIntId(42).Int64(); !ok || n != 42 {
+		t.Fatal("expected int id to convert to int64")
+	}
+}
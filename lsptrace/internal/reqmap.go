@@ -4,37 +4,61 @@ import (
 	"fmt"
 	"log"
 	"sync"
+	"time"
 )
 
+// RequestInfo is what is remembered about a request until its
+// response is seen.
+type RequestInfo struct {
+	Method string
+	// UTC timestamp the request was received by the tracer
+	Timestamp time.Time
+	// whether the request was left out of the trace by the method filter
+	Excluded bool
+}
+
 type RequestMap struct {
 	rMutex sync.Mutex
-	rMap   map[int64]string
+	rMap   map[requestKey]RequestInfo
 }
 
 func NewRequestMap() *RequestMap {
-	return &RequestMap{rMap: make(map[int64]string)}
+	return &RequestMap{rMap: make(map[requestKey]RequestInfo)}
 }
 
-func (m *RequestMap) PushRequest(reqid int64, method string) {
-	if reqid < 0 || len(method) < 1 {
+func (m *RequestMap) PushRequest(reqid RequestId, info RequestInfo) {
+	if reqid.raw == nil || len(info.Method) < 1 {
 		panic("RequestMap: insert must be called with non-nil and non-empty reqid and method")
 	}
 	m.rMutex.Lock()
 	defer m.rMutex.Unlock()
-	m.rMap[reqid] = method
+	m.rMap[reqid.key()] = info
 }
 
-func (m *RequestMap) Pop(reqid int64) string {
+// Pop returns the request info saved for reqid and removes it from the map.
+// ok is false if there was no request saved for reqid.
+func (m *RequestMap) Pop(reqid RequestId) (info RequestInfo, ok bool) {
 	m.rMutex.Lock()
 	defer m.rMutex.Unlock()
-	method, ok := m.rMap[reqid]
-	if !ok || len(method) < 1 {
+	info, ok = m.rMap[reqid.key()]
+	if !ok || len(info.Method) < 1 {
 		// TODO: this shouldn't happen but I see it happen. why?
 		log.Printf("RequestMap: reqid [%v] did not exist in map. Pop must be called after Insert.", reqid)
-		return ""
+		return RequestInfo{}, false
+	}
+	delete(m.rMap, reqid.key())
+	return info, true
+}
+
+// Ids returns the ids of the requests which haven't been popped yet.
+func (m *RequestMap) Ids() []RequestId {
+	m.rMutex.Lock()
+	defer m.rMutex.Unlock()
+	ids := make([]RequestId, 0, len(m.rMap))
+	for key := range m.rMap {
+		ids = append(ids, key.id())
 	}
-	delete(m.rMap, reqid)
-	return method
+	return ids
 }
 
 func (m *RequestMap) String() string {
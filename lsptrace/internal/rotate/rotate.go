@@ -0,0 +1,283 @@
+package rotate
+
+import (
+	"cmp"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// rotated segments are named <name>-<SEGMENT_TIME_FORMAT><ext>
+	SEGMENT_TIME_FORMAT = "20060102T150405.000000"
+	GZIP_EXT            = ".gz"
+)
+
+var (
+	EINVALIDSIZE = errors.New("rotate: size must be a number of bytes with an optional K, M or G suffix")
+)
+
+// Options of when a file is rotated. A file is only rotated if MaxSize or
+// MaxAge is set.
+type Options struct {
+	// rotate before a write would make the file bigger than this many bytes
+	MaxSize int64
+	// rotate before writing to a file which was opened this long ago
+	MaxAge time.Duration
+	// how many rotated segments are kept. all are kept if 0
+	MaxFiles int
+	// gzip rotated segments
+	Compress bool
+}
+
+func (o Options) Enabled() bool {
+	return o.MaxSize > 0 || o.MaxAge > 0
+}
+
+// Writer writes to a file which is moved aside as a segment and replaced by
+// a new file when it gets too big or old. Each Write goes to a single file
+// so that lines written in one Write are never split.
+type Writer struct {
+	path string
+	opts Options
+
+	mutex  sync.Mutex
+	file   *os.File
+	size   int64
+	opened time.Time
+
+	// segments are compressed and pruned in the background, one at a time
+	background      sync.WaitGroup
+	backgroundMutex sync.Mutex
+}
+
+// Open truncates the file at path. With rotation enabled, an existing file
+// is kept as a segment instead so that it isn't lost when lsptrace restarts.
+func Open(path string, opts Options) (*Writer, error) {
+	if opts.MaxSize < 0 || opts.MaxAge < 0 || opts.MaxFiles < 0 {
+		return nil, fmt.Errorf("rotate: options must not be negative, got %+v", opts)
+	}
+	w := &Writer{path: path, opts: opts}
+	if opts.Enabled() {
+		if info, err := os.Stat(path); err == nil && info.Size() > 0 {
+			if err := w.moveToSegment(info.ModTime()); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *Writer) open() error {
+	file, err := os.OpenFile(w.path, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+	w.file, w.size, w.opened = file, 0, time.Now()
+	return nil
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.shouldRotate(len(p)) {
+		if err := w.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *Writer) shouldRotate(n int) bool {
+	// a line bigger than MaxSize gets a file of its own
+	if w.size == 0 {
+		return false
+	}
+	if w.opts.MaxSize > 0 && w.size+int64(n) > w.opts.MaxSize {
+		return true
+	}
+	return w.opts.MaxAge > 0 && time.Since(w.opened) >= w.opts.MaxAge
+}
+
+func (w *Writer) rotate() error {
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+	if err := w.moveToSegment(time.Now()); err != nil {
+		return err
+	}
+	return w.open()
+}
+
+// moveToSegment renames the file to a segment named after t and then
+// compresses and prunes segments in the background.
+func (w *Writer) moveToSegment(t time.Time) error {
+	segment := w.segmentName(t)
+	if err := os.Rename(w.path, segment); err != nil {
+		return errors.Join(errors.New("rotate: could not move file to segment"), err)
+	}
+	log.Printf("rotate: moved %s to %s\n", w.path, segment)
+	w.background.Add(1)
+	go func() {
+		defer w.background.Done()
+		w.backgroundMutex.Lock()
+		defer w.backgroundMutex.Unlock()
+		if w.opts.Compress {
+			if err := compress(segment); err != nil {
+				log.Printf("rotate: error compressing %s: %s\n", segment, err)
+			}
+		}
+		w.prune()
+	}()
+	return nil
+}
+
+func (w *Writer) segmentName(t time.Time) string {
+	ext := filepath.Ext(w.path)
+	stem := strings.TrimSuffix(w.path, ext)
+	segment := stem + "-" + t.Format(SEGMENT_TIME_FORMAT) + ext
+	for i := 1; exists(segment) || exists(segment+GZIP_EXT); i++ {
+		segment = stem + "-" + t.Format(SEGMENT_TIME_FORMAT) + "-" + strconv.Itoa(i) + ext
+	}
+	return segment
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// Segments returns the rotated segments of the file at path, oldest first.
+func Segments(path string) ([]string, error) {
+	ext := filepath.Ext(path)
+	stem := strings.TrimSuffix(path, ext)
+	matches, err := filepath.Glob(globEscape(stem) + "-*")
+	if err != nil {
+		return nil, err
+	}
+	keys := make(map[string]string)
+	segments := make([]string, 0)
+	for _, match := range matches {
+		middle, ok := strings.CutSuffix(strings.TrimSuffix(match, GZIP_EXT), ext)
+		if !ok {
+			continue
+		}
+		// a counter is added to segments rotated at the same time
+		timestamp, counter, _ := strings.Cut(strings.TrimPrefix(middle, stem+"-"), "-")
+		if _, err := time.Parse(SEGMENT_TIME_FORMAT, timestamp); err != nil {
+			continue
+		}
+		n, err := strconv.Atoi(cmp.Or(counter, "0"))
+		if err != nil {
+			continue
+		}
+		keys[match] = fmt.Sprintf("%s-%09d", timestamp, n)
+		segments = append(segments, match)
+	}
+	sort.SliceStable(segments, func(i, j int) bool {
+		return keys[segments[i]] < keys[segments[j]]
+	})
+	return segments, nil
+}
+
+func globEscape(path string) string {
+	replacer := strings.NewReplacer("*", `\*`, "?", `\?`, "[", `\[`, `\`, `\\`)
+	return replacer.Replace(path)
+}
+
+// prune removes the oldest segments beyond MaxFiles.
+func (w *Writer) prune() {
+	if w.opts.MaxFiles <= 0 {
+		return
+	}
+	segments, err := Segments(w.path)
+	if err != nil {
+		log.Printf("rotate: error listing segments of %s: %s\n", w.path, err)
+		return
+	}
+	// a segment can be there twice if compressing it was interrupted
+	unique := make([]string, 0, len(segments))
+	for _, segment := range segments {
+		stem := strings.TrimSuffix(segment, GZIP_EXT)
+		if len(unique) > 0 && strings.TrimSuffix(unique[len(unique)-1], GZIP_EXT) == stem {
+			continue
+		}
+		unique = append(unique, segment)
+	}
+	for _, segment := range unique[:max(len(unique)-w.opts.MaxFiles, 0)] {
+		stem := strings.TrimSuffix(segment, GZIP_EXT)
+		for _, path := range []string{stem, stem + GZIP_EXT} {
+			if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+				log.Printf("rotate: error removing %s: %s\n", path, err)
+			}
+		}
+	}
+}
+
+// compress replaces segment with a gzipped copy.
+func compress(segment string) error {
+	in, err := os.Open(segment)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tmp := segment + GZIP_EXT + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(out)
+	_, err = io.Copy(gz, in)
+	err = errors.Join(err, gz.Close(), out.Close())
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, segment+GZIP_EXT); err != nil {
+		return err
+	}
+	return os.Remove(segment)
+}
+
+// Close closes the file and waits for segments to be compressed.
+func (w *Writer) Close() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	err := w.file.Close()
+	w.background.Wait()
+	return err
+}
+
+// ParseSize parses a size like 500000, 512K, 100M or 1G.
+func ParseSize(s string) (int64, error) {
+	if len(s) == 0 {
+		return 0, nil
+	}
+	multiplier := int64(1)
+	upper := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "B")
+	for suffix, m := range map[string]int64{"K": 1 << 10, "M": 1 << 20, "G": 1 << 30} {
+		if strings.HasSuffix(upper, suffix) {
+			upper, multiplier = strings.TrimSuffix(upper, suffix), m
+			break
+		}
+	}
+	n, err := strconv.ParseInt(upper, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%w, got %q", EINVALIDSIZE, s)
+	}
+	return n * multiplier, nil
+}
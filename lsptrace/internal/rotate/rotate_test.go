@@ -0,0 +1,134 @@
+package rotate
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func readFile(t *testing.T, path string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if strings.HasSuffix(path, GZIP_EXT) {
+		if r, err = gzip.NewReader(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestRotateBySize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trace.json")
+	w, err := Open(path, Options{MaxSize: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"aaaa\n", "bbbb\n", "cccc\n", "a line longer than the max size\n", "dddd\n"} {
+		w.Write([]byte(line))
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	segments, err := Segments(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents := make([]string, 0)
+	for _, segment := range segments {
+		contents = append(contents, readFile(t, segment))
+	}
+	contents = append(contents, readFile(t, path))
+	expected := []string{"aaaa\nbbbb\n", "cccc\n", "a line longer than the max size\n", "dddd\n"}
+	if strings.Join(contents, "|") != strings.Join(expected, "|") {
+		t.Fatalf("expected lines to be kept whole in order, got %q", contents)
+	}
+}
+
+func TestRotateByAge(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trace.json")
+	w, err := Open(path, Options{MaxAge: time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("old\n"))
+	time.Sleep(5 * time.Millisecond)
+	w.Write([]byte("new\n"))
+	w.Close()
+	segments, _ := Segments(path)
+	if len(segments) != 1 || readFile(t, segments[0]) != "old\n" || readFile(t, path) != "new\n" {
+		t.Fatalf("expected the old line in a segment, got %v", segments)
+	}
+}
+
+func TestKeepPreviousFileAndPrune(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "trace.json")
+	os.WriteFile(path, []byte("previous run\n"), 0666)
+	// not a segment
+	os.WriteFile(filepath.Join(dir, "trace-other.json"), []byte("x"), 0666)
+	w, err := Open(path, Options{MaxSize: 5, MaxFiles: 2, Compress: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"111\n", "222\n", "333\n"} {
+		w.Write([]byte(line))
+	}
+	w.Close()
+	segments, _ := Segments(path)
+	if len(segments) != 2 {
+		t.Fatalf("expected 2 segments to be kept, got %v", segments)
+	}
+	for _, segment := range segments {
+		if !strings.HasSuffix(segment, ".json"+GZIP_EXT) {
+			t.Fatalf("expected segments to be compressed, got %v", segments)
+		}
+	}
+	if readFile(t, segments[0]) != "111\n" || readFile(t, segments[1]) != "222\n" || readFile(t, path) != "333\n" {
+		t.Fatalf("expected the oldest segments to be removed, got %v", segments)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "trace-other.json")); err != nil {
+		t.Fatal("expected files which aren't segments to be kept")
+	}
+}
+
+func TestOpenWithoutRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trace.json")
+	os.WriteFile(path, []byte("previous run\n"), 0666)
+	w, err := Open(path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(bytes.Repeat([]byte("x"), 100))
+	w.Close()
+	segments, _ := Segments(path)
+	if len(segments) != 0 || len(readFile(t, path)) != 100 {
+		t.Fatalf("expected the file to be truncated without rotation, got %v", segments)
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	tests := map[string]int64{"": 0, "500": 500, "512K": 512 << 10, "100MB": 100 << 20, "1g": 1 << 30}
+	for s, expected := range tests {
+		size, err := ParseSize(s)
+		if err != nil || size != expected {
+			t.Fatalf("expected %q to be %d, got %d %v", s, expected, size, err)
+		}
+	}
+	if _, err := ParseSize("ten"); !errors.Is(err, EINVALIDSIZE) {
+		t.Fatalf("expected an invalid size error, got %v", err)
+	}
+}
@@ -0,0 +1,311 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf16"
+)
+
+const (
+	// client messages bigger than this aren't looked at by ObserveRaw.
+	// shutdown and exit have no params so they are always smaller
+	RAW_BODY_LIMIT = 4 * 1024
+	// header sections longer than this are not looked for a content length in
+	RAW_HEADER_LIMIT = 4 * 1024
+)
+
+var (
+	// quick check for a body which may be shutdown or exit before it is
+	// decoded. it also matches a nested "method" field
+	shutdownMethod = regexp.MustCompile(`"method"\s*:\s*"(shutdown|exit)"`)
+)
+
+// SessionState keeps what the client has told the server so far, to tell a
+// crash from a requested exit and to bring a restarted server to the same
+// state.
+type SessionState struct {
+	mutex sync.Mutex
+	// whether the client sent shutdown or exit
+	shuttingDown bool
+	// the client's stream as passed to ObserveRaw
+	rawFrames rawFrames
+
+	// only kept when the handshake is to be replayed
+	keepHandshake bool
+	initialize    *RawLSPMessage
+	initialized   *RawLSPMessage
+	// each open document with the changes since it was opened applied, so
+	// that a long session doesn't keep every edit
+	documents     map[string]*textDocumentItem
+	documentOrder []string
+}
+
+// textDocumentItem is the lsp TextDocumentItem sent with didOpen.
+type textDocumentItem struct {
+	Uri        string `json:"uri"`
+	LanguageId string `json:"languageId"`
+	Version    int    `json:"version"`
+	Text       string `json:"text"`
+}
+
+type textDocumentChange struct {
+	// the whole text is replaced if unset
+	Range *struct {
+		Start position `json:"start"`
+		End   position `json:"end"`
+	} `json:"range,omitempty"`
+	Text string `json:"text"`
+}
+
+type position struct {
+	Line      int `json:"line"`
+	Character int `json:"character"`
+}
+
+func NewSessionState(keepHandshake bool) *SessionState {
+	return &SessionState{keepHandshake: keepHandshake, documents: make(map[string]*textDocumentItem)}
+}
+
+// ObserveRaw looks for shutdown and exit in a chunk the client sent before
+// it is parsed. The chunk may be dropped or traced later on, while whether
+// the server was asked to exit has to be known as soon as it exits.
+func (s *SessionState) ObserveRaw(chunk []byte) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.shuttingDown {
+		return
+	}
+	s.rawFrames.write(chunk, func(body []byte) {
+		if shutdownMethod.Match(body) && isShutdown(body) {
+			s.shuttingDown = true
+		}
+	})
+}
+
+// methodOnly decodes the method of a message and nothing else.
+type methodOnly struct {
+	Method string `json:"method"`
+}
+
+// isShutdown reports whether body is shutdown or exit, or a batch with
+// either of them. Only the method of the message counts, not a "method"
+// field somewhere in its params or result.
+func isShutdown(body []byte) bool {
+	msgs := make([]methodOnly, 1)
+	var err error
+	if bytes.HasPrefix(bytes.TrimSpace(body), []byte("[")) {
+		err = json.Unmarshal(body, &msgs)
+	} else {
+		err = json.Unmarshal(body, &msgs[0])
+	}
+	return err == nil && slices.ContainsFunc(msgs, func(msg methodOnly) bool {
+		return msg.Method == "shutdown" || msg.Method == "exit"
+	})
+}
+
+// rawFrames splits a raw jsonrpc stream into message bodies. Only what's
+// needed to find the bodies is parsed, anything malformed is skipped.
+type rawFrames struct {
+	// the header section read so far
+	header []byte
+	// bytes of the current body which weren't read yet
+	bodyLeft int
+	// the current body unless it is bigger than RAW_BODY_LIMIT
+	body []byte
+	keep bool
+}
+
+// write adds a chunk of the stream and calls found with every body
+// completed by it which isn't bigger than RAW_BODY_LIMIT.
+func (f *rawFrames) write(chunk []byte, found func(body []byte)) {
+	for len(chunk) > 0 {
+		if f.bodyLeft > 0 {
+			n := min(f.bodyLeft, len(chunk))
+			if f.keep {
+				f.body = append(f.body, chunk[:n]...)
+			}
+			f.bodyLeft -= n
+			chunk = chunk[n:]
+			if f.bodyLeft == 0 && f.keep {
+				found(f.body)
+				f.body = nil
+			}
+			continue
+		}
+		f.header = append(f.header, chunk...)
+		end := bytes.Index(f.header, []byte("\r\n\r\n"))
+		if end < 0 {
+			if len(f.header) > RAW_HEADER_LIMIT {
+				// a \r\n\r\n may be split across chunks
+				f.header = slices.Clone(f.header[len(f.header)-3:])
+			}
+			return
+		}
+		chunk = f.header[end+4:]
+		length := rawContentLength(f.header[:end])
+		f.header = nil
+		f.bodyLeft, f.keep = length, length <= RAW_BODY_LIMIT
+	}
+}
+
+// rawContentLength returns the last content length in a header section or
+// 0 if it has none. Anything in front of the header, e.g. the rest of a
+// malformed message, is ignored.
+func rawContentLength(section []byte) int {
+	i := bytes.LastIndex(bytes.ToLower(section), []byte("content-length:"))
+	if i < 0 {
+		return 0
+	}
+	value, _, _ := bytes.Cut(section[i+len("content-length:"):], []byte("\r\n"))
+	length, err := strconv.Atoi(string(bytes.TrimSpace(value)))
+	if err != nil || length < 0 {
+		return 0
+	}
+	return length
+}
+
+// Observe records a message sent by the client.
+func (s *SessionState) Observe(msg *RawLSPMessage) {
+	if s == nil || msg.Method == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	switch *msg.Method {
+	case "shutdown", "exit":
+		s.shuttingDown = true
+	}
+	if !s.keepHandshake {
+		return
+	}
+	copied := *msg
+	switch *msg.Method {
+	case "initialize":
+		s.initialize = &copied
+	case "initialized":
+		s.initialized = &copied
+	case "textDocument/didOpen":
+		var params struct {
+			TextDocument textDocumentItem `json:"textDocument"`
+		}
+		if json.Unmarshal(msg.Params, &params) != nil {
+			return
+		}
+		uri := params.TextDocument.Uri
+		if _, ok := s.documents[uri]; !ok {
+			s.documentOrder = append(s.documentOrder, uri)
+		}
+		s.documents[uri] = &params.TextDocument
+	case "textDocument/didChange":
+		var params struct {
+			TextDocument struct {
+				Uri     string `json:"uri"`
+				Version int    `json:"version"`
+			} `json:"textDocument"`
+			ContentChanges []textDocumentChange `json:"contentChanges"`
+		}
+		if json.Unmarshal(msg.Params, &params) != nil {
+			return
+		}
+		document, ok := s.documents[params.TextDocument.Uri]
+		if !ok {
+			return
+		}
+		for _, change := range params.ContentChanges {
+			document.Text = applyChange(document.Text, change)
+		}
+		document.Version = params.TextDocument.Version
+	case "textDocument/didClose":
+		var params struct {
+			TextDocument struct {
+				Uri string `json:"uri"`
+			} `json:"textDocument"`
+		}
+		json.Unmarshal(msg.Params, &params)
+		uri := params.TextDocument.Uri
+		delete(s.documents, uri)
+		s.documentOrder = slices.DeleteFunc(s.documentOrder, func(open string) bool { return open == uri })
+	}
+}
+
+// applyChange applies a didChange content change to text.
+func applyChange(text string, change textDocumentChange) string {
+	if change.Range == nil {
+		return change.Text
+	}
+	start := positionOffset(text, change.Range.Start)
+	end := max(start, positionOffset(text, change.Range.End))
+	return text[:start] + change.Text + text[end:]
+}
+
+// positionOffset returns the byte offset of pos in text. Characters are
+// counted in utf-16 code units, the lsp default. Positions past the end of
+// a line or of the text are clamped to it like clients do.
+func positionOffset(text string, pos position) int {
+	offset := 0
+	for line := 0; line < pos.Line; line++ {
+		i := strings.IndexAny(text[offset:], "\r\n")
+		if i < 0 {
+			return len(text)
+		}
+		offset += i
+		if strings.HasPrefix(text[offset:], "\r\n") {
+			offset += 2
+		} else {
+			offset++
+		}
+	}
+	units := 0
+	for i, r := range text[offset:] {
+		if units >= pos.Character || r == '\r' || r == '\n' {
+			return offset + i
+		}
+		units += utf16.RuneLen(r)
+	}
+	return len(text)
+}
+
+// ShuttingDown reports whether the client asked the server to shut down.
+func (s *SessionState) ShuttingDown() bool {
+	if s == nil {
+		return false
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.shuttingDown
+}
+
+// Handshake returns the messages which bring a new server to the state of
+// the session: the client's initialize request with id in place of its
+// own and then initialized and a didOpen with the current text of each
+// document which is open. initialize is nil if the client never sent one.
+func (s *SessionState) Handshake(id *RequestId) (initialize *RawLSPMessage, rest []*RawLSPMessage) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.initialize == nil {
+		return nil, nil
+	}
+	copied := *s.initialize
+	copied.Id = id
+	rest = make([]*RawLSPMessage, 0)
+	if s.initialized != nil {
+		rest = append(rest, s.initialized)
+	}
+	method := "textDocument/didOpen"
+	for _, uri := range s.documentOrder {
+		params, err := json.Marshal(map[string]any{"textDocument": s.documents[uri]})
+		if err != nil {
+			continue
+		}
+		rest = append(rest, &RawLSPMessage{JsonRpc: "2.0", Method: &method, Params: params})
+	}
+	return &copied, rest
+}
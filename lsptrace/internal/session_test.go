@@ -0,0 +1,113 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func clientMessage(id *RequestId, method string, params string) *RawLSPMessage {
+	return &RawLSPMessage{JsonRpc: "2.0", Id: id, Method: &method, Params: json.RawMessage(params)}
+}
+
+func TestSessionStateHandshake(t *testing.T) {
+	state := NewSessionState(true)
+	if initialize, _ := state.Handshake(NewStringId("restart")); initialize != nil {
+		t.Fatal("expected no handshake before initialize")
+	}
+	for _, msg := range []*RawLSPMessage{
+		clientMessage(NewIntId(1), "initialize", `{"rootUri":"file:///a"}`),
+		clientMessage(nil, "initialized", `{}`),
+		clientMessage(nil, "textDocument/didOpen", `{"textDocument":{"uri":"file:///a/x.go","languageId":"go","version":1,"text":"package a\n"}}`),
+		clientMessage(nil, "textDocument/didOpen", `{"textDocument":{"uri":"file:///a/y.go","languageId":"go","version":1,"text":""}}`),
+		clientMessage(nil, "textDocument/didChange", `{"textDocument":{"uri":"file:///a/x.go","version":2},"contentChanges":[{"text":"package x\n"}]}`),
+		clientMessage(nil, "textDocument/didChange", `{"textDocument":{"uri":"file:///a/x.go","version":3},"contentChanges":[{"range":{"start":{"line":1,"character":0},"end":{"line":1,"character":0}},"text":"var s = \"é😀\"\n"}]}`),
+		clientMessage(nil, "textDocument/didChange", `{"textDocument":{"uri":"file:///a/x.go","version":4},"contentChanges":[{"range":{"start":{"line":1,"character":12},"end":{"line":1,"character":12}},"text":"!"},{"range":{"start":{"line":0,"character":8},"end":{"line":0,"character":9}},"text":"b"}]}`),
+		clientMessage(NewIntId(2), "textDocument/hover", `{"textDocument":{"uri":"file:///a/x.go"}}`),
+		clientMessage(nil, "textDocument/didClose", `{"textDocument":{"uri":"file:///a/y.go"}}`),
+	} {
+		state.Observe(msg)
+	}
+	if state.ShuttingDown() {
+		t.Fatal("expected the session not to be shutting down")
+	}
+	initialize, rest := state.Handshake(NewStringId("restart"))
+	if initialize == nil || *initialize.Method != "initialize" || initialize.Id.String() != `"restart"` {
+		t.Fatalf("expected initialize with the given id, got %v", initialize)
+	}
+	methods := make([]string, len(rest))
+	for i, msg := range rest {
+		methods[i] = *msg.Method
+	}
+	expected := []string{"initialized", "textDocument/didOpen"}
+	if len(methods) != len(expected) || methods[0] != expected[0] || methods[1] != expected[1] {
+		t.Fatalf("expected %v for the open document, got %v", expected, methods)
+	}
+	// the changes are applied instead of being replayed. the emoji counts as
+	// two utf-16 code units
+	if params := string(rest[1].Params); params != `{"textDocument":{"uri":"file:///a/x.go","languageId":"go","version":4,"text":"package b\nvar s = \"é😀!\"\n"}}` {
+		t.Fatalf("expected didOpen with the current text, got %s", params)
+	}
+
+	state.Observe(clientMessage(NewIntId(3), "shutdown", ""))
+	if !state.ShuttingDown() {
+		t.Fatal("expected shutdown to be recorded")
+	}
+}
+
+func TestSessionStateObserveRaw(t *testing.T) {
+	state := NewSessionState(false)
+	// source text mentioning shutdown is escaped inside its json string
+	state.ObserveRaw(frame(`{"jsonrpc":"2.0","method":"textDocument/didChange","params":{"text":"{\"method\":\"shutdown\"}"}}`))
+	if state.ShuttingDown() {
+		t.Fatal("expected escaped text not to count as shutdown")
+	}
+	// a method nested in params or a result isn't the message's method
+	state.ObserveRaw(frame(`{"jsonrpc":"2.0","id":3,"method":"workspace/executeCommand","params":{"arguments":[{"method":"exit"}]}}`))
+	state.ObserveRaw(frame(`{"jsonrpc":"2.0","id":4,"result":{"method": "shutdown"}}`))
+	state.ObserveRaw(frame(`[{"jsonrpc":"2.0","method":"$/cancelRequest","params":{"method":"exit"}}]`))
+	if state.ShuttingDown() {
+		t.Fatal("expected a nested method not to count as shutdown")
+	}
+	// split across reads
+	split := frame(`{"jsonrpc":"2.0","id":9,"method": "shutdown"}`)
+	state.ObserveRaw(split[:10])
+	state.ObserveRaw(split[10:40])
+	state.ObserveRaw(split[40:])
+	if !state.ShuttingDown() {
+		t.Fatal("expected shutdown split across reads to be seen")
+	}
+}
+
+func TestSessionStateObserveRawBatch(t *testing.T) {
+	state := NewSessionState(false)
+	// a big message in front is skipped
+	state.ObserveRaw(frame(`{"jsonrpc":"2.0","method":"textDocument/didOpen","params":{"text":"` + strings.Repeat("a", RAW_BODY_LIMIT) + `"}}`))
+	state.ObserveRaw(frame(`[{"jsonrpc":"2.0","id":1,"method":"textDocument/hover"},{"jsonrpc":"2.0","method":"exit"}]`))
+	if !state.ShuttingDown() {
+		t.Fatal("expected exit in a batch to be seen")
+	}
+}
+
+func frame(body string) []byte {
+	return []byte(fmt.Sprintf("Content-Length: %d\r\n\r\n%s", len(body), body))
+}
+
+func TestSessionStateWithoutHandshake(t *testing.T) {
+	state := NewSessionState(false)
+	state.Observe(clientMessage(NewIntId(1), "initialize", `{}`))
+	if initialize, _ := state.Handshake(NewStringId("restart")); initialize != nil {
+		t.Fatal("expected the handshake not to be kept")
+	}
+	state.Observe(clientMessage(nil, "exit", ""))
+	if !state.ShuttingDown() {
+		t.Fatal("expected exit to be recorded")
+	}
+	// the tracer calls Observe on a nil state when none is set
+	var unset *SessionState
+	unset.Observe(clientMessage(nil, "exit", ""))
+	if unset.ShuttingDown() {
+		t.Fatal("expected a nil state never to be shutting down")
+	}
+}
@@ -0,0 +1,183 @@
+package shellwords
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	EUNTERMINATED = errors.New("shellwords: unterminated quote")
+	ETRAILING     = errors.New("shellwords: trailing backslash")
+	EBADVAR       = errors.New("shellwords: bad variable substitution")
+)
+
+// Split splits s into words the way a POSIX shell would, without running
+// anything:
+//   - words are separated by unquoted spaces, tabs and new lines
+//   - single quotes keep everything up to the next single quote as it is
+//   - double quotes keep spaces and expand variables. inside them a
+//     backslash only escapes $, ", \ and a new line so that windows paths
+//     can be written as they are e.g. "C:\Program Files\dotnet\dotnet.exe"
+//   - an unquoted backslash keeps the next character as it is
+//   - $VAR and ${VAR} are looked up with getenv outside of single quotes
+//   - an unquoted ~ at the start of a word or right after the = of an
+//     assignment like NAME=~/x, alone or followed by /, is replaced by
+//     home unless home is empty
+func Split(s string, getenv func(string) string, home string) ([]string, error) {
+	words := make([]string, 0)
+	word := new(strings.Builder)
+	// an empty quoted string is still a word
+	inWord := false
+	// whether the word so far was written without quotes, escapes or
+	// variables, to tell a NAME= assignment
+	literal := true
+	runes := []rune(s)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case isSpace(r):
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+			literal = true
+		case r == '\\':
+			if i+1 >= len(runes) {
+				return nil, ETRAILING
+			}
+			i++
+			literal = false
+			// an escaped new line joins lines
+			if runes[i] != '\n' {
+				word.WriteRune(runes[i])
+				inWord = true
+			}
+		case r == '\'':
+			end := indexRune(runes, i+1, '\'')
+			if end < 0 {
+				return nil, EUNTERMINATED
+			}
+			word.WriteString(string(runes[i+1 : end]))
+			i = end
+			inWord, literal = true, false
+		case r == '"':
+			end, err := doubleQuoted(runes, i+1, word, getenv)
+			if err != nil {
+				return nil, err
+			}
+			i = end
+			inWord, literal = true, false
+		case r == '$':
+			next, err := variable(runes, i+1, word, getenv)
+			if err != nil {
+				return nil, err
+			}
+			i = next - 1
+			inWord, literal = true, false
+		case r == '~' && (!inWord || (literal && isAssignment(word.String()))) && len(home) > 0 && (i+1 >= len(runes) || runes[i+1] == '/' || isSpace(runes[i+1])):
+			word.WriteString(home)
+			inWord = true
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
+
+// doubleQuoted writes the double quoted string starting at start to word
+// and returns the index of the closing quote.
+func doubleQuoted(runes []rune, start int, word *strings.Builder, getenv func(string) string) (int, error) {
+	for i := start; i < len(runes); i++ {
+		switch r := runes[i]; r {
+		case '"':
+			return i, nil
+		case '\\':
+			if i+1 < len(runes) && strings.ContainsRune("$\"\\\n", runes[i+1]) {
+				i++
+				if runes[i] != '\n' {
+					word.WriteRune(runes[i])
+				}
+			} else {
+				word.WriteRune(r)
+			}
+		case '$':
+			next, err := variable(runes, i+1, word, getenv)
+			if err != nil {
+				return 0, err
+			}
+			i = next - 1
+		default:
+			word.WriteRune(r)
+		}
+	}
+	return 0, EUNTERMINATED
+}
+
+// variable writes the value of the variable whose name starts at start to
+// word and returns the index after it. A $ which isn't followed by a name
+// is kept.
+func variable(runes []rune, start int, word *strings.Builder, getenv func(string) string) (int, error) {
+	if start < len(runes) && runes[start] == '{' {
+		end := indexRune(runes, start+1, '}')
+		if end < 0 {
+			return 0, EBADVAR
+		}
+		name := string(runes[start+1 : end])
+		if !isName(name) {
+			return 0, errors.Join(EBADVAR, fmt.Errorf("invalid name %q", name))
+		}
+		word.WriteString(getenv(name))
+		return end + 1, nil
+	}
+	end := start
+	for end < len(runes) && isNameRune(runes[end], end == start) {
+		end++
+	}
+	if end == start {
+		word.WriteRune('$')
+		return start, nil
+	}
+	word.WriteString(getenv(string(runes[start:end])))
+	return end, nil
+}
+
+func indexRune(runes []rune, start int, r rune) int {
+	for i := start; i < len(runes); i++ {
+		if runes[i] == r {
+			return i
+		}
+	}
+	return -1
+}
+
+func isSpace(r rune) bool {
+	return r == ' ' || r == '\t' || r == '\n'
+}
+
+// isAssignment reports whether word is the NAME= start of an assignment.
+func isAssignment(word string) bool {
+	name, ok := strings.CutSuffix(word, "=")
+	return ok && isName(name)
+}
+
+func isName(name string) bool {
+	if len(name) == 0 {
+		return false
+	}
+	for i, r := range name {
+		if !isNameRune(r, i == 0) {
+			return false
+		}
+	}
+	return true
+}
+
+func isNameRune(r rune, first bool) bool {
+	return r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (!first && r >= '0' && r <= '9')
+}
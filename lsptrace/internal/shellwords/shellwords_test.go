@@ -0,0 +1,54 @@
+package shellwords
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+func getenv(name string) string {
+	return map[string]string{"ROSLYN": "/opt/roslyn dir", "V": "1"}[name]
+}
+
+func TestSplit(t *testing.T) {
+	for s, expected := range map[string][]string{
+		`dotnet /opt/roslyn/lsp.dll`:                                  {"dotnet", "/opt/roslyn/lsp.dll"},
+		"  dotnet\t lsp.dll \n":                                       {"dotnet", "lsp.dll"},
+		`"/Applications/My Editor.app/dotnet" --stdio`:                {"/Applications/My Editor.app/dotnet", "--stdio"},
+		`'it''s' "a \"b\"" c\ d`:                                      {"its", `a "b"`, "c d"},
+		`"C:\Program Files\dotnet\dotnet.exe" lsp.dll`:                {`C:\Program Files\dotnet\dotnet.exe`, "lsp.dll"},
+		`dotnet "$ROSLYN/lsp.dll" ${ROSLYN}/x '$ROSLYN'`:              {"dotnet", "/opt/roslyn dir/lsp.dll", "/opt/roslyn dir/x", "$ROSLYN"},
+		`--level=$V$UNSET --cost=$ a$`:                                {"--level=1", "--cost=$", "a$"},
+		`~/bin/server ~ a~ "~/x" --log=~/log`:                         {"/home/me/bin/server", "/home/me", "a~", "~/x", "--log=~/log"},
+		`DOTNET_ROOT=~/.dotnet HOME_DIR=~ A=B=~ 1X=~ "Q=~" \Q=~ X=~a`: {"DOTNET_ROOT=/home/me/.dotnet", "HOME_DIR=/home/me", "A=B=~", "1X=~", "Q=~", "Q=~", "X=~a"},
+		`"" ''`:    {"", ""},
+		"a \\\n b": {"a", "b"},
+		``:         {},
+	} {
+		words, err := Split(s, getenv, "/home/me")
+		if err != nil || !slices.Equal(words, expected) {
+			t.Errorf("expected %q to split into %q, got %q %v", s, expected, words, err)
+		}
+	}
+}
+
+func TestSplitErrors(t *testing.T) {
+	for s, expected := range map[string]error{
+		`dotnet "lsp.dll`: EUNTERMINATED,
+		`dotnet 'lsp.dll`: EUNTERMINATED,
+		`dotnet lsp.dll\`: ETRAILING,
+		`${ROSLYN`:        EBADVAR,
+		`${1X}`:           EBADVAR,
+	} {
+		if _, err := Split(s, getenv, ""); !errors.Is(err, expected) {
+			t.Errorf("expected %q to fail with %v, got %v", s, expected, err)
+		}
+	}
+}
+
+func TestSplitWithoutHome(t *testing.T) {
+	words, err := Split(`~/server`, getenv, "")
+	if err != nil || !slices.Equal(words, []string{"~/server"}) {
+		t.Fatalf("expected ~ to be kept without a home, got %q %v", words, err)
+	}
+}
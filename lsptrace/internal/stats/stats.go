@@ -0,0 +1,219 @@
+package stats
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/mparq/lsptrace/internal"
+	"io"
+	"math"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+// MessageCount is the number of messages seen for a method sent from
+// one side of the connection.
+type MessageCount struct {
+	Method   string
+	SentFrom string
+	Kind     string
+	Count    int
+}
+
+// Latency summarizes response times (ms) of requests for a method.
+type Latency struct {
+	Method string
+	Count  int
+	P50    float64
+	P90    float64
+	P99    float64
+	Max    float64
+}
+
+// ErrorCount is the number of error responses for a method with the
+// given jsonrpc error code.
+type ErrorCount struct {
+	Method string
+	Code   int64
+	Count  int
+}
+
+// Orphan is a request which never got a response in the trace.
+type Orphan struct {
+	Method    string
+	SentFrom  string
+	Id        string
+	Timestamp time.Time
+}
+
+type Report struct {
+	Total     int
+	Counts    []MessageCount
+	Latencies []Latency
+	Errors    []ErrorCount
+	Orphans   []Orphan
+}
+
+type countKey struct {
+	method, sentFrom, kind string
+}
+
+type errorKey struct {
+	method string
+	code   int64
+}
+
+// Compute builds a Report from traces in the order they were written.
+func Compute(traces []*internal.LSPTrace) *Report {
+	report := &Report{Total: len(traces)}
+	counts := make(map[countKey]int)
+	durations := make(map[string][]float64)
+	errCounts := make(map[errorKey]int)
+	pending := make(map[string]*internal.LSPTrace)
+	pendingOrder := make([]string, 0)
+
+	for _, trace := range traces {
+		method := methodOf(trace)
+		counts[countKey{method, trace.SentFrom, trace.MessageKind}]++
+		switch trace.MessageKind {
+		case internal.REQUEST:
+			if trace.Id == nil {
+				continue
+			}
+			key := trace.RequestKey()
+			if _, ok := pending[key]; !ok {
+				pendingOrder = append(pendingOrder, key)
+			}
+			pending[key] = trace
+		case internal.RESPONSE, internal.ERROR:
+			if trace.Id == nil {
+				continue
+			}
+			key := trace.RequestKey()
+			request, ok := pending[key]
+			delete(pending, key)
+			if ok && method == unknownMethod {
+				method = methodOf(request)
+			}
+			switch {
+			case trace.DurationMs != nil:
+				durations[method] = append(durations[method], *trace.DurationMs)
+			case ok:
+				durationMs := float64(trace.Timestamp.Sub(request.Timestamp).Microseconds()) / 1000
+				durations[method] = append(durations[method], durationMs)
+			}
+			if trace.MessageKind == internal.ERROR {
+				errCounts[errorKey{method, errorCode(trace.Message.Error)}]++
+			}
+		}
+	}
+
+	for key, count := range counts {
+		report.Counts = append(report.Counts, MessageCount{key.method, key.sentFrom, key.kind, count})
+	}
+	sort.Slice(report.Counts, func(i, j int) bool {
+		a, b := report.Counts[i], report.Counts[j]
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		if a.Method != b.Method {
+			return a.Method < b.Method
+		}
+		if a.SentFrom != b.SentFrom {
+			return a.SentFrom < b.SentFrom
+		}
+		return a.Kind < b.Kind
+	})
+
+	for method, ds := range durations {
+		sort.Float64s(ds)
+		report.Latencies = append(report.Latencies, Latency{
+			Method: method,
+			Count:  len(ds),
+			P50:    Percentile(ds, 50),
+			P90:    Percentile(ds, 90),
+			P99:    Percentile(ds, 99),
+			Max:    ds[len(ds)-1],
+		})
+	}
+	sort.Slice(report.Latencies, func(i, j int) bool {
+		return report.Latencies[i].Method < report.Latencies[j].Method
+	})
+
+	for key, count := range errCounts {
+		report.Errors = append(report.Errors, ErrorCount{key.method, key.code, count})
+	}
+	sort.Slice(report.Errors, func(i, j int) bool {
+		a, b := report.Errors[i], report.Errors[j]
+		if a.Method != b.Method {
+			return a.Method < b.Method
+		}
+		return a.Code < b.Code
+	})
+
+	for _, key := range pendingOrder {
+		request, ok := pending[key]
+		if !ok {
+			continue
+		}
+		report.Orphans = append(report.Orphans, Orphan{methodOf(request), request.SentFrom, request.Id.String(), request.Timestamp})
+	}
+	return report
+}
+
+// Percentile returns the p-th percentile of sorted values using the
+// nearest-rank method.
+func Percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// Write prints the report as aligned text tables.
+func (r *Report) Write(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "messages: %d\n\n", r.Total)
+
+	fmt.Fprintln(tw, "MESSAGES\tFROM\tKIND\tCOUNT")
+	for _, c := range r.Counts {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\n", c.Method, c.SentFrom, c.Kind, c.Count)
+	}
+
+	fmt.Fprintln(tw, "\nLATENCY (ms)\tCOUNT\tP50\tP90\tP99\tMAX")
+	for _, l := range r.Latencies {
+		fmt.Fprintf(tw, "%s\t%d\t%.1f\t%.1f\t%.1f\t%.1f\n", l.Method, l.Count, l.P50, l.P90, l.P99, l.Max)
+	}
+
+	fmt.Fprintln(tw, "\nERRORS\tCODE\tCOUNT")
+	for _, e := range r.Errors {
+		fmt.Fprintf(tw, "%s\t%d\t%d\n", e.Method, e.Code, e.Count)
+	}
+
+	fmt.Fprintln(tw, "\nORPHAN REQUESTS\tFROM\tID\tTIMESTAMP")
+	for _, o := range r.Orphans {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", o.Method, o.SentFrom, o.Id, o.Timestamp.Format(time.RFC3339Nano))
+	}
+	return tw.Flush()
+}
+
+const unknownMethod = "<unknown>"
+
+func methodOf(trace *internal.LSPTrace) string {
+	if trace.Method == nil || len(*trace.Method) == 0 {
+		return unknownMethod
+	}
+	return *trace.Method
+}
+
+func errorCode(rawError json.RawMessage) int64 {
+	var lspError struct {
+		Code int64 `json:"code"`
+	}
+	json.Unmarshal(rawError, &lspError)
+	return lspError.Code
+}
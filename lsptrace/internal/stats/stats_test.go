@@ -0,0 +1,94 @@
+package stats
+
+import (
+	"bytes"
+	"github.com/mparq/lsptrace/internal"
+	"strings"
+	"testing"
+)
+
+var traceFile = strings.Join([]string{
+	`{"msgKind":"request","from":"client","method":"textDocument/completion","id":1,"timestamp":"2024-11-28T12:01:45.000Z","msg":{"jsonrpc":"2.0","id":1,"method":"textDocument/completion"}}`,
+	`{"msgKind":"request","from":"server","method":"workspace/configuration","id":1,"timestamp":"2024-11-28T12:01:45.010Z","msg":{"jsonrpc":"2.0","id":1,"method":"workspace/configuration"}}`,
+	`{"msgKind":"response","from":"client","method":"workspace/configuration","id":1,"timestamp":"2024-11-28T12:01:45.015Z","msg":{"jsonrpc":"2.0","id":1,"result":[]}}`,
+	`{"msgKind":"response","from":"server","method":"textDocument/completion","id":1,"timestamp":"2024-11-28T12:01:45.100Z","msg":{"jsonrpc":"2.0","id":1,"result":[]}}`,
+	`{"msgKind":"request","from":"client","method":"textDocument/completion","id":"two","timestamp":"2024-11-28T12:01:46.000Z","msg":{"jsonrpc":"2.0","id":"two","method":"textDocument/completion"}}`,
+	`{"msgKind":"error","from":"server","method":"textDocument/completion","id":"two","timestamp":"2024-11-28T12:01:46.300Z","durationMs":300,"msg":{"jsonrpc":"2.0","id":"two","error":{"code":-32800,"message":"cancelled"}}}`,
+	`{"msgKind":"request","from":"client","method":"textDocument/hover","id":3,"timestamp":"2024-11-28T12:01:47.000Z","msg":{"jsonrpc":"2.0","id":3,"method":"textDocument/hover"}}`,
+	``,
+}, "\n")
+
+func TestCompute(t *testing.T) {
+	traces, err := internal.ReadTraces(strings.NewReader(traceFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	report := Compute(traces)
+	if report.Total != 7 {
+		t.Fatalf("expected 7 messages, got %d", report.Total)
+	}
+
+	latencies := make(map[string]Latency)
+	for _, l := range report.Latencies {
+		latencies[l.Method] = l
+	}
+	completion := latencies["textDocument/completion"]
+	if completion.Count != 2 || completion.P50 != 100 || completion.Max != 300 {
+		t.Fatalf("unexpected completion latency: %+v", completion)
+	}
+	if latencies["workspace/configuration"].Max != 5 {
+		t.Fatalf("unexpected configuration latency: %+v", latencies["workspace/configuration"])
+	}
+
+	if len(report.Errors) != 1 || report.Errors[0].Code != -32800 || report.Errors[0].Method != "textDocument/completion" {
+		t.Fatalf("unexpected errors: %+v", report.Errors)
+	}
+	if len(report.Orphans) != 1 || report.Orphans[0].Method != "textDocument/hover" {
+		t.Fatalf("unexpected orphans: %+v", report.Orphans)
+	}
+
+	out := new(bytes.Buffer)
+	if err := report.Write(out); err != nil {
+		t.Fatal(err)
+	}
+	t.Logf("report:\n%s", out)
+}
+
+func TestPercentile(t *testing.T) {
+	values := []float64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	if p := Percentile(values, 50); p != 5 {
+		t.Fatalf("expected p50 5, got %v", p)
+	}
+	if p := Percentile(values, 90); p != 9 {
+		t.Fatalf("expected p90 9, got %v", p)
+	}
+	if p := Percentile(values, 99); p != 10 {
+		t.Fatalf("expected p99 10, got %v", p)
+	}
+}
+
+// two daemon sessions which both start with request id 1
+var sessionsTraceFile = strings.Join([]string{
+	`{"msgKind":"request","from":"client","method":"textDocument/hover","id":1,"sessionId":"a","timestamp":"2024-11-28T12:01:45.000Z","msg":{"jsonrpc":"2.0","id":1,"method":"textDocument/hover"}}`,
+	`{"msgKind":"request","from":"client","method":"textDocument/completion","id":1,"sessionId":"b","timestamp":"2024-11-28T12:01:45.010Z","msg":{"jsonrpc":"2.0","id":1,"method":"textDocument/completion"}}`,
+	`{"msgKind":"response","from":"server","id":1,"sessionId":"b","timestamp":"2024-11-28T12:01:45.030Z","msg":{"jsonrpc":"2.0","id":1,"result":[]}}`,
+	`{"msgKind":"response","from":"server","id":1,"sessionId":"a","timestamp":"2024-11-28T12:01:45.100Z","msg":{"jsonrpc":"2.0","id":1,"result":null}}`,
+}, "\n")
+
+func TestComputeSessions(t *testing.T) {
+	traces, err := internal.ReadTraces(strings.NewReader(sessionsTraceFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	report := Compute(traces)
+	latencies := make(map[string]Latency)
+	for _, l := range report.Latencies {
+		latencies[l.Method] = l
+	}
+	if latencies["textDocument/hover"].Max != 100 || latencies["textDocument/completion"].Max != 20 {
+		t.Fatalf("expected responses to be paired within their session, got %+v", report.Latencies)
+	}
+	if len(report.Orphans) != 0 {
+		t.Fatalf("unexpected orphans: %+v", report.Orphans)
+	}
+}
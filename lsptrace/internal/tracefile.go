@@ -0,0 +1,89 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+var (
+	EMULTIPLESESSIONS = errors.New("trace file: traces of several sessions. pick one with --session_id")
+	ENOSESSION        = errors.New("trace file: no traces of the session")
+)
+
+// TraceReader reads LSPTrace entries from a trace file written by lsptrace
+// which has one json encoded LSPTrace per line.
+type TraceReader struct {
+	r    *bufio.Reader
+	line int
+}
+
+func NewTraceReader(r io.Reader) *TraceReader {
+	return &TraceReader{r: bufio.NewReader(r)}
+}
+
+// Next returns the next trace in the file. Blank lines are skipped.
+// io.EOF is returned once there are no more traces.
+func (r *TraceReader) Next() (*LSPTrace, error) {
+	for {
+		// NOTE: not using bufio.Scanner since a single trace line can be
+		// bigger than its max token size (e.g. didOpen of a big file)
+		line, err := r.r.ReadBytes('\n')
+		if len(line) > 0 {
+			r.line++
+		}
+		line = bytes.TrimSpace(line)
+		if len(line) > 0 {
+			trace := new(LSPTrace)
+			if jsonErr := json.Unmarshal(line, trace); jsonErr != nil {
+				return nil, errors.Join(fmt.Errorf("trace file: could not parse line %d", r.line), jsonErr)
+			}
+			return trace, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// ReadTraces reads all traces from r.
+func ReadTraces(r io.Reader) ([]*LSPTrace, error) {
+	traceReader := NewTraceReader(r)
+	traces := make([]*LSPTrace, 0)
+	for {
+		trace, err := traceReader.Next()
+		if err == io.EOF {
+			return traces, nil
+		}
+		if err != nil {
+			return traces, err
+		}
+		traces = append(traces, trace)
+	}
+}
+
+// SessionTraces keeps the traces of sessionId. With an empty sessionId the
+// traces are only returned if they are of a single session.
+func SessionTraces(traces []*LSPTrace, sessionId string) ([]*LSPTrace, error) {
+	if len(sessionId) == 0 {
+		for _, trace := range traces {
+			if trace.SessionId != traces[0].SessionId {
+				return nil, EMULTIPLESESSIONS
+			}
+		}
+		return traces, nil
+	}
+	kept := make([]*LSPTrace, 0)
+	for _, trace := range traces {
+		if trace.SessionId == sessionId {
+			kept = append(kept, trace)
+		}
+	}
+	if len(kept) == 0 {
+		return nil, ENOSESSION
+	}
+	return kept, nil
+}
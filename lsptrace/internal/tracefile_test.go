@@ -0,0 +1,48 @@
+package internal
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+var sessionsTrace = strings.Join([]string{
+	`{"msgKind":"request","from":"client","method":"textDocument/hover","id":1,"sessionId":"a","timestamp":"2024-11-28T12:01:45.000Z","msg":{"jsonrpc":"2.0","id":1,"method":"textDocument/hover"}}`,
+	`{"msgKind":"request","from":"client","method":"textDocument/completion","id":1,"sessionId":"b","timestamp":"2024-11-28T12:01:45.010Z","msg":{"jsonrpc":"2.0","id":1,"method":"textDocument/completion"}}`,
+	`{"msgKind":"response","from":"server","id":1,"sessionId":"b","timestamp":"2024-11-28T12:01:45.030Z","msg":{"jsonrpc":"2.0","id":1,"result":[]}}`,
+	`{"msgKind":"response","from":"server","id":1,"sessionId":"a","timestamp":"2024-11-28T12:01:45.100Z","msg":{"jsonrpc":"2.0","id":1,"result":null}}`,
+}, "\n")
+
+func TestRequestKey(t *testing.T) {
+	traces, err := ReadTraces(strings.NewReader(sessionsTrace))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if traces[0].RequestKey() != traces[3].RequestKey() || traces[1].RequestKey() != traces[2].RequestKey() {
+		t.Fatal("expected responses to have the key of the request of their session")
+	}
+	if traces[0].RequestKey() == traces[1].RequestKey() {
+		t.Fatal("expected requests with the same id in different sessions to have different keys")
+	}
+}
+
+func TestSessionTraces(t *testing.T) {
+	traces, err := ReadTraces(strings.NewReader(sessionsTrace))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := SessionTraces(traces, ""); !errors.Is(err, EMULTIPLESESSIONS) {
+		t.Fatalf("expected a trace with several sessions to need a session id, got %v", err)
+	}
+	if _, err := SessionTraces(traces, "c"); !errors.Is(err, ENOSESSION) {
+		t.Fatalf("expected an unknown session to fail, got %v", err)
+	}
+	session, err := SessionTraces(traces, "b")
+	if err != nil || len(session) != 2 || *session[0].Method != "textDocument/completion" {
+		t.Fatalf("expected the traces of session b, got %v %v", session, err)
+	}
+	single, err := SessionTraces(session, "")
+	if err != nil || len(single) != 2 {
+		t.Fatalf("expected a single session trace to be kept, got %v %v", single, err)
+	}
+}
@@ -0,0 +1,105 @@
+package view
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"net"
+	"sync"
+)
+
+const (
+	// trace lines a viewer may fall behind by before it is disconnected
+	VIEWER_BUFFER = 4096
+)
+
+// Broadcaster sends the trace lines written to it to every viewer connected
+// to a running lsptrace. Viewers only get the lines written after they
+// connected. A viewer which can't keep up is disconnected rather than
+// slowing down tracing.
+type Broadcaster struct {
+	mutex   sync.Mutex
+	viewers map[net.Conn]chan []byte
+	closed  bool
+}
+
+func NewBroadcaster() *Broadcaster {
+	return &Broadcaster{viewers: make(map[net.Conn]chan []byte)}
+}
+
+// Serve adds a viewer for every connection accepted on l until l is closed.
+func (b *Broadcaster) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		b.add(conn)
+	}
+}
+
+func (b *Broadcaster) add(conn net.Conn) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.closed {
+		conn.Close()
+		return
+	}
+	lines := make(chan []byte, VIEWER_BUFFER)
+	b.viewers[conn] = lines
+	log.Printf("view: viewer %s connected\n", conn.RemoteAddr())
+	go func() {
+		defer conn.Close()
+		for line := range lines {
+			if _, err := conn.Write(line); err != nil {
+				log.Printf("view: viewer %s disconnected: %s\n", conn.RemoteAddr(), err)
+				b.remove(conn)
+				return
+			}
+		}
+	}()
+}
+
+func (b *Broadcaster) remove(conn net.Conn) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if lines, ok := b.viewers[conn]; ok {
+		delete(b.viewers, conn)
+		close(lines)
+	}
+}
+
+// Write sends p, which is expected to be whole trace lines, to every
+// viewer. It never fails so it can be used in an io.MultiWriter.
+func (b *Broadcaster) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if len(b.viewers) == 0 {
+		return len(p), nil
+	}
+	line := bytes.Clone(p)
+	for conn, lines := range b.viewers {
+		select {
+		case lines <- line:
+		default:
+			log.Printf("view: viewer %s fell behind. disconnecting it\n", conn.RemoteAddr())
+			delete(b.viewers, conn)
+			close(lines)
+		}
+	}
+	return len(p), nil
+}
+
+// Close disconnects every viewer once the lines sent to it are written.
+func (b *Broadcaster) Close() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.closed = true
+	for conn, lines := range b.viewers {
+		delete(b.viewers, conn)
+		close(lines)
+	}
+}
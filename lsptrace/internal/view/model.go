@@ -0,0 +1,365 @@
+package view
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/mparq/lsptrace/internal"
+	"regexp"
+	"strings"
+)
+
+const (
+	// rows of the screen used for the detail pane
+	DETAIL_RATIO = 0.5
+)
+
+// Entry is a trace shown in the viewer.
+type Entry struct {
+	// position of the trace in the trace file
+	Index int
+	Trace *internal.LSPTrace
+	// index of the matching request/response entry or -1
+	Pair int
+}
+
+// Model holds the state of the viewer: all entries seen so far, the active
+// filters and the selected entry. It has no knowledge of the terminal.
+type Model struct {
+	entries []*Entry
+	// side+id of requests which haven't been responded to -> entry index
+	pending map[string]int
+	// entries which pass the filters
+	visible []int
+
+	// glob (or substring if there are no glob characters) matched against the method
+	methodFilter string
+	// methodFilter compiled if it is a glob
+	methodGlob *regexp.Regexp
+	// 'client' | 'server' | '' for both
+	fromFilter string
+
+	// position in visible
+	selected int
+	// first line of the detail pane shown
+	detailOffset int
+	// keep the last entry selected as new entries arrive
+	Follow bool
+}
+
+func NewModel() *Model {
+	return &Model{entries: make([]*Entry, 0), pending: make(map[string]int), visible: make([]int, 0), Follow: true}
+}
+
+// Add appends a trace and pairs it with its request or response.
+func (m *Model) Add(trace *internal.LSPTrace) {
+	entry := &Entry{Index: len(m.entries), Trace: trace, Pair: -1}
+	m.entries = append(m.entries, entry)
+	if trace.Id != nil {
+		switch trace.MessageKind {
+		case internal.REQUEST:
+			m.pending[trace.RequestKey()] = entry.Index
+		case internal.RESPONSE, internal.ERROR:
+			key := trace.RequestKey()
+			if request, ok := m.pending[key]; ok {
+				delete(m.pending, key)
+				entry.Pair = request
+				m.entries[request].Pair = entry.Index
+			}
+		}
+	}
+	if m.matches(entry) {
+		m.visible = append(m.visible, entry.Index)
+		if m.Follow {
+			m.selected = len(m.visible) - 1
+			m.detailOffset = 0
+		}
+	}
+}
+
+func (m *Model) matches(entry *Entry) bool {
+	if len(m.fromFilter) > 0 && entry.Trace.SentFrom != m.fromFilter {
+		return false
+	}
+	if len(m.methodFilter) == 0 {
+		return true
+	}
+	method := ""
+	if entry.Trace.Method != nil {
+		method = *entry.Trace.Method
+	}
+	if m.methodGlob != nil {
+		return m.methodGlob.MatchString(method)
+	}
+	return strings.Contains(method, m.methodFilter)
+}
+
+// SetFilters changes the filters keeping the selected entry selected if
+// it is still visible.
+func (m *Model) SetFilters(methodFilter, fromFilter string) {
+	selected := m.Selected()
+	m.methodFilter, m.fromFilter = methodFilter, fromFilter
+	// same globs as --include_methods and --exclude_methods
+	m.methodGlob = nil
+	if strings.ContainsAny(methodFilter, "*?") {
+		m.methodGlob = internal.CompileGlob(methodFilter)
+	}
+	m.visible = make([]int, 0)
+	m.selected = 0
+	for _, entry := range m.entries {
+		if m.matches(entry) {
+			if selected != nil && entry.Index <= selected.Index {
+				m.selected = len(m.visible)
+			}
+			m.visible = append(m.visible, entry.Index)
+		}
+	}
+	m.clamp()
+}
+
+func (m *Model) MethodFilter() string {
+	return m.methodFilter
+}
+
+func (m *Model) FromFilter() string {
+	return m.fromFilter
+}
+
+// Visible returns the entries which pass the filters.
+func (m *Model) Visible() []*Entry {
+	visible := make([]*Entry, len(m.visible))
+	for i, index := range m.visible {
+		visible[i] = m.entries[index]
+	}
+	return visible
+}
+
+// Selected returns the selected entry or nil if nothing is visible.
+func (m *Model) Selected() *Entry {
+	if len(m.visible) == 0 {
+		return nil
+	}
+	return m.entries[m.visible[m.selected]]
+}
+
+// Move changes the selection by delta visible entries. Moving to the
+// last entry turns on follow mode, moving away from it turns it off.
+func (m *Model) Move(delta int) {
+	m.selected += delta
+	m.clamp()
+	m.Follow = m.selected == len(m.visible)-1
+}
+
+// JumpToPair selects the matching request/response of the selected entry.
+// Filters are cleared if the pair is not visible.
+func (m *Model) JumpToPair() {
+	selected := m.Selected()
+	if selected == nil || selected.Pair < 0 {
+		return
+	}
+	if !m.matches(m.entries[selected.Pair]) {
+		m.SetFilters("", "")
+	}
+	m.detailOffset = 0
+	for i, index := range m.visible {
+		if index == selected.Pair {
+			m.selected = i
+		}
+	}
+	m.Follow = m.selected == len(m.visible)-1
+}
+
+// ScrollDetail scrolls the detail pane by delta lines.
+func (m *Model) ScrollDetail(delta int) {
+	m.detailOffset += delta
+	if m.detailOffset < 0 {
+		m.detailOffset = 0
+	}
+}
+
+func (m *Model) clamp() {
+	m.detailOffset = 0
+	if m.selected >= len(m.visible) {
+		m.selected = len(m.visible) - 1
+	}
+	if m.selected < 0 {
+		m.selected = 0
+	}
+}
+
+// Render draws the message list, the detail pane of the selected entry
+// and a status line into height lines of at most width characters.
+func (m *Model) Render(width, height int) []string {
+	lines := make([]string, 0, height)
+	detailHeight := int(float64(height) * DETAIL_RATIO)
+	listHeight := height - detailHeight - 1
+	if listHeight < 1 {
+		listHeight = 1
+	}
+
+	// scroll so that the selected entry is in view
+	start := 0
+	if m.selected >= listHeight {
+		start = m.selected - listHeight + 1
+	}
+	for i := start; i < start+listHeight; i++ {
+		if i >= len(m.visible) {
+			lines = append(lines, "")
+			continue
+		}
+		row := fit(FormatRow(m.entries[m.visible[i]]), width)
+		if i == m.selected {
+			// reverse video
+			row = "\x1b[7m" + row + "\x1b[0m"
+		}
+		lines = append(lines, row)
+	}
+
+	follow := ""
+	if m.Follow {
+		follow = " [follow]"
+	}
+	from := m.fromFilter
+	if len(from) == 0 {
+		from = "all"
+	}
+	status := fmt.Sprintf("-- %d/%d messages | method:%q from:%s%s | j/k move  J/K scroll  p pair  / method  f from  G end  q quit",
+		len(m.visible), len(m.entries), m.methodFilter, from, follow)
+	lines = append(lines, "\x1b[1m"+fit(status, width)+"\x1b[0m")
+
+	detail := make([]string, 0)
+	if selected := m.Selected(); selected != nil {
+		detail = Detail(selected)
+	}
+	if m.detailOffset >= len(detail) {
+		m.detailOffset = max(len(detail)-1, 0)
+	}
+	detail = detail[m.detailOffset:]
+	for i := 0; i < detailHeight; i++ {
+		if i < len(detail) {
+			lines = append(lines, fit(detail[i], width))
+		} else {
+			lines = append(lines, "")
+		}
+	}
+	return lines
+}
+
+// FormatRow is the one line summary of an entry in the message list.
+func FormatRow(entry *Entry) string {
+	trace := entry.Trace
+	arrow := "->"
+	if trace.SentFrom == "server" {
+		arrow = "<-"
+	}
+	method := ""
+	if trace.Method != nil {
+		method = *trace.Method
+	}
+	if trace.ProtocolError != nil {
+		method = trace.ProtocolError.Reason
+	}
+	if len(trace.ParseError) > 0 {
+		method = trace.ParseError
+	}
+	if trace.DroppedMessages > 0 {
+		method = fmt.Sprintf("dropped %d messages", trace.DroppedMessages)
+	}
+	if trace.MessageKind == internal.STDERR {
+		method = trace.Line
+	}
+	if trace.Exit != nil {
+		method = exitSummary(trace.Exit)
+	}
+	id := ""
+	if trace.Id != nil {
+		id = "id=" + trace.Id.String()
+	}
+	latency := ""
+	if trace.DurationMs != nil {
+		latency = fmt.Sprintf("%.1fms", *trace.DurationMs)
+	}
+	return fmt.Sprintf("%6d %s %-6s %-12s %-40s %-10s %s",
+		entry.Index+1, arrow, trace.SentFrom, trace.MessageKind, method, id, latency)
+}
+
+// Detail is the pretty printed message of an entry.
+func Detail(entry *Entry) []string {
+	trace := entry.Trace
+	header := fmt.Sprintf("#%d %s %s %s", entry.Index+1, trace.SentFrom, trace.MessageKind, trace.Timestamp.Format("15:04:05.000000"))
+	if entry.Pair >= 0 {
+		header += fmt.Sprintf("  (pair: #%d)", entry.Pair+1)
+	}
+	if trace.BatchId > 0 {
+		header += fmt.Sprintf("  (batch: %d)", trace.BatchId)
+	}
+	if trace.Injected {
+		header += "  (sent by lsptrace)"
+	}
+	if len(trace.RawBody) > 0 {
+		// raw bodies aren't necessarily json
+		lines := []string{header}
+		if len(trace.ParseError) > 0 {
+			lines = append(lines, "parse error: "+trace.ParseError)
+		}
+		return append(lines, strings.Split(trace.RawBody, "\n")...)
+	}
+	if trace.MessageKind == internal.STDERR {
+		return []string{header, trace.Line}
+	}
+	if trace.Exit != nil {
+		return []string{header, exitSummary(trace.Exit)}
+	}
+	if trace.DroppedMessages > 0 {
+		return []string{header, fmt.Sprintf("about %d messages were not traced because the tracer fell behind", trace.DroppedMessages)}
+	}
+	var msg []byte
+	var err error
+	if trace.ProtocolError != nil {
+		msg, err = json.Marshal(trace.ProtocolError)
+	} else {
+		msg, err = json.Marshal(trace.Message)
+	}
+	if err != nil {
+		return []string{header, err.Error()}
+	}
+	pretty := new(bytes.Buffer)
+	if err := json.Indent(pretty, msg, "", "  "); err != nil {
+		return []string{header, string(msg)}
+	}
+	return append([]string{header}, strings.Split(pretty.String(), "\n")...)
+}
+
+func exitSummary(exit *internal.ServerExit) string {
+	summary := fmt.Sprintf("exited with code %d", exit.Code)
+	if len(exit.Signal) > 0 {
+		summary = "killed by " + exit.Signal
+	}
+	if exit.Crashed {
+		summary += " before shutdown"
+	}
+	return summary
+}
+
+// fit pads or truncates s to exactly width runes. Control characters,
+// which a trace can contain in stderr lines or raw bodies, are escaped so
+// that they can't move the cursor or change the terminal.
+func fit(s string, width int) string {
+	var sb strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '\t':
+			sb.WriteString("  ")
+		case r < 0x20 || (r >= 0x7f && r <= 0x9f):
+			fmt.Fprintf(&sb, "\\x%02x", r)
+		default:
+			sb.WriteRune(r)
+		}
+	}
+	s = sb.String()
+	runes := []rune(s)
+	if len(runes) > width {
+		return string(runes[:width])
+	}
+	return s + strings.Repeat(" ", width-len(runes))
+}
@@ -0,0 +1,193 @@
+package view
+
+import (
+	"bytes"
+	"github.com/mparq/lsptrace/internal"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+var viewTrace = strings.Join([]string{
+	`{"msgKind":"request","from":"client","method":"textDocument/hover","id":1,"timestamp":"2024-11-28T12:01:45.000Z","msg":{"jsonrpc":"2.0","id":1,"method":"textDocument/hover","params":{}}}`,
+	`{"msgKind":"notification","from":"server","method":"window/logMessage","timestamp":"2024-11-28T12:01:45.010Z","msg":{"jsonrpc":"2.0","method":"window/logMessage","params":{}}}`,
+	`{"msgKind":"response","from":"server","method":"textDocument/hover","id":1,"timestamp":"2024-11-28T12:01:45.100Z","durationMs":100,"msg":{"jsonrpc":"2.0","id":1,"result":null}}`,
+	`{"msgKind":"notification","from":"server","method":"$/progress","timestamp":"2024-11-28T12:01:45.200Z","msg":{"jsonrpc":"2.0","method":"$/progress","params":{}}}`,
+}, "\n")
+
+func loadModel(t *testing.T) *Model {
+	traces, err := internal.ReadTraces(strings.NewReader(viewTrace))
+	if err != nil {
+		t.Fatal(err)
+	}
+	model := NewModel()
+	for _, trace := range traces {
+		model.Add(trace)
+	}
+	return model
+}
+
+func TestModelPairsAndFilters(t *testing.T) {
+	model := loadModel(t)
+	if model.Selected().Index != 3 {
+		t.Fatal("expected follow mode to select the last entry")
+	}
+	model.SetFilters("textDocument/*", "")
+	if len(model.Visible()) != 2 {
+		t.Fatalf("expected 2 textDocument messages, got %d", len(model.Visible()))
+	}
+	model.Move(-1)
+	if model.Selected().Index != 0 || model.Selected().Pair != 2 {
+		t.Fatalf("expected the hover request to be selected and paired, got %+v", model.Selected())
+	}
+	model.SetFilters("hover", "client")
+	model.JumpToPair()
+	if model.Selected().Index != 2 {
+		t.Fatalf("expected to jump to the hover response, got %+v", model.Selected())
+	}
+	if model.MethodFilter() != "" {
+		t.Fatal("expected filters to be cleared when the pair isn't visible")
+	}
+	if !strings.Contains(FormatRow(model.Selected()), "100.0ms") {
+		t.Fatalf("expected latency in row: %s", FormatRow(model.Selected()))
+	}
+	lines := model.Render(120, 20)
+	if len(lines) != 20 {
+		t.Fatalf("expected render to fill the screen, got %d lines", len(lines))
+	}
+}
+
+func TestModelMethodGlob(t *testing.T) {
+	model := loadModel(t)
+	// globs are the ones of --include_methods, '[' is not special
+	model.SetFilters("*/*o*", "")
+	if len(model.Visible()) != 4 {
+		t.Fatalf("expected the glob to match every method, got %d", len(model.Visible()))
+	}
+	model.SetFilters("textDocument/hove?", "")
+	if len(model.Visible()) != 2 {
+		t.Fatalf("expected the hover request and response, got %d", len(model.Visible()))
+	}
+	model.SetFilters("$/[", "")
+	if len(model.Visible()) != 0 {
+		t.Fatalf("expected a substring without matches, got %d", len(model.Visible()))
+	}
+}
+
+func TestFitEscapesControlCharacters(t *testing.T) {
+	if fitted := fit("a\x1b[2Jb\tc\r\u009b", 16); fitted != "a\\x1b[2Jb  c\\x0d" {
+		t.Fatalf("expected control characters to be escaped and truncated, got %q", fitted)
+	}
+	if fitted := fit("\x07é", 8); fitted != "\\x07é   " {
+		t.Fatalf("expected control characters to count as escaped, got %q", fitted)
+	}
+}
+
+func TestTailPartialLines(t *testing.T) {
+	r, w := io.Pipe()
+	out := make(chan *internal.LSPTrace)
+	stop := make(chan struct{})
+	defer close(stop)
+	go Tail(r, out, stop)
+
+	lines := strings.Split(viewTrace, "\n")
+	half := len(lines[0]) / 2
+	go func() {
+		io.WriteString(w, lines[0][:half])
+		time.Sleep(10 * time.Millisecond)
+		io.WriteString(w, lines[0][half:]+"\n"+lines[1]+"\n")
+	}()
+	for i := 0; i < 2; i++ {
+		select {
+		case trace := <-out:
+			if *trace.Method != []string{"textDocument/hover", "window/logMessage"}[i] {
+				t.Fatalf("unexpected trace %s", trace)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected tail to emit complete lines")
+		}
+	}
+}
+
+func TestUIQuit(t *testing.T) {
+	model := loadModel(t)
+	out := new(bytes.Buffer)
+	keys := make(chan string)
+	go ReadKeys(strings.NewReader("kk/hover\rpq"), keys)
+	NewUI(model, out, func() (int, int) { return 100, 20 }).Run(nil, keys)
+	if model.Selected().Index != 2 {
+		t.Fatalf("expected keys to select the hover response, got %+v", model.Selected())
+	}
+}
+
+func TestBroadcast(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	b := NewBroadcaster()
+	go b.Serve(l)
+	b.Write([]byte("not seen by viewers which connect later\n"))
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		b.mutex.Lock()
+		connected := len(b.viewers) == 1
+		b.mutex.Unlock()
+		if connected {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the viewer to connect")
+		}
+	}
+	for _, line := range strings.Split(viewTrace, "\n") {
+		b.Write([]byte(line + "\n"))
+	}
+	b.Close()
+
+	out := make(chan *internal.LSPTrace, 4)
+	stop := make(chan struct{})
+	defer close(stop)
+	go Tail(conn, out, stop)
+	for i := 0; i < 4; i++ {
+		select {
+		case trace := <-out:
+			if trace.Timestamp.IsZero() {
+				t.Fatalf("unexpected trace %s", trace)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected every line written after the viewer connected, got %d", i)
+		}
+	}
+}
+
+func TestModelPairsWithinSessions(t *testing.T) {
+	traces, err := internal.ReadTraces(strings.NewReader(strings.Join([]string{
+		`{"msgKind":"request","from":"client","method":"textDocument/hover","id":1,"sessionId":"a","timestamp":"2024-11-28T12:01:45.000Z","msg":{"jsonrpc":"2.0","id":1,"method":"textDocument/hover"}}`,
+		`{"msgKind":"request","from":"client","method":"textDocument/completion","id":1,"sessionId":"b","timestamp":"2024-11-28T12:01:45.010Z","msg":{"jsonrpc":"2.0","id":1,"method":"textDocument/completion"}}`,
+		`{"msgKind":"response","from":"server","method":"textDocument/completion","id":1,"sessionId":"b","timestamp":"2024-11-28T12:01:45.030Z","msg":{"jsonrpc":"2.0","id":1,"result":[]}}`,
+		`{"msgKind":"response","from":"server","method":"textDocument/hover","id":1,"sessionId":"a","timestamp":"2024-11-28T12:01:45.100Z","msg":{"jsonrpc":"2.0","id":1,"result":null}}`,
+	}, "\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	model := NewModel()
+	for _, trace := range traces {
+		model.Add(trace)
+	}
+	model.Move(-3)
+	if model.Selected().Index != 0 || model.Selected().Pair != 3 {
+		t.Fatalf("expected the hover request to be paired with the response of its session, got %+v", model.Selected())
+	}
+	model.Move(1)
+	if model.Selected().Index != 1 || model.Selected().Pair != 2 {
+		t.Fatalf("expected the completion request to be paired with the response of its session, got %+v", model.Selected())
+	}
+}
@@ -0,0 +1,59 @@
+package view
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/mparq/lsptrace/internal"
+	"io"
+	"log"
+	"time"
+)
+
+const (
+	// how often the trace file is checked for new lines once its end is reached
+	TAIL_POLL_INTERVAL = 250 * time.Millisecond
+)
+
+// Tail sends every trace in r to out. Once the end of r is reached it keeps
+// polling for lines appended by a running lsptrace until stop is closed.
+// Partial lines are held back until they are complete.
+func Tail(r io.Reader, out chan<- *internal.LSPTrace, stop <-chan struct{}) error {
+	buf := make([]byte, 64*1024)
+	pending := new(bytes.Buffer)
+	for {
+		nr, err := r.Read(buf)
+		if nr > 0 {
+			pending.Write(buf[:nr])
+			for {
+				nl := bytes.IndexByte(pending.Bytes(), '\n')
+				if nl < 0 {
+					break
+				}
+				line := bytes.TrimSpace(pending.Next(nl + 1))
+				if len(line) == 0 {
+					continue
+				}
+				trace := new(internal.LSPTrace)
+				if err := json.Unmarshal(line, trace); err != nil {
+					log.Printf("view: skipping unparseable trace line: %s\n", err)
+					continue
+				}
+				select {
+				case out <- trace:
+				case <-stop:
+					return nil
+				}
+			}
+		}
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if err == io.EOF || nr == 0 {
+			select {
+			case <-stop:
+				return nil
+			case <-time.After(TAIL_POLL_INTERVAL):
+			}
+		}
+	}
+}
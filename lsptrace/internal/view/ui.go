@@ -0,0 +1,209 @@
+package view
+
+import (
+	"bufio"
+	"github.com/mparq/lsptrace/internal"
+	"io"
+	"strings"
+	"time"
+)
+
+const (
+	KEY_UP        = "up"
+	KEY_DOWN      = "down"
+	KEY_PAGEUP    = "pgup"
+	KEY_PAGEDOWN  = "pgdn"
+	KEY_ENTER     = "enter"
+	KEY_ESCAPE    = "esc"
+	KEY_BACKSPACE = "backspace"
+	KEY_CTRL_C    = "ctrl-c"
+
+	// how often the terminal size is checked
+	RESIZE_POLL_INTERVAL = time.Second
+)
+
+// ReadKeys decodes key presses from a terminal in raw mode and sends them to
+// out. Printable keys are sent as themselves, other keys as KEY_* names.
+func ReadKeys(in io.Reader, out chan<- string) {
+	defer close(out)
+	r := bufio.NewReader(in)
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return
+		}
+		switch b {
+		case 3:
+			out <- KEY_CTRL_C
+		case '\r', '\n':
+			out <- KEY_ENTER
+		case 127, 8:
+			out <- KEY_BACKSPACE
+		case 27:
+			// escape sequences arrive in the same read as the escape key
+			if r.Buffered() == 0 {
+				out <- KEY_ESCAPE
+				continue
+			}
+			seq := make([]byte, 0, 4)
+			for r.Buffered() > 0 && len(seq) < 4 {
+				c, _ := r.ReadByte()
+				seq = append(seq, c)
+				if c >= 'A' && c <= 'Z' || c == '~' {
+					break
+				}
+			}
+			switch string(seq) {
+			case "[A", "OA":
+				out <- KEY_UP
+			case "[B", "OB":
+				out <- KEY_DOWN
+			case "[5~":
+				out <- KEY_PAGEUP
+			case "[6~":
+				out <- KEY_PAGEDOWN
+			}
+		default:
+			out <- string(b)
+		}
+	}
+}
+
+// UI draws a Model to a terminal and applies key presses to it.
+type UI struct {
+	model *Model
+	out   io.Writer
+	// returns the terminal width and height
+	size func() (int, int)
+
+	// text typed for the method filter while prompting
+	prompt    string
+	prompting bool
+}
+
+func NewUI(model *Model, out io.Writer, size func() (int, int)) *UI {
+	return &UI{model: model, out: out, size: size}
+}
+
+// Run redraws the screen as traces and keys arrive until q or ctrl-c is pressed
+// or keys is closed.
+func (ui *UI) Run(traces <-chan *internal.LSPTrace, keys <-chan string) {
+	// alternate screen and hidden cursor
+	io.WriteString(ui.out, "\x1b[?1049h\x1b[?25l")
+	defer io.WriteString(ui.out, "\x1b[?25h\x1b[?1049l")
+	width, height := ui.size()
+	ui.draw(width, height)
+	resize := time.NewTicker(RESIZE_POLL_INTERVAL)
+	defer resize.Stop()
+	for {
+		select {
+		case trace, ok := <-traces:
+			if !ok {
+				traces = nil
+				continue
+			}
+			ui.model.Add(trace)
+			// drain what is already available before redrawing
+			for more := true; more; {
+				select {
+				case trace, ok = <-traces:
+					if ok {
+						ui.model.Add(trace)
+					}
+					more = ok
+				default:
+					more = false
+				}
+			}
+		case key, ok := <-keys:
+			if !ok || !ui.handleKey(key, height) {
+				return
+			}
+		case <-resize.C:
+			w, h := ui.size()
+			if w == width && h == height {
+				continue
+			}
+			width, height = w, h
+		}
+		ui.draw(width, height)
+	}
+}
+
+// handleKey applies a key press. Returns false if the viewer should quit.
+func (ui *UI) handleKey(key string, height int) bool {
+	if ui.prompting {
+		switch key {
+		case KEY_ENTER:
+			ui.prompting = false
+			ui.model.SetFilters(ui.prompt, ui.model.FromFilter())
+		case KEY_ESCAPE:
+			ui.prompting = false
+		case KEY_BACKSPACE:
+			if len(ui.prompt) > 0 {
+				ui.prompt = ui.prompt[:len(ui.prompt)-1]
+			}
+		case KEY_CTRL_C:
+			return false
+		default:
+			if len(key) == 1 {
+				ui.prompt += key
+			}
+		}
+		return true
+	}
+	page := max(height/2, 1)
+	switch key {
+	case "q", KEY_CTRL_C:
+		return false
+	case "j", KEY_DOWN:
+		ui.model.Move(1)
+	case "k", KEY_UP:
+		ui.model.Move(-1)
+	case KEY_PAGEDOWN, "d":
+		ui.model.Move(page)
+	case KEY_PAGEUP, "u":
+		ui.model.Move(-page)
+	case "g":
+		ui.model.Move(-len(ui.model.visible))
+	case "G":
+		ui.model.Move(len(ui.model.visible))
+	case "J":
+		ui.model.ScrollDetail(1)
+	case "K":
+		ui.model.ScrollDetail(-1)
+	case "p":
+		ui.model.JumpToPair()
+	case "/":
+		ui.prompting = true
+		ui.prompt = ui.model.MethodFilter()
+	case "f":
+		switch ui.model.FromFilter() {
+		case "":
+			ui.model.SetFilters(ui.model.MethodFilter(), "client")
+		case "client":
+			ui.model.SetFilters(ui.model.MethodFilter(), "server")
+		default:
+			ui.model.SetFilters(ui.model.MethodFilter(), "")
+		}
+	}
+	return true
+}
+
+func (ui *UI) draw(width, height int) {
+	lines := ui.model.Render(width, height)
+	if ui.prompting && len(lines) > 0 {
+		// show the prompt in place of the last line
+		lines[len(lines)-1] = fit("method filter (glob): "+ui.prompt, width)
+	}
+	var sb strings.Builder
+	sb.WriteString("\x1b[H")
+	for i, line := range lines {
+		sb.WriteString(line)
+		sb.WriteString("\x1b[K")
+		if i < len(lines)-1 {
+			sb.WriteString("\r\n")
+		}
+	}
+	io.WriteString(ui.out, sb.String())
+}
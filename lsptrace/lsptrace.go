@@ -2,11 +2,19 @@ package main
 
 import (
 	"bufio"
+	"cmp"
 	"encoding/json"
 	"errors"
 	"flag"
+	"fmt"
 	"github.com/mparq/lsptrace/internal"
+	"github.com/mparq/lsptrace/internal/config"
+	"github.com/mparq/lsptrace/internal/outpath"
 	"github.com/mparq/lsptrace/internal/pipeline"
+	"github.com/mparq/lsptrace/internal/redact"
+	"github.com/mparq/lsptrace/internal/rotate"
+	"github.com/mparq/lsptrace/internal/shellwords"
+	"github.com/mparq/lsptrace/internal/view"
 	"io"
 	"log"
 	"net"
@@ -15,52 +23,161 @@ import (
 	"os/signal"
 	"os/user"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
 )
 
 const (
+	// how long to keep reading the server's stderr after its stdout closed
+	STDERR_CLOSE_TIMEOUT = 5 * time.Second
+
 	HELP_MESSAGE = `
 Usage:
   $ ./lsptrace [command] [...command-args]
 
+  $ ./lsptrace stats <trace-file>    Summarize an existing trace file.
+  $ ./lsptrace replay [flags] <trace-file> <language-server-exe> [...args]
+                                     Replay the client side of a trace against a language server.
+  $ ./lsptrace serve-trace [flags] <trace-file>
+                                     Act as a language server answering from a recorded trace.
+  $ ./lsptrace diff [flags] <a-trace-file> <b-trace-file>
+                                     Compare the messages of two trace files.
+  $ ./lsptrace view [flags] <trace-file>
+  $ ./lsptrace view [flags] --connect <endpoint>
+                                     Browse a trace file or a running lsptrace in the terminal as it is written.
+  $ ./lsptrace redact [flags] <trace-file> [output-file]
+                                     Redact an existing trace file for sharing.
+  $ ./lsptrace daemon [flags] --listen <endpoint> <language-server-exe> [...args]
+                                     Trace several client sessions through one lsptrace.
+
   $ ./lsptrace -h      Display this help message.
 `
 )
 
+// subcommands are lsptrace tools which don't proxy a language server.
+// They are checked for even when LSPTRACE_LANGUAGE_SERVER_CMD or _ARGV is
+// set, an arg for the server with a subcommand's name goes after '--'.
+var subcommands = map[string]func(args []string) error{
+	"stats":       runStats,
+	"replay":      runReplay,
+	"serve-trace": runServeTrace,
+	"diff":        runDiff,
+	"view":        runView,
+	"redact":      runRedact,
+	"daemon":      runDaemon,
+}
+
 var (
 	// Output file which the program will write lsp traces to
-	// while processing lsp communication
+	// while processing lsp communication. Output paths may contain the
+	// placeholders {server}, {date}, {time}, {pid}, {cwd} and {session} e.g.
+	// '~/.lsptrace/{server}-{session}.lsptrace'. a 'latest' symlink next to a
+	// templated trace output points at the newest trace
 	TRACE_OUTPUT = os.Getenv("LSPTRACE_TRACE_OUTPUT")
+	// The trace output is rotated once it is bigger than LSPTRACE_TRACE_MAX_SIZE
+	// (e.g. '100M') or older than LSPTRACE_TRACE_MAX_AGE (e.g. '24h'). Rotated
+	// segments are kept next to it up to LSPTRACE_TRACE_MAX_FILES and gzipped if
+	// LSPTRACE_TRACE_COMPRESS is set. With rotation a previous trace is kept as a
+	// segment instead of being overwritten.
+	TRACE_MAX_SIZE     = os.Getenv("LSPTRACE_TRACE_MAX_SIZE")
+	TRACE_MAX_AGE, _   = time.ParseDuration(cmp.Or(os.Getenv("LSPTRACE_TRACE_MAX_AGE"), "0s"))
+	TRACE_MAX_FILES, _ = strconv.Atoi(cmp.Or(os.Getenv("LSPTRACE_TRACE_MAX_FILES"), "0"))
+	TRACE_COMPRESS, _  = strconv.ParseBool(cmp.Or(os.Getenv("LSPTRACE_TRACE_COMPRESS"), "false"))
 	// Output file for debug logs. Due to the nature of the program
 	// stdout is not usable for logging.
 	DEBUG_OUTPUT = os.Getenv("LSPTRACE_DEBUG_OUTPUT")
+	// Optional output file which the raw byte streams in both directions
+	// will be recorded to before any parsing, for reproducing parser issues.
+	CAPTURE_OUTPUT = os.Getenv("LSPTRACE_CAPTURE_OUTPUT")
+	// Optional output file which the language server's stderr is copied to.
+	// stderr is always traced line by line and passed on to lsptrace's stderr.
+	STDERR_OUTPUT = os.Getenv("LSPTRACE_STDERR_OUTPUT")
+	// Comma-separated glob patterns of lsp methods to write to the trace
+	// e.g. 'textDocument/*'. If empty all methods are included.
+	INCLUDE_METHODS = os.Getenv("LSPTRACE_INCLUDE_METHODS")
+	// Comma-separated glob patterns of lsp methods to leave out of the trace
+	// e.g. '$/progress,window/logMessage'. Responses follow their request.
+	EXCLUDE_METHODS = os.Getenv("LSPTRACE_EXCLUDE_METHODS")
+	// Comma-separated redaction rules applied before traces are written
+	// e.g. 'textDocument/didOpen:params.textDocument.text=hash' or 'defaults'
+	REDACT = os.Getenv("LSPTRACE_REDACT")
+	// file:// uris under this directory are rewritten to file:///$ROOT/...
+	REDACT_URI_ROOT = os.Getenv("LSPTRACE_REDACT_URI_ROOT")
 	// Command to run the language server e.g. `dotnet <roslyndllpath>``.
 	// If this is not set, the program will assume its first argument is the
-	// command to run. If the cmd is space-separated then it will be split
-	// and the first part will be used as command in exec.Command and the
-	// other parts will be pre-pended to the args passed to lsptrace
-	// IMPORTANT: If LSPTRACE_LANGUAGE_SERVER_CMD is set then lsptrace will
-	// ignore parsing command line flags, because the caller of the command
-	// may expect to pass flags directly to the exe. in this case, all
-	// lsptrace configuration should be set through environment vars
-	LANGUAGE_SERVER_CMD = os.Getenv("LSPTRACE_LANGUAGE_SERVER_CMD")
+	// command to run. The cmd is split into words like a shell would, with
+	// quotes, backslash escapes, ~ and $VAR expansion, and the first word
+	// will be used as command in exec.Command and the other words will be
+	// pre-pended to the args passed to lsptrace.
+	// LSPTRACE_LANGUAGE_SERVER_ARGV can be set instead to a json array of
+	// the exact command and args e.g. `["dotnet", "/path with spaces/x.dll"]`
+	// IMPORTANT: If either is set then the caller of the command may expect
+	// to pass flags directly to the exe. lsptrace's own flags are still
+	// parsed wherever they are, and every other arg as well as every arg
+	// after '--' is passed on to the exe
+	LANGUAGE_SERVER_CMD  = os.Getenv("LSPTRACE_LANGUAGE_SERVER_CMD")
+	LANGUAGE_SERVER_ARGV = os.Getenv("LSPTRACE_LANGUAGE_SERVER_ARGV")
+	// Environment variables to set for the language server on top of
+	// lsptrace's own, split like LSPTRACE_LANGUAGE_SERVER_CMD
+	// e.g. `DOTNET_ROOT=~/.dotnet LOG_DIR="$TMPDIR/roslyn logs"`
+	LANGUAGE_SERVER_ENV = os.Getenv("LSPTRACE_LANGUAGE_SERVER_ENV")
+	// Name of a profile in the config file, which sets the options that
+	// weren't set by a flag or an environment variable e.g. 'gopls'. If the
+	// profile has a command it is used like LSPTRACE_LANGUAGE_SERVER_CMD,
+	// so args which aren't lsptrace flags are passed on to the server when
+	// the profile is selected with LSPTRACE_PROFILE.
+	PROFILE = os.Getenv("LSPTRACE_PROFILE")
+	// Config file with the profiles. Defaults to
+	// $XDG_CONFIG_HOME/lsptrace/config.json or ~/.config/lsptrace/config.json
+	CONFIG = os.Getenv("LSPTRACE_CONFIG")
 	// '1' means that the lsp communication will start with named pipe negotation
 	// meaning that the server will create a named pipe and then pass a single
 	// json message with 'pipeName' over stdout which the client should listen for
 	// and then connect to - from that point all communication will go through the
 	// pipe instead of stdin/stdout
 	HANDLE_NAMED_PIPES, _ = strconv.ParseBool(os.Getenv("LSPTRACE_HANDLE_NAMED_PIPES"))
-	CLI_ARGS              = os.Args[1:]
+	// 'client' | 'server' means that the lsp communication goes over a TCP socket
+	// on the port passed to the server as --socket=<port> or --port=<port>.
+	// The value is which side listens on that port: 'client' means the server
+	// connects to the client (vscode-languageclient's socket transport), 'server'
+	// means the client connects to the server. lsptrace rewrites the port passed
+	// to the server and sits in between.
+	SOCKET_LISTENER = os.Getenv("LSPTRACE_SOCKET_LISTENER")
+	// Endpoint to listen on for the client e.g. 'tcp:127.0.0.1:9000' or
+	// 'unix:/tmp/lsp.sock'. If set, lsptrace doesn't launch a language server
+	// and instead forwards the client to the already running server at
+	// LSPTRACE_FORWARD.
+	LISTEN  = os.Getenv("LSPTRACE_LISTEN")
+	FORWARD = os.Getenv("LSPTRACE_FORWARD")
+	// Endpoint to stream traces to `lsptrace view --connect` from e.g.
+	// 'unix:/tmp/lsptrace-view.sock'. Viewers get the traces written after
+	// they connect, on top of the trace output.
+	VIEW_LISTEN = os.Getenv("LSPTRACE_VIEW_LISTEN")
+	// Messages are forwarded right away and queued to be traced. This is how
+	// many reads may be waiting to be traced in each direction before
+	// LSPTRACE_QUEUE_POLICY applies: 'block' waits for the tracer, which
+	// slows down forwarding, and 'drop' leaves messages out of the trace and
+	// writes a 'dropped' marker in their place.
+	QUEUE_SIZE, _ = strconv.Atoi(cmp.Or(os.Getenv("LSPTRACE_QUEUE_SIZE"), strconv.Itoa(pipeline.DEFAULT_QUEUE_SIZE)))
+	QUEUE_POLICY  = cmp.Or(os.Getenv("LSPTRACE_QUEUE_POLICY"), pipeline.QUEUE_BLOCK)
+	// How often to write queue metrics to the debug log e.g. '10s'. They are
+	// always written when lsptrace exits.
+	METRICS_INTERVAL, _ = time.ParseDuration(cmp.Or(os.Getenv("LSPTRACE_METRICS_INTERVAL"), "0s"))
+	// How the language server exited is always traced as a 'server-exit'
+	// entry. If LSPTRACE_RESTART_SERVER is set, a server which exits before
+	// the client asked it to is restarted, up to LSPTRACE_MAX_RESTARTS times,
+	// and the client's initialize, initialized and open documents are
+	// replayed to it so that the editor session carries on. Only supported
+	// over stdin/stdout.
+	RESTART_SERVER, _ = strconv.ParseBool(cmp.Or(os.Getenv("LSPTRACE_RESTART_SERVER"), "false"))
+	MAX_RESTARTS, _   = strconv.Atoi(cmp.Or(os.Getenv("LSPTRACE_MAX_RESTARTS"), "3"))
+	CLI_ARGS          = os.Args[1:]
 )
 
-func checkError(err error) {
-	if err != nil {
-		log.Fatalf("Error: %s", err)
-	}
-}
-
 func setupLogger(filePath string) (func(), error) {
 	// TODO: debug file should be parameterized.
 	debugF, err := os.OpenFile(filePath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
@@ -74,104 +191,540 @@ func setupLogger(filePath string) (func(), error) {
 	}, err
 }
 
-func handleInterrupt(cleanup func()) {
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
-	go func() {
-		<-c
-		if cleanup != nil {
-			cleanup()
+// setupSubcommandLogger writes debug logs to filePath if set. Otherwise
+// they are discarded since subcommands may be using stdout and stderr.
+func setupSubcommandLogger(filePath string) (func(), error) {
+	if len(filePath) < 1 {
+		log.SetOutput(io.Discard)
+		return func() {}, nil
+	}
+	debugPath, err := resolveLocalPath(filePath)
+	if err != nil {
+		return nil, err
+	}
+	return setupLogger(debugPath)
+}
+
+// notifyShutdownSignals returns a channel receiving the signals which should
+// end lsptrace.
+func notifyShutdownSignals() chan os.Signal {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	return signals
+}
+
+// registerFlags defines lsptrace's flags on fs. Each defaults to the value
+// of its environment variable.
+func registerFlags(fs *flag.FlagSet) {
+	fs.StringVar(&DEBUG_OUTPUT, "debug_output", DEBUG_OUTPUT, "filepath to write debug logs to. defaults to lsptrace-debug-<pid>.log in the temp dir, which is removed again if lsptrace exits with 0.")
+	fs.StringVar(&TRACE_OUTPUT, "trace_output", TRACE_OUTPUT, "filepath to write lsp traces to.")
+	fs.StringVar(&TRACE_MAX_SIZE, "trace_max_size", TRACE_MAX_SIZE, "rotate the trace output before it gets bigger than this e.g. 100M.")
+	fs.DurationVar(&TRACE_MAX_AGE, "trace_max_age", TRACE_MAX_AGE, "rotate the trace output once it is this old e.g. 24h.")
+	fs.IntVar(&TRACE_MAX_FILES, "trace_max_files", TRACE_MAX_FILES, "how many rotated trace segments to keep. all are kept if 0.")
+	fs.BoolVar(&TRACE_COMPRESS, "trace_compress", TRACE_COMPRESS, "gzip rotated trace segments.")
+	fs.StringVar(&CAPTURE_OUTPUT, "capture_output", CAPTURE_OUTPUT, "filepath to record raw client/server byte streams to. the bytes are written as read and are not redacted by --redact or --redact_uri_root.")
+	fs.StringVar(&STDERR_OUTPUT, "stderr_output", STDERR_OUTPUT, "filepath to copy the language server's stderr to.")
+	fs.StringVar(&INCLUDE_METHODS, "include_methods", INCLUDE_METHODS, "comma-separated globs of lsp methods to trace. all methods are traced if empty.")
+	fs.StringVar(&EXCLUDE_METHODS, "exclude_methods", EXCLUDE_METHODS, "comma-separated globs of lsp methods to leave out of the trace.")
+	fs.StringVar(&REDACT, "redact", REDACT, "comma-separated redaction rules <method-glob>:<params|result|error>.<path>=<blank|hash> or <method-glob>:raw=<blank|hash> for unparsed bodies. 'defaults' redacts source text, initialize options, workspace roots and unparsed bodies.")
+	fs.StringVar(&REDACT_URI_ROOT, "redact_uri_root", REDACT_URI_ROOT, "rewrite file:// uris under this directory to file:///$ROOT/...")
+	fs.BoolVar(&HANDLE_NAMED_PIPES, "handle_named_pipes", HANDLE_NAMED_PIPES, "whether lsp communication will use named pipes. if true, lsptrace will expect an initial named pipe handshake.")
+	fs.StringVar(&LISTEN, "listen", LISTEN, "endpoint to accept the client on, tcp:<host>:<port> or unix:<path>. if set, no language server is launched and the client is proxied to --forward.")
+	fs.StringVar(&FORWARD, "forward", FORWARD, "endpoint of an already running language server to proxy the --listen client to.")
+	fs.StringVar(&VIEW_LISTEN, "view_listen", VIEW_LISTEN, "endpoint to stream traces to 'lsptrace view --connect' from, tcp:<host>:<port> or unix:<path>.")
+	fs.IntVar(&QUEUE_SIZE, "queue_size", QUEUE_SIZE, "how many reads in each direction may be waiting to be traced.")
+	fs.StringVar(&QUEUE_POLICY, "queue_policy", QUEUE_POLICY, "'block' | 'drop'. whether to wait for the tracer or leave messages out of the trace when the queue is full.")
+	fs.DurationVar(&METRICS_INTERVAL, "metrics_interval", METRICS_INTERVAL, "how often to write queue metrics to the debug log. only written on exit if 0.")
+	fs.StringVar(&LANGUAGE_SERVER_ENV, "server_env", LANGUAGE_SERVER_ENV, "environment variables to set for the language server e.g. 'DOTNET_ROOT=~/.dotnet LOG_LEVEL=debug'.")
+	fs.BoolVar(&RESTART_SERVER, "restart_server", RESTART_SERVER, "restart the language server if it exits before the client asks it to and replay the session's handshake to it. stdin/stdout transport only.")
+	fs.IntVar(&MAX_RESTARTS, "max_restarts", MAX_RESTARTS, "how many times to restart the language server with --restart_server.")
+	fs.StringVar(&SOCKET_LISTENER, "socket_listener", SOCKET_LISTENER, "'client' | 'server'. trace the lsp TCP socket transport on the --socket/--port server arg. the value is which side listens on the port.")
+
+	fs.StringVar(&PROFILE, "profile", PROFILE, "name of the profile in the config file to take options which aren't set otherwise from.")
+	fs.StringVar(&CONFIG, "config", CONFIG, "config file with profiles. defaults to ~/.config/lsptrace/config.json.")
+}
+
+// splitArgs separates lsptrace's own flags from the args meant for the
+// language server when the server command is set through the environment.
+// Flags defined on fs are taken wherever they are, along with their value.
+// Everything else, including unknown flags, and every arg after '--' is
+// passed on to the server in order.
+func splitArgs(fs *flag.FlagSet, args []string) (own []string, server []string) {
+	own, server = make([]string, 0), make([]string, 0)
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			server = append(server, args[i+1:]...)
+			break
 		}
-		os.Exit(1)
-	}()
+		f, hasValue := lookupFlag(fs, arg)
+		if f == nil {
+			server = append(server, arg)
+			continue
+		}
+		own = append(own, arg)
+		if boolFlag, ok := f.Value.(interface{ IsBoolFlag() bool }); !hasValue && !(ok && boolFlag.IsBoolFlag()) && i+1 < len(args) {
+			i++
+			own = append(own, args[i])
+		}
+	}
+	return own, server
+}
+
+// lookupFlag returns the flag on fs which arg sets e.g. '--trace_output=x'
+// and whether arg includes its value.
+func lookupFlag(fs *flag.FlagSet, arg string) (*flag.Flag, bool) {
+	if len(arg) < 2 || arg[0] != '-' {
+		return nil, false
+	}
+	name := strings.TrimPrefix(arg[1:], "-")
+	name, _, hasValue := strings.Cut(name, "=")
+	if len(name) == 0 {
+		return nil, false
+	}
+	return fs.Lookup(name), hasValue
 }
 
 func main() {
-	if len(os.Args) < 2 || os.Args[1] == "-h" {
+	if len(os.Args) > 1 && os.Args[1] == "-h" {
 		log.Fatal(HELP_MESSAGE)
 	}
+	if len(os.Args) > 1 {
+		if run, ok := subcommands[os.Args[1]]; ok {
+			// log may be discarded by the subcommand so errors go to stderr directly
+			if err := run(os.Args[2:]); err != nil {
+				if !errors.Is(err, ETRACESDIFFER) {
+					fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+				}
+				os.Exit(1)
+			}
+			return
+		}
+	}
 
-	// configuration
-	flag.StringVar(&DEBUG_OUTPUT, "debug_output", DEBUG_OUTPUT, "filepath to write debug logs to.")
-	flag.StringVar(&TRACE_OUTPUT, "trace_output", TRACE_OUTPUT, "filepath to write lsp traces to.")
-	flag.BoolVar(&HANDLE_NAMED_PIPES, "handle_named_pipes", HANDLE_NAMED_PIPES, "whether lsp communication will use named pipes. if true, lsptrace will expect an initial named pipe handshake.")
+	// a profile selected through the environment may set the server command
+	var profile *config.Profile
+	if len(PROFILE) > 0 {
+		var err error
+		if profile, err = loadProfile(CONFIG, PROFILE); err != nil {
+			log.Fatalf("%s\n", err)
+		}
+	}
+	// the server command may need no args when it is set
+	serverCmdSet := len(LANGUAGE_SERVER_CMD) > 0 || len(LANGUAGE_SERVER_ARGV) > 0 || (profile != nil && profile.HasCommand())
+	if len(os.Args) < 2 && !serverCmdSet {
+		log.Fatal(HELP_MESSAGE)
+	}
 
-	if len(LANGUAGE_SERVER_CMD) <= 0 {
-		// only parse flags from command line if LANGUAGE_SERVER_CMD isn't explicitly set
+	registerFlags(flag.CommandLine)
+	if serverCmdSet {
+		// the caller of the command may pass flags meant for the server, so
+		// only lsptrace's own flags are taken out of the args
+		own, serverArgs := splitArgs(flag.CommandLine, os.Args[1:])
+		flag.CommandLine.Parse(own)
+		CLI_ARGS = serverArgs
+	} else {
 		flag.Parse()
 		CLI_ARGS = flag.Args()
 	}
+	setFlags := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		setFlags[f.Name] = true
+	})
+	if profile == nil && len(PROFILE) > 0 {
+		var err error
+		if profile, err = loadProfile(CONFIG, PROFILE); err != nil {
+			log.Fatalf("%s\n", err)
+		}
+	}
+	if profile != nil {
+		if err := applyProfile(flag.CommandLine, profile, setFlags); err != nil {
+			log.Fatalf("%s\n", err)
+		}
+	}
 
 	if len(TRACE_OUTPUT) < 1 {
 		log.Fatalf("LSPTRACE_TRACE_OUTPUT or --trace_output must be set\n")
 	}
+	if RESTART_SERVER && (len(LISTEN) > 0 || HANDLE_NAMED_PIPES || len(SOCKET_LISTENER) > 0) {
+		log.Fatalf("LSPTRACE_RESTART_SERVER or --restart_server is only supported over stdin/stdout\n")
+	}
 
+	// exit only after the deferred cleanup in runTrace has happened
+	code, err := runTrace()
+	if err != nil {
+		log.Printf("Error: %s\n", err)
+		// stderr isn't used for lsp communication
+		fmt.Fprintf(os.Stderr, "lsptrace: %s\n", err)
+	}
+	os.Exit(code)
+}
+
+// runTrace traces the language server until it exits (or until either
+// side of the proxy disconnects). Signals are forwarded to the server, both
+// pipelines are drained before returning and the exit code is the server's.
+func runTrace() (code int, err error) {
 	// setup resources
+	signals := notifyShutdownSignals()
+	defer signal.Stop(signals)
 
-	// setup tmp dir
-	// TODO: temporary sockets should be removed after
-	// the log file probably shouldn't be removed.
+	// setup tmp dir for intercept sockets
 	tmpDir, err := os.MkdirTemp("", "lsp-trace-proxy")
-	checkError(err)
+	if err != nil {
+		return 1, err
+	}
+	defer os.RemoveAll(tmpDir)
 
-	// setup logger
-	debugPath := filepath.Join(tmpDir, "debug.log")
+	// the server command is needed to name the output files
+	var serverArgv, serverEnv []string
+	serverName := "proxy"
+	if len(LISTEN) <= 0 {
+		serverArgv, err = languageServerArgv(LANGUAGE_SERVER_CMD, LANGUAGE_SERVER_ARGV, CLI_ARGS)
+		if err != nil {
+			return 1, err
+		}
+		serverEnv, err = languageServerEnv(LANGUAGE_SERVER_ENV)
+		if err != nil {
+			return 1, err
+		}
+		// LSPTRACE_LANGUAGE_SERVER_ENV wins over the profile
+		serverEnv = append(slices.Clone(PROFILE_SERVER_ENV), serverEnv...)
+		serverName = languageServerName(PROFILE, serverArgv)
+	}
+	outputVars := outputPathVars(serverName)
+
+	// setup logger. the default log is kept outside of the tmp dir so
+	// that it is still around after a failed run. it is per run since
+	// an editor may start several lsptraces at once, and removed again
+	// after a clean exit so the temp dir doesn't fill up.
+	debugPath := filepath.Join(os.TempDir(), fmt.Sprintf("lsptrace-debug-%d.log", os.Getpid()))
+	removeDebugLog := true
 	if len(DEBUG_OUTPUT) > 0 {
-		debugPath, err = resolveLocalPath(DEBUG_OUTPUT)
-		checkError(err)
+		debugPath, err = resolveOutputPath(DEBUG_OUTPUT, outputVars)
+		if err != nil {
+			return 1, err
+		}
+		removeDebugLog = false
 	}
 	logCloser, err := setupLogger(debugPath)
-	checkError(err)
-	defer logCloser()
+	if err != nil {
+		return 1, err
+	}
+	defer func() {
+		logCloser()
+		if removeDebugLog && code == 0 && err == nil {
+			os.Remove(debugPath)
+		}
+	}()
 
 	// open trace file
-	tracePath, err := resolveLocalPath(TRACE_OUTPUT)
-	checkError(err)
-	traceOut, err := os.OpenFile(tracePath, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0666)
+	tracePath, err := resolveOutputPath(TRACE_OUTPUT, outputVars)
+	if err != nil {
+		return 1, err
+	}
+	rotateOptions, err := traceRotateOptions(TRACE_MAX_SIZE, TRACE_MAX_AGE, TRACE_MAX_FILES, TRACE_COMPRESS)
 	if err != nil {
-		err = errors.Join(errors.New("error opening trace output file"), err)
-		checkError(err)
+		return 1, err
+	}
+	traceOut, err := rotate.Open(tracePath, rotateOptions)
+	if err != nil {
+		return 1, errors.Join(errors.New("error opening trace output file"), err)
 	}
 	defer traceOut.Close()
+	if outpath.HasPlaceholders(TRACE_OUTPUT) {
+		if err := outpath.LinkLatest(tracePath); err != nil {
+			log.Printf("could not link latest trace: %s\n", err)
+		}
+	}
 
-	// TODO: handle interrupts properly and cleanup
-	handleInterrupt(nil)
+	// open capture file
+	var captureOut *os.File
+	if len(CAPTURE_OUTPUT) > 0 {
+		capturePath, err := resolveOutputPath(CAPTURE_OUTPUT, outputVars)
+		if err != nil {
+			return 1, err
+		}
+		captureOut, err = os.OpenFile(capturePath, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0666)
+		if err != nil {
+			return 1, errors.Join(errors.New("error opening capture output file"), err)
+		}
+		defer captureOut.Close()
+	}
 
-	log.Printf("debug log opened...\n")
+	// the server's stderr is passed on like it would be without lsptrace
+	var stderrOut io.Writer = os.Stderr
+	if len(STDERR_OUTPUT) > 0 {
+		stderrPath, err := resolveOutputPath(STDERR_OUTPUT, outputVars)
+		if err != nil {
+			return 1, err
+		}
+		stderrFile, err := os.OpenFile(stderrPath, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0666)
+		if err != nil {
+			return 1, errors.Join(errors.New("error opening stderr output file"), err)
+		}
+		defer stderrFile.Close()
+		stderrOut = io.MultiWriter(os.Stderr, stderrFile)
+	}
 
-	// setup command
-	execCmd := setupLanguageServerCommand()
-	log.Printf("execCmd created.: %s\n", execCmd.String())
+	redactor, err := redact.New(REDACT, REDACT_URI_ROOT)
+	if err != nil {
+		return 1, err
+	}
+	if captureOut != nil && !redactor.Empty() {
+		log.Println("warning: the raw capture is not redacted. it has everything the redaction rules leave out of the trace")
+	}
 
-	pipes, err := createLspPipes(execCmd, tmpDir, HANDLE_NAMED_PIPES)
-	checkError(err)
-	defer pipes.Close()
+	// traces are streamed to viewers as they are written to the trace output
+	var traceLines io.Writer = traceOut
+	if len(VIEW_LISTEN) > 0 {
+		viewListener, err := listenForViewers(VIEW_LISTEN)
+		if err != nil {
+			return 1, err
+		}
+		defer viewListener.Close()
+		broadcaster := view.NewBroadcaster()
+		defer broadcaster.Close()
+		go broadcaster.Serve(viewListener)
+		traceLines = io.MultiWriter(traceOut, broadcaster)
+	}
+
+	log.Printf("debug log opened...\n")
+
+	var execCmd *exec.Cmd
+	var serverStderr io.Reader
+	var pipes LSPPipe
+	var proxyPipe *ProxyLSPPipe
+	if len(LISTEN) > 0 {
+		// standalone proxy to an already running server
+		proxyPipe = NewProxyLSPPipe(LISTEN, FORWARD)
+		pipes = proxyPipe
+	} else {
+		// setup command
+		execCmd = setupLanguageServerCommand(serverArgv, serverEnv)
+		log.Printf("execCmd created.: %s\n", execCmd.String())
+		serverStderr, err = execCmd.StderrPipe()
+		if err != nil {
+			return 1, err
+		}
+		pipes = createLspPipes(execCmd, tmpDir, HANDLE_NAMED_PIPES, SOCKET_LISTENER)
+	}
+	sig, err := setupPipes(pipes, execCmd, signals)
+	if err != nil {
+		return 1, errors.Join(errors.New("could not set up lsp communication"), err)
+	}
+	if sig != nil {
+		return signalExitCode(sig), nil
+	}
+	// pipes is replaced when the server is restarted
+	defer func() { pipes.Close() }()
 
 	cIn, cOut, sIn, sOut := pipes.CIn(), pipes.COut(), pipes.SIn(), pipes.SOut()
 	reqMap := internal.NewRequestMap()
 	lspTracer := internal.NewLSPTracer(reqMap)
-	clientPipeline := pipeline.NewPipeline(cOut, sIn, traceOut, lspTracer, "client")
-	serverPipeline := pipeline.NewPipeline(sOut, cIn, traceOut, lspTracer, "server")
-	// TODO: handle closing
-	_ = clientPipeline.Run()
-	_ = serverPipeline.Run()
+	lspTracer.SetMethodFilter(internal.NewMethodFilter(INCLUDE_METHODS, EXCLUDE_METHODS))
+	// tells a crash from a requested exit and keeps what a restarted server
+	// needs to be told
+	sessionState := internal.NewSessionState(RESTART_SERVER)
+	lspTracer.SetSessionState(sessionState)
+	traceWriter := pipeline.NewTraceWriter(traceLines)
+	newPipeline := func(rawIn io.Reader, rawOut io.Writer, sentFrom string) (*pipeline.Pipeline, error) {
+		p := pipeline.NewPipeline(rawIn, rawOut, traceWriter, lspTracer, sentFrom)
+		p.SetRedactor(redactor)
+		if captureOut != nil {
+			p.SetCaptureOutput(captureOut)
+		}
+		return p, p.SetQueue(QUEUE_SIZE, QUEUE_POLICY)
+	}
+	clientPipeline, err := newPipeline(cOut, sIn, "client")
+	if err != nil {
+		return 1, err
+	}
+	serverPipeline, err := newPipeline(sOut, cIn, "server")
+	if err != nil {
+		return 1, err
+	}
+	stopMetrics := logMetrics(METRICS_INTERVAL, map[string]*pipeline.Pipeline{"client": clientPipeline, "server": serverPipeline})
+	// replaced when the server is restarted
+	defer func() { stopMetrics() }()
+	clientDone := clientPipeline.Run()
+	serverDone := serverPipeline.Run()
+	var stderrDone chan int
+	if serverStderr != nil {
+		stderrDone = pipeline.RunStderrStage(serverStderr, stderrOut, traceWriter, lspTracer, redactor)
+	}
 
-	execCmd.Wait()
-}
+	if proxyPipe != nil {
+		return runProxy(proxyPipe, clientPipeline, serverPipeline, clientDone, serverDone, signals)
+	}
 
-func createLspPipes(execCmd *exec.Cmd, tmpDir string, handleNamedPipes bool) (lspPipe LSPPipe, err error) {
-	if handleNamedPipes {
-		lspPipe = NewNamedPipesLSPPipe(execCmd, tmpDir)
-	} else {
-		lspPipe = NewStdInOutLSPPipe(execCmd)
+	restarter := &serverRestarter{
+		serverArgv:     serverArgv,
+		serverEnv:      serverEnv,
+		clientPipeline: clientPipeline,
+		clientIn:       cIn,
+		state:          sessionState,
+		lspTracer:      lspTracer,
+		traceWriter:    traceWriter,
+		redactor:       redactor,
+	}
+	for {
+		// the server's output ends when it exits. the client may never close
+		// its output so its pipeline is stopped once the server is done.
+		for serverDone != nil {
+			select {
+			case <-serverDone:
+				serverDone = nil
+			case <-clientDone:
+				log.Println("client closed its output. closing server input")
+				clientDone = nil
+				pipes.CloseServerInput()
+			case sig := <-signals:
+				log.Printf("forwarding %s to language server\n", sig)
+				execCmd.Process.Signal(sig)
+			}
+		}
+		// stderr can be held open by processes the server started
+		select {
+		case <-stderrDone:
+		case <-time.After(STDERR_CLOSE_TIMEOUT):
+			log.Println("timed out waiting for the language server to close stderr")
+		}
+		// only wait for the server after its output was read since Wait
+		// closes the server's stdout and stderr
+		waitForServer(execCmd, signals)
+		exit := serverExit(execCmd.ProcessState, !sessionState.ShuttingDown())
+		traceWriter.Trace(func() *internal.LSPTrace {
+			return lspTracer.MakeServerExitTrace(exit)
+		}, redactor)
+
+		if !RESTART_SERVER || !exit.Crashed || clientDone == nil || restarter.restarts >= MAX_RESTARTS {
+			break
+		}
+		server, err := restarter.Restart()
+		if err != nil {
+			log.Printf("could not restart language server: %s\n", err)
+			break
+		}
+		log.Printf("restarted language server (%d/%d)\n", restarter.restarts, MAX_RESTARTS)
+		execCmd, pipes = server.execCmd, server.pipes
+		serverPipeline, err = newPipeline(server.sOut, cIn, "server")
+		if err != nil {
+			return 1, err
+		}
+		stopMetrics()
+		stopMetrics = logMetrics(METRICS_INTERVAL, map[string]*pipeline.Pipeline{"client": clientPipeline, "server": serverPipeline})
+		serverDone = serverPipeline.Run()
+		stderrDone = pipeline.RunStderrStage(server.stderr, stderrOut, traceWriter, lspTracer, redactor)
 	}
-	err = lspPipe.Setup()
+	clientPipeline.Stop()
+	if clientDone != nil {
+		<-clientDone
+	}
+	return exitCode(execCmd.ProcessState), nil
+}
+
+// listenForViewers listens on the --view_listen endpoint.
+func listenForViewers(endpoint string) (net.Listener, error) {
+	network, address, err := parseEndpoint(endpoint)
 	if err != nil {
-		err = errors.Join(errors.New("could not set up named pipes lsp communication"), err)
 		return nil, err
 	}
-	return lspPipe, err
+	if network == "unix" {
+		if err := removeStaleSocket(address); err != nil {
+			return nil, err
+		}
+	}
+	l, err := net.Listen(network, address)
+	if err != nil {
+		return nil, errors.Join(errors.New("could not listen for viewers"), err)
+	}
+	log.Printf("streaming traces to viewers on %s\n", endpoint)
+	return l, nil
+}
+
+// waitForServer waits for the language server to exit while forwarding
+// signals to it.
+func waitForServer(execCmd *exec.Cmd, signals chan os.Signal) {
+	exited := make(chan error, 1)
+	go func() {
+		exited <- execCmd.Wait()
+	}()
+	for {
+		select {
+		case err := <-exited:
+			log.Printf("language server exited: %v\n", err)
+			return
+		case sig := <-signals:
+			log.Printf("forwarding %s to language server\n", sig)
+			execCmd.Process.Signal(sig)
+		}
+	}
+}
+
+func traceRotateOptions(maxSize string, maxAge time.Duration, maxFiles int, compress bool) (rotate.Options, error) {
+	size, err := rotate.ParseSize(maxSize)
+	if err != nil {
+		return rotate.Options{}, err
+	}
+	return rotate.Options{MaxSize: size, MaxAge: maxAge, MaxFiles: maxFiles, Compress: compress}, nil
+}
+
+// logMetrics writes the queue metrics of pipelines to the debug log every
+// interval, if positive, and once more when the returned func is called.
+func logMetrics(interval time.Duration, pipelines map[string]*pipeline.Pipeline) (stop func()) {
+	write := func() {
+		for name, p := range pipelines {
+			log.Printf("metrics: %s: %s\n", name, p.Metrics())
+		}
+	}
+	done := make(chan struct{})
+	if interval > 0 {
+		go func() {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					write()
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+	return func() {
+		close(done)
+		write()
+	}
+}
+
+// exitCode is the exit code of a finished process following the shell
+// convention of 128+n for processes ended by signal n.
+func exitCode(state *os.ProcessState) int {
+	if status, ok := state.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return 128 + int(status.Signal())
+	}
+	return state.ExitCode()
+}
 
+func signalExitCode(sig os.Signal) int {
+	if s, ok := sig.(syscall.Signal); ok {
+		return 128 + int(s)
+	}
+	return 1
+}
+
+// createLspPipes picks the LSPPipe for the configured transport. Setup
+// still needs to be called on it.
+func createLspPipes(execCmd *exec.Cmd, tmpDir string, handleNamedPipes bool, socketListener string) LSPPipe {
+	switch {
+	case len(socketListener) > 0:
+		return NewSocketLSPPipe(execCmd, socketListener)
+	case handleNamedPipes:
+		return NewNamedPipesLSPPipe(execCmd, tmpDir)
+	default:
+		return NewStdInOutLSPPipe(execCmd)
+	}
 }
 
 type LSPPipe interface {
@@ -180,13 +733,92 @@ type LSPPipe interface {
 	COut() io.Reader
 	SIn() io.Writer
 	SOut() io.Reader
+	// CloseServerInput lets the server know that the client is gone while
+	// still reading what it sends
+	CloseServerInput()
+	// Close may be called while Setup is still running, which makes Setup
+	// return
 	Close()
 }
 
+var (
+	ESETUPCLOSED = errors.New("pipe closed during setup")
+)
+
+// setupClosers keeps what a pipe opened during Setup so that Close can be
+// called while Setup is still running, e.g. on a signal.
+type setupClosers struct {
+	mutex   sync.Mutex
+	closed  bool
+	closers []io.Closer
+}
+
+// add keeps closer to be closed by closeAll. If closeAll was called already
+// closer is closed right away and ESETUPCLOSED is returned.
+func (c *setupClosers) add(closer io.Closer) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.closed {
+		closer.Close()
+		return ESETUPCLOSED
+	}
+	c.closers = append(c.closers, closer)
+	return nil
+}
+
+func (c *setupClosers) isClosed() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.closed
+}
+
+func (c *setupClosers) closeAll() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.closed = true
+	for _, closer := range c.closers {
+		closer.Close()
+	}
+	c.closers = nil
+}
+
+// setupPipes sets up pipes while still stopping on a signal, which is
+// returned. If setup fails or is interrupted, what it opened is closed and
+// a server it started is killed so that it isn't left running.
+func setupPipes(pipes LSPPipe, execCmd *exec.Cmd, signals chan os.Signal) (os.Signal, error) {
+	// setup may wait on the client or server to connect so it is done in the
+	// background
+	setupDone := make(chan error, 1)
+	go func() {
+		setupDone <- pipes.Setup()
+	}()
+	var sig os.Signal
+	var err error
+	select {
+	case err = <-setupDone:
+		if err == nil {
+			return nil, nil
+		}
+		pipes.Close()
+	case sig = <-signals:
+		log.Printf("received %s during setup\n", sig)
+		pipes.Close()
+		// the server is only known to be started or not once setup returned
+		<-setupDone
+	}
+	if execCmd != nil && execCmd.Process != nil {
+		log.Println("killing language server started during setup")
+		execCmd.Process.Kill()
+		execCmd.Wait()
+	}
+	return sig, err
+}
+
 type StdInOutLSPPipe struct {
 	execCmd *exec.Cmd
 	sIn     io.WriteCloser
 	sOut    io.ReadCloser
+	closers setupClosers
 }
 
 func NewStdInOutLSPPipe(execCmd *exec.Cmd) *StdInOutLSPPipe {
@@ -204,6 +836,12 @@ func (p *StdInOutLSPPipe) Setup() error {
 		return err
 	}
 	p.sOut = sOut
+	if err := p.closers.add(sIn); err != nil {
+		return err
+	}
+	if err := p.closers.add(sOut); err != nil {
+		return err
+	}
 	err = p.execCmd.Start()
 	if err != nil {
 		err = errors.Join(errors.New("error starting lsp command"), err)
@@ -230,9 +868,12 @@ func (p *StdInOutLSPPipe) SOut() io.Reader {
 	return p.sOut
 }
 
-func (p *StdInOutLSPPipe) Close() {
+func (p *StdInOutLSPPipe) CloseServerInput() {
 	p.sIn.Close()
-	p.sOut.Close()
+}
+
+func (p *StdInOutLSPPipe) Close() {
+	p.closers.closeAll()
 }
 
 type NamedPipesLSPPipe struct {
@@ -241,6 +882,7 @@ type NamedPipesLSPPipe struct {
 	interceptListener net.Listener
 	clientConnection  net.Conn
 	serverConnection  net.Conn
+	closers           setupClosers
 }
 
 func NewNamedPipesLSPPipe(execCmd *exec.Cmd, pipeDir string) *NamedPipesLSPPipe {
@@ -258,6 +900,10 @@ func (p *NamedPipesLSPPipe) Setup() error {
 		err = errors.Join(errors.New("could not get stdout pipe of lsp command"), err)
 		return err
 	}
+	// closing stdout stops waiting for the pipe message
+	if err := p.closers.add(stdout); err != nil {
+		return err
+	}
 	// Start command
 	err = p.execCmd.Start()
 	if err != nil {
@@ -280,6 +926,9 @@ func (p *NamedPipesLSPPipe) Setup() error {
 		err = errors.Join(errors.New("could not setup intercept pipe"), err)
 		return err
 	}
+	if err := p.closers.add(l); err != nil {
+		return err
+	}
 	log.Printf("Created intercept pipe name: %s\n", interceptPipeName)
 	log.Printf("Created intercept pipe listener\n")
 	interceptPipeMsg := PipeMsg{
@@ -304,6 +953,9 @@ func (p *NamedPipesLSPPipe) Setup() error {
 		err = errors.Join(errors.New("error listening for connection from client on created intercept pipe"), err)
 		return err
 	}
+	if err := p.closers.add(conn); err != nil {
+		return err
+	}
 	log.Println("Accepted connection on intercept pipe.")
 
 	// connect to the original pipe which the language server broadcast that it is listening on
@@ -314,6 +966,9 @@ func (p *NamedPipesLSPPipe) Setup() error {
 		err = errors.Join(errors.New("unable to connect to original pipe given from server"), err)
 		return err
 	}
+	if err := p.closers.add(serv_conn); err != nil {
+		return err
+	}
 	log.Println("Connected to original pipe.")
 	return nil
 }
@@ -334,10 +989,12 @@ func (p *NamedPipesLSPPipe) SOut() io.Reader {
 	return p.serverConnection
 }
 
+func (p *NamedPipesLSPPipe) CloseServerInput() {
+	closeWrite(p.serverConnection)
+}
+
 func (p *NamedPipesLSPPipe) Close() {
-	p.serverConnection.Close()
-	p.clientConnection.Close()
-	p.interceptListener.Close()
+	p.closers.closeAll()
 }
 
 func pollForInitialPipeMsg(pipeSender io.Reader) (string, error) {
@@ -346,10 +1003,9 @@ func pollForInitialPipeMsg(pipeSender io.Reader) (string, error) {
 	var pipeMsg PipeMsg
 	var err error
 	for {
-		outScanner.Scan()
-		err = outScanner.Err()
-		if err != nil {
-			return "", err
+		if !outScanner.Scan() {
+			// the server exited or stdout was closed
+			return "", cmp.Or(outScanner.Err(), io.ErrUnexpectedEOF)
 		}
 		bytes := outScanner.Bytes()
 		err = json.Unmarshal(bytes, &pipeMsg)
@@ -368,29 +1024,84 @@ type PipeMsg struct {
 	PipeName string `json:"pipeName"`
 }
 
-func setupLanguageServerCommand() *exec.Cmd {
-	var cmd string
-	var args []string
-	if LANGUAGE_SERVER_CMD == "" {
-		log.Println("language server command not specified. assumed to be first argument.")
-		cmd = CLI_ARGS[0]
-		args = CLI_ARGS[1:]
-	} else {
+// languageServerArgv returns the command and args to run the language
+// server with. cliArgs are appended to serverCmd or serverArgv if either
+// is set and are the whole command otherwise.
+func languageServerArgv(serverCmd string, serverArgv string, cliArgs []string) ([]string, error) {
+	var argv []string
+	switch {
+	case len(serverCmd) > 0 && len(serverArgv) > 0:
+		return nil, errors.New("only one of LSPTRACE_LANGUAGE_SERVER_CMD and LSPTRACE_LANGUAGE_SERVER_ARGV can be set")
+	case len(serverArgv) > 0:
+		if err := json.Unmarshal([]byte(serverArgv), &argv); err != nil {
+			return nil, errors.Join(errors.New("LSPTRACE_LANGUAGE_SERVER_ARGV must be a json array of strings"), err)
+		}
+	case len(serverCmd) > 0:
 		// for roslyn we should configure LSPTRACE_LANGUAGE_SERVER_CMD = "dotnet <path-to-roslyn-dll>"
 		// when running vscode
-		log.Printf("language server command specified. lsptrace will run %s with given args\n", LANGUAGE_SERVER_CMD)
-		cmdParts := strings.Split(LANGUAGE_SERVER_CMD, " ")
-		cmd = cmdParts[0]
-		if len(cmdParts) > 1 {
-			args = append(cmdParts[1:], CLI_ARGS...)
-		} else {
-			args = CLI_ARGS
+		words, err := shellwords.Split(serverCmd, os.Getenv, homeDir())
+		if err != nil {
+			return nil, errors.Join(errors.New("could not parse LSPTRACE_LANGUAGE_SERVER_CMD"), err)
 		}
+		argv = words
+	}
+	// if no command is specified, it is assumed to be the first argument
+	argv = append(argv, cliArgs...)
+	if len(argv) < 1 {
+		return nil, errors.New("no language server command given")
+	}
+	return argv, nil
+}
+
+// languageServerEnv parses KEY=VALUE words of serverEnv.
+func languageServerEnv(serverEnv string) ([]string, error) {
+	words, err := shellwords.Split(serverEnv, os.Getenv, homeDir())
+	if err != nil {
+		return nil, errors.Join(errors.New("could not parse language server environment"), err)
+	}
+	for _, word := range words {
+		if name, _, ok := strings.Cut(word, "="); !ok || len(name) == 0 {
+			return nil, fmt.Errorf("language server environment must be KEY=VALUE, got %q", word)
+		}
+	}
+	return words, nil
+}
+
+// setupLanguageServerCommand makes the command for argv. env is set on top
+// of lsptrace's own environment.
+func setupLanguageServerCommand(argv []string, env []string) *exec.Cmd {
+	execCmd := exec.Command(argv[0], argv[1:]...)
+	if len(env) > 0 {
+		// later values win over lsptrace's
+		execCmd.Env = append(os.Environ(), env...)
 	}
-	execCmd := exec.Command(cmd, args...)
 	return execCmd
 }
 
+// homeDir returns the current user's home directory or an empty string if
+// it can't be found.
+func homeDir() string {
+	usr, err := user.Current()
+	if err != nil {
+		return ""
+	}
+	return usr.HomeDir
+}
+
+// readTraceFile reads all traces of the trace file at path.
+func readTraceFile(path string) ([]*internal.LSPTrace, error) {
+	tracePath, err := resolveLocalPath(path)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(tracePath)
+	if err != nil {
+		return nil, errors.Join(errors.New("could not open trace file "+path), err)
+	}
+	defer f.Close()
+	return internal.ReadTraces(f)
+}
+
 func resolveLocalPath(path string) (string, error) {
 	if strings.HasPrefix(path, "~/") {
 		usr, err := user.Current()
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestSplitArgs(t *testing.T) {
+	var output string
+	var compress bool
+	fs := flag.NewFlagSet("lsptrace", flag.ContinueOnError)
+	fs.StringVar(&output, "trace_output", "", "")
+	fs.BoolVar(&compress, "trace_compress", false, "")
+
+	own, server := splitArgs(fs, []string{"--stdio", "--trace_output", "x.lsptrace", "--logLevel", "Information", "-trace_compress", "--", "--trace_output=y"})
+	if expected := []string{"--trace_output", "x.lsptrace", "-trace_compress"}; !slices.Equal(own, expected) {
+		t.Fatalf("expected lsptrace flags %v, got %v", expected, own)
+	}
+	if expected := []string{"--stdio", "--logLevel", "Information", "--trace_output=y"}; !slices.Equal(server, expected) {
+		t.Fatalf("expected server args %v in order, got %v", expected, server)
+	}
+	if err := fs.Parse(own); err != nil || output != "x.lsptrace" || !compress || len(fs.Args()) > 0 {
+		t.Fatalf("expected lsptrace flags to parse, got %q %v %v %v", output, compress, fs.Args(), err)
+	}
+
+	own, server = splitArgs(fs, []string{"--trace_output=z", "-", "serve"})
+	if !slices.Equal(own, []string{"--trace_output=z"}) || !slices.Equal(server, []string{"-", "serve"}) {
+		t.Fatalf("expected a flag with its value in the same arg, got %v %v", own, server)
+	}
+}
+
+func TestSetupPipesSignal(t *testing.T) {
+	started := filepath.Join(t.TempDir(), "started")
+	execCmd := setupLanguageServerCommand([]string{os.Args[0]}, []string{FAKE_SERVER_ENV + "=" + FAKE_SERVER_HANG, FAKE_SERVER_STARTED_ENV + "=" + started})
+	// setup waits for a pipe name the server never sends
+	pipes := NewNamedPipesLSPPipe(execCmd, t.TempDir())
+	signals := make(chan os.Signal, 1)
+	go func() {
+		for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			if _, err := os.Stat(started); err == nil {
+				break
+			}
+		}
+		signals <- syscall.SIGTERM
+	}()
+	sig, err := setupPipes(pipes, execCmd, signals)
+	if sig != syscall.SIGTERM || err != nil {
+		t.Fatalf("expected setup to stop on the signal, got %v %v", sig, err)
+	}
+	if execCmd.ProcessState == nil {
+		t.Fatal("expected the server started during setup to be killed and waited for")
+	}
+	if _, err := os.Stat(started); err != nil {
+		t.Fatalf("expected the server to have been started, got %v", err)
+	}
+}
+
+func TestSetupPipesError(t *testing.T) {
+	execCmd := setupLanguageServerCommand([]string{os.Args[0]}, []string{FAKE_SERVER_ENV + "=1"})
+	// the server exits without sending a pipe name since its stdin is empty
+	pipes := NewNamedPipesLSPPipe(execCmd, t.TempDir())
+	sig, err := setupPipes(pipes, execCmd, make(chan os.Signal))
+	if sig != nil || err == nil {
+		t.Fatalf("expected setup to fail, got %v %v", sig, err)
+	}
+	if execCmd.ProcessState == nil {
+		t.Fatal("expected the server to be waited for when setup fails")
+	}
+	// closing again is fine
+	pipes.Close()
+	if err := pipes.closers.add(io.NopCloser(nil)); !errors.Is(err, ESETUPCLOSED) {
+		t.Fatalf("expected nothing to be kept once closed, got %v", err)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/mparq/lsptrace/internal/config"
+	"github.com/mparq/lsptrace/internal/outpath"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// {date} in output paths
+	OUTPUT_DATE_FORMAT = "2006-01-02"
+	// {time} in output paths, also the start of {session}
+	OUTPUT_TIME_FORMAT = "20060102T150405"
+)
+
+var (
+	// environment variables the selected profile sets for the language server
+	PROFILE_SERVER_ENV []string
+
+	// options whose environment variable isn't LSPTRACE_<OPTION>
+	optionEnvNames = map[string]string{
+		"server_env": "LSPTRACE_LANGUAGE_SERVER_ENV",
+	}
+)
+
+// loadProfile reads the profile called name from the config file at
+// configPath or at the default path if it is empty.
+func loadProfile(configPath string, name string) (*config.Profile, error) {
+	if len(configPath) == 0 {
+		configPath = config.DefaultPath(homeDir())
+	}
+	configPath, err := resolveLocalPath(configPath)
+	if err != nil {
+		return nil, err
+	}
+	c, err := config.Load(configPath)
+	if err != nil {
+		return nil, errors.Join(fmt.Errorf("could not load profile %q", name), err)
+	}
+	return c.Profile(name)
+}
+
+// applyProfile sets the options of profile which weren't set by a flag in
+// setFlags or by their environment variable on fs. The profile's command is
+// used if neither LSPTRACE_LANGUAGE_SERVER_CMD nor _ARGV is set.
+func applyProfile(fs *flag.FlagSet, profile *config.Profile, setFlags map[string]bool) error {
+	for name, value := range profile.Options {
+		f := fs.Lookup(name)
+		if f == nil || name == "profile" || name == "config" {
+			return fmt.Errorf("profile: unknown option %q", name)
+		}
+		if setFlags[name] || len(os.Getenv(optionEnvName(name))) > 0 {
+			continue
+		}
+		if err := f.Value.Set(value); err != nil {
+			return errors.Join(fmt.Errorf("profile: invalid value %q for %s", value, name), err)
+		}
+	}
+	if len(LANGUAGE_SERVER_CMD) == 0 && len(LANGUAGE_SERVER_ARGV) == 0 {
+		LANGUAGE_SERVER_CMD = profile.Command
+		if len(profile.Argv) > 0 {
+			argv, err := json.Marshal(profile.Argv)
+			if err != nil {
+				return err
+			}
+			LANGUAGE_SERVER_ARGV = string(argv)
+		}
+	}
+	PROFILE_SERVER_ENV = profile.EnvList()
+	return nil
+}
+
+func optionEnvName(name string) string {
+	if envName, ok := optionEnvNames[name]; ok {
+		return envName
+	}
+	return "LSPTRACE_" + strings.ToUpper(name)
+}
+
+// languageServerName is the profile name or else the name of the server's
+// executable without its extension e.g. 'gopls'.
+func languageServerName(profile string, argv []string) string {
+	if len(profile) > 0 {
+		return profile
+	}
+	exe := filepath.Base(argv[0])
+	return strings.TrimSuffix(exe, filepath.Ext(exe))
+}
+
+// outputPathVars are the values of the placeholders in output paths. they
+// are taken once so that every output of a run has the same {time}.
+func outputPathVars(server string) map[string]string {
+	now := time.Now()
+	pid := strconv.Itoa(os.Getpid())
+	// only the name of the working dir, a full path would add directories
+	cwd := "unknown"
+	if wd, err := os.Getwd(); err == nil {
+		cwd = outpath.Sanitize(filepath.Base(wd))
+	}
+	return map[string]string{
+		"server":  outpath.Sanitize(server),
+		"date":    now.Format(OUTPUT_DATE_FORMAT),
+		"time":    now.Format(OUTPUT_TIME_FORMAT),
+		"pid":     pid,
+		"cwd":     cwd,
+		"session": fmt.Sprintf("%s-%s", now.Format(OUTPUT_TIME_FORMAT), pid),
+	}
+}
+
+// resolveOutputPath replaces the placeholders in path and resolves ~/.
+func resolveOutputPath(path string, vars map[string]string) (string, error) {
+	expanded, err := outpath.Expand(path, vars)
+	if err != nil {
+		return "", err
+	}
+	return resolveLocalPath(expanded)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"flag"
+	"github.com/mparq/lsptrace/internal/config"
+	"testing"
+)
+
+func TestApplyProfilePrecedence(t *testing.T) {
+	serverCmd, serverArgv, serverEnv := LANGUAGE_SERVER_CMD, LANGUAGE_SERVER_ARGV, PROFILE_SERVER_ENV
+	t.Cleanup(func() {
+		LANGUAGE_SERVER_CMD, LANGUAGE_SERVER_ARGV, PROFILE_SERVER_ENV = serverCmd, serverArgv, serverEnv
+	})
+	LANGUAGE_SERVER_CMD, LANGUAGE_SERVER_ARGV = "", ""
+
+	// flags default to their environment variable like in registerFlags
+	t.Setenv("LSPTRACE_EXCLUDE_METHODS", "env/*")
+	var output, exclude, redact string
+	exclude = "env/*"
+	fs := flag.NewFlagSet("lsptrace", flag.ContinueOnError)
+	fs.StringVar(&output, "trace_output", output, "")
+	fs.StringVar(&exclude, "exclude_methods", exclude, "")
+	fs.StringVar(&redact, "redact", redact, "")
+	if err := fs.Parse([]string{"--trace_output", "flag.lsptrace"}); err != nil {
+		t.Fatal(err)
+	}
+	setFlags := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		setFlags[f.Name] = true
+	})
+
+	profile := &config.Profile{
+		Command: "gopls serve",
+		Env:     map[string]string{"GOFLAGS": "-mod=mod"},
+		Options: map[string]string{
+			"trace_output":    "profile.lsptrace",
+			"exclude_methods": "profile/*",
+			"redact":          "defaults",
+		},
+	}
+	if err := applyProfile(fs, profile, setFlags); err != nil {
+		t.Fatal(err)
+	}
+	if output != "flag.lsptrace" || exclude != "env/*" || redact != "defaults" {
+		t.Fatalf("expected flag > env > profile, got trace_output=%q exclude_methods=%q redact=%q", output, exclude, redact)
+	}
+	if LANGUAGE_SERVER_CMD != "gopls serve" || len(PROFILE_SERVER_ENV) != 1 || PROFILE_SERVER_ENV[0] != "GOFLAGS=-mod=mod" {
+		t.Fatalf("expected the profile's command and env to be used, got %q %v", LANGUAGE_SERVER_CMD, PROFILE_SERVER_ENV)
+	}
+
+	// an env command wins over the profile's
+	LANGUAGE_SERVER_CMD = "gopls -rpc.trace"
+	if err := applyProfile(fs, profile, setFlags); err != nil || LANGUAGE_SERVER_CMD != "gopls -rpc.trace" {
+		t.Fatalf("expected the env command to be kept, got %q %v", LANGUAGE_SERVER_CMD, err)
+	}
+
+	profile.Options = map[string]string{"trace_outptu": "x"}
+	if err := applyProfile(fs, profile, setFlags); err == nil {
+		t.Fatal("expected an unknown option to be an error")
+	}
+}
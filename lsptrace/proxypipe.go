@@ -0,0 +1,231 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"github.com/mparq/lsptrace/internal/pipeline"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// how long to wait for the other side to finish after one side of the
+	// proxy closes its connection
+	PROXY_CLOSE_TIMEOUT = 5 * time.Second
+	// how long to wait for something listening on an existing unix socket
+	SOCKET_PROBE_TIMEOUT = time.Second
+)
+
+var (
+	EADDRINUSE    = errors.New("proxy: address in use")
+	ECLOSETIMEOUT = errors.New("proxy: timed out waiting for the other side to close")
+)
+
+// ProxyLSPPipe traces lsp communication between a client which connects to
+// the listen endpoint and an already running server at the forward endpoint.
+// Nothing is launched. Endpoints look like 'tcp:127.0.0.1:9000',
+// 'unix:/tmp/lsp.sock' or 'host:port' which is taken to be tcp.
+type ProxyLSPPipe struct {
+	listen  string
+	forward string
+
+	listener         net.Listener
+	clientConnection net.Conn
+	serverConnection net.Conn
+	closers          setupClosers
+}
+
+func NewProxyLSPPipe(listen string, forward string) *ProxyLSPPipe {
+	return &ProxyLSPPipe{listen: listen, forward: forward}
+}
+
+func (p *ProxyLSPPipe) Setup() error {
+	if len(p.forward) == 0 {
+		return errors.New("proxy: a forward endpoint is required to listen on " + p.listen)
+	}
+	listenNetwork, listenAddress, err := parseEndpoint(p.listen)
+	if err != nil {
+		return err
+	}
+	forwardNetwork, forwardAddress, err := parseEndpoint(p.forward)
+	if err != nil {
+		return err
+	}
+	if listenNetwork == "unix" {
+		if err := removeStaleSocket(listenAddress); err != nil {
+			return err
+		}
+	}
+	l, err := net.Listen(listenNetwork, listenAddress)
+	if err != nil {
+		return errors.Join(errors.New("proxy: could not listen for client"), err)
+	}
+	p.listener = l
+	if err := p.closers.add(l); err != nil {
+		return err
+	}
+
+	log.Printf("Listening for connection from client on %s...\n", p.listen)
+	conn, err := l.Accept()
+	if err != nil {
+		return errors.Join(errors.New("proxy: error accepting connection from client"), err)
+	}
+	p.clientConnection = conn
+	if err := p.closers.add(conn); err != nil {
+		return err
+	}
+	log.Println("Accepted connection from client.")
+
+	log.Printf("Connecting to server at %s...\n", p.forward)
+	conn, err = net.DialTimeout(forwardNetwork, forwardAddress, SOCKET_CONNECT_TIMEOUT)
+	if err != nil {
+		return errors.Join(errors.New("proxy: could not connect to server"), err)
+	}
+	p.serverConnection = conn
+	if err := p.closers.add(conn); err != nil {
+		return err
+	}
+	log.Println("Connected to server.")
+	return nil
+}
+
+// Wait blocks until both pipelines are done. When one side closes its
+// connection the write side of the other connection is closed so that it
+// sees the end of the stream too. If the other side doesn't close in time
+// its done channel is returned, otherwise nil.
+func (p *ProxyLSPPipe) Wait(clientDone chan int, serverDone chan int) (pending chan int) {
+	var otherDone chan int
+	select {
+	case <-clientDone:
+		log.Println("proxy: client closed the connection")
+		p.CloseServerInput()
+		otherDone = serverDone
+	case <-serverDone:
+		log.Println("proxy: server closed the connection")
+		closeWrite(p.clientConnection)
+		otherDone = clientDone
+	}
+	select {
+	case <-otherDone:
+		return nil
+	case <-time.After(PROXY_CLOSE_TIMEOUT):
+		log.Println("proxy: timed out waiting for the other side to close")
+		return otherDone
+	}
+}
+
+// runProxy waits for the proxy to end and returns lsptrace's exit code. The
+// proxy ended normally if both sides closed their connections. A side which
+// failed, didn't close in time or a signal make it end with a nonzero code.
+func runProxy(p *ProxyLSPPipe, clientPipeline *pipeline.Pipeline, serverPipeline *pipeline.Pipeline, clientDone chan int, serverDone chan int, signals chan os.Signal) (int, error) {
+	proxyDone := make(chan bool, 1)
+	go func() {
+		pending := p.Wait(clientDone, serverDone)
+		if pending != nil {
+			// closing the connections ends the side which didn't close.
+			// what it read is still traced
+			p.Close()
+			<-pending
+		}
+		proxyDone <- pending == nil
+	}()
+	var interrupted os.Signal
+	for {
+		select {
+		case closed := <-proxyDone:
+			switch {
+			case interrupted != nil:
+				return signalExitCode(interrupted), nil
+			case !closed:
+				return 1, ECLOSETIMEOUT
+			}
+			if err := cmp.Or(clientPipeline.Err(), serverPipeline.Err()); err != nil {
+				return 1, errors.Join(errors.New("proxy: connection ended abnormally"), err)
+			}
+			return 0, nil
+		case interrupted = <-signals:
+			log.Printf("received %s. closing proxy connections\n", interrupted)
+			p.Close()
+		}
+	}
+}
+
+func (p *ProxyLSPPipe) CIn() io.Writer {
+	return p.clientConnection
+}
+
+func (p *ProxyLSPPipe) COut() io.Reader {
+	return p.clientConnection
+}
+
+func (p *ProxyLSPPipe) SIn() io.Writer {
+	return p.serverConnection
+}
+
+func (p *ProxyLSPPipe) SOut() io.Reader {
+	return p.serverConnection
+}
+
+func (p *ProxyLSPPipe) CloseServerInput() {
+	closeWrite(p.serverConnection)
+}
+
+func (p *ProxyLSPPipe) Close() {
+	p.closers.closeAll()
+}
+
+// parseEndpoint splits an endpoint into the network and address expected
+// by net.Listen and net.Dial.
+func parseEndpoint(endpoint string) (string, string, error) {
+	network, address, ok := strings.Cut(endpoint, ":")
+	switch {
+	case ok && (network == "tcp" || network == "unix"):
+		if len(address) == 0 {
+			return "", "", fmt.Errorf("proxy: missing address in endpoint %q", endpoint)
+		}
+		if network == "unix" {
+			resolved, err := resolveLocalPath(address)
+			return network, resolved, err
+		}
+		return network, address, nil
+	case ok:
+		// host:port
+		return "tcp", endpoint, nil
+	}
+	return "", "", fmt.Errorf("proxy: invalid endpoint %q. expected tcp:<host>:<port>, unix:<path> or <host>:<port>", endpoint)
+}
+
+// removeStaleSocket removes a unix socket left behind by a previous run.
+// A socket which is still accepted on, e.g. by another lsptrace, is left
+// alone and is an error. Anything else at path is left for net.Listen to
+// report.
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if err != nil || info.Mode()&os.ModeSocket == 0 {
+		return nil
+	}
+	conn, err := net.DialTimeout("unix", path, SOCKET_PROBE_TIMEOUT)
+	if err == nil {
+		conn.Close()
+		return errors.Join(EADDRINUSE, fmt.Errorf("%s is in use by another process", path))
+	}
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		return errors.Join(EADDRINUSE, fmt.Errorf("could not tell whether %s is in use", path), err)
+	}
+	log.Printf("proxy: removing stale socket %s\n", path)
+	return os.Remove(path)
+}
+
+func closeWrite(conn net.Conn) {
+	if c, ok := conn.(interface{ CloseWrite() error }); ok {
+		c.CloseWrite()
+	} else {
+		conn.Close()
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"github.com/mparq/lsptrace/internal"
+	"github.com/mparq/lsptrace/internal/pipeline"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestRemoveStaleSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lsp.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := removeStaleSocket(path); !errors.Is(err, EADDRINUSE) {
+		t.Fatalf("expected a socket which is listened on to be in use, got %v", err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("expected the socket in use to be kept, got %v", err)
+	}
+
+	// left behind like by a process which was killed
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+	if err := removeStaleSocket(path); err != nil {
+		t.Fatalf("expected a stale socket to be removed, got %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("expected the stale socket to be gone, got %v", err)
+	}
+	if err := removeStaleSocket(path); err != nil {
+		t.Fatalf("expected nothing to do without a socket, got %v", err)
+	}
+}
+
+func TestParseEndpoint(t *testing.T) {
+	for endpoint, expected := range map[string][2]string{
+		"tcp:127.0.0.1:9000": {"tcp", "127.0.0.1:9000"},
+		"localhost:9000":     {"tcp", "localhost:9000"},
+		"unix:/tmp/lsp.sock": {"unix", "/tmp/lsp.sock"},
+	} {
+		network, address, err := parseEndpoint(endpoint)
+		if err != nil || network != expected[0] || address != expected[1] {
+			t.Errorf("expected %s to be %v, got %s %s %v", endpoint, expected, network, address, err)
+		}
+	}
+	for _, endpoint := range []string{"lsp.sock", "unix:"} {
+		if _, _, err := parseEndpoint(endpoint); err == nil {
+			t.Errorf("expected %q to be invalid", endpoint)
+		}
+	}
+}
+
+// startProxy runs a ProxyLSPPipe forwarding to server with a client
+// connected to it.
+func startProxy(t *testing.T, server net.Listener) (*ProxyLSPPipe, net.Conn) {
+	t.Helper()
+	port, err := freePort()
+	if err != nil {
+		t.Fatal(err)
+	}
+	listen := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+	pipes := NewProxyLSPPipe("tcp:"+listen, "tcp:"+server.Addr().String())
+	setupDone := make(chan error, 1)
+	go func() {
+		setupDone <- pipes.Setup()
+	}()
+	client, err := dialWithRetry(listen, 10*time.Second, func() bool { return false })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-setupDone; err != nil {
+		t.Fatal(err)
+	}
+	client.SetDeadline(time.Now().Add(10 * time.Second))
+	return pipes, client
+}
+
+// traceProxy runs the proxy until it ends and returns its exit code, error
+// and what was traced.
+func traceProxy(t *testing.T, pipes *ProxyLSPPipe, client func()) (int, error, []*internal.LSPTrace) {
+	t.Helper()
+	traceOut := new(bytes.Buffer)
+	traceWriter := pipeline.NewTraceWriter(traceOut)
+	lspTracer := internal.NewLSPTracer(internal.NewRequestMap())
+	clientPipeline := pipeline.NewPipeline(pipes.COut(), pipes.SIn(), traceWriter, lspTracer, "client")
+	serverPipeline := pipeline.NewPipeline(pipes.SOut(), pipes.CIn(), traceWriter, lspTracer, "server")
+	clientDone, serverDone := clientPipeline.Run(), serverPipeline.Run()
+	go client()
+	code, err := runProxy(pipes, clientPipeline, serverPipeline, clientDone, serverDone, make(chan os.Signal))
+	pipes.Close()
+	traces, readErr := internal.ReadTraces(traceOut)
+	if readErr != nil {
+		t.Fatal(readErr)
+	}
+	return code, err, traces
+}
+
+func TestProxyForwardsAndTraces(t *testing.T) {
+	server := fakeServer(t)
+	defer server.Close()
+	pipes, client := startProxy(t, server)
+	defer client.Close()
+
+	code, err, traces := traceProxy(t, pipes, func() {
+		client.Write(frames(t, `{"jsonrpc":"2.0","id":1,"method":"textDocument/hover","params":{}}`))
+		_, msg, err := pipeline.ReadJsonRpcMessage(bufio.NewReader(client))
+		if err != nil || string(msg.Result) != `"textDocument/hover"` {
+			t.Errorf("expected the server's response through the proxy, got %v %v", msg, err)
+		}
+		closeWrite(client)
+	})
+	if code != 0 || err != nil {
+		t.Fatalf("expected the proxy to end normally, got %d %v", code, err)
+	}
+	if len(traces) != 2 || traces[0].MessageKind != internal.REQUEST || traces[1].MessageKind != internal.RESPONSE ||
+		*traces[1].Method != "textDocument/hover" || traces[1].DurationMs == nil {
+		t.Fatalf("expected the request and its matched response to be traced, got %v", traces)
+	}
+}
+
+func TestProxyConnectionReset(t *testing.T) {
+	// the server resets the connection after reading the request
+	server, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	go func() {
+		conn, err := server.Accept()
+		if err != nil {
+			return
+		}
+		pipeline.ReadJsonRpcMessage(bufio.NewReader(conn))
+		conn.(*net.TCPConn).SetLinger(0)
+		conn.Close()
+	}()
+	pipes, client := startProxy(t, server)
+	defer client.Close()
+
+	code, err, traces := traceProxy(t, pipes, func() {
+		client.Write(frames(t, `{"jsonrpc":"2.0","id":1,"method":"textDocument/hover","params":{}}`))
+		// the proxy closes the client connection once the server is gone
+		bufio.NewReader(client).ReadByte()
+		closeWrite(client)
+	})
+	if code == 0 || !errors.Is(err, syscall.ECONNRESET) {
+		t.Fatalf("expected a nonzero exit code for the reset connection, got %d %v", code, err)
+	}
+	if len(traces) != 1 || traces[0].MessageKind != internal.REQUEST {
+		t.Fatalf("expected the request to be traced, got %v", traces)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"github.com/mparq/lsptrace/internal"
+	"github.com/mparq/lsptrace/internal/redact"
+	"io"
+	"os"
+)
+
+const (
+	REDACT_HELP_MESSAGE = `Usage:
+  $ ./lsptrace redact [flags] <trace-file> [output-file]
+
+The redacted trace is written to stdout if no output file is given.
+`
+)
+
+// runRedact applies redaction rules to an existing trace file.
+func runRedact(args []string) error {
+	flags := flag.NewFlagSet("redact", flag.ExitOnError)
+	flags.Usage = func() {
+		flags.Output().Write([]byte(REDACT_HELP_MESSAGE))
+		flags.PrintDefaults()
+	}
+	rules := flags.String("rules", "defaults", "comma-separated redaction rules <method-glob>:<params|result|error>.<path>=<blank|hash> or <method-glob>:raw=<blank|hash> for unparsed bodies. 'defaults' redacts source text, initialize options, workspace roots and unparsed bodies.")
+	uriRoot := flags.String("uri_root", "", "rewrite file:// uris under this directory to file:///$ROOT/...")
+	flags.Parse(args)
+	if flags.NArg() < 1 || flags.NArg() > 2 {
+		flags.Usage()
+		return errors.New("redact: expected a trace file and an optional output file")
+	}
+	redactor, err := redact.New(*rules, *uriRoot)
+	if err != nil {
+		return err
+	}
+
+	inPath, err := resolveLocalPath(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	in, err := os.Open(inPath)
+	if err != nil {
+		return errors.Join(errors.New("redact: could not open trace file"), err)
+	}
+	defer in.Close()
+
+	var out io.Writer = os.Stdout
+	if flags.NArg() == 2 {
+		outPath, err := resolveLocalPath(flags.Arg(1))
+		if err != nil {
+			return err
+		}
+		outF, err := os.OpenFile(outPath, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0666)
+		if err != nil {
+			return errors.Join(errors.New("redact: could not open output file"), err)
+		}
+		defer outF.Close()
+		out = outF
+	}
+	bufOut := bufio.NewWriter(out)
+	defer bufOut.Flush()
+
+	traceReader := internal.NewTraceReader(in)
+	for {
+		trace, err := traceReader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		redactor.Apply(trace)
+		traceJson, err := json.Marshal(trace)
+		if err != nil {
+			return err
+		}
+		bufOut.Write(append(traceJson, '\n'))
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"github.com/mparq/lsptrace/internal"
+	"github.com/mparq/lsptrace/internal/pipeline"
+	"github.com/mparq/lsptrace/internal/replay"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"time"
+)
+
+const (
+	REPLAY_HELP_MESSAGE = `Usage:
+  $ ./lsptrace replay [flags] <recorded-trace> <language-server-exe> [...args]
+`
+	// how long the server has to exit after the replay is done before it is killed
+	REPLAY_EXIT_TIMEOUT = 5 * time.Second
+)
+
+// runReplay launches a language server and plays the client side of a
+// recorded trace against it, tracing the new session.
+func runReplay(args []string) error {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	flags.Usage = func() {
+		flags.Output().Write([]byte(REPLAY_HELP_MESSAGE))
+		flags.PrintDefaults()
+	}
+	traceOutput := flags.String("trace_output", "", "filepath to write the lsp traces of the new session to.")
+	debugOutput := flags.String("debug_output", "", "filepath to write debug logs to.")
+	sessionId := flags.String("session_id", "", "the session to replay from a daemon trace with several sessions.")
+	handleNamedPipes := flags.Bool("handle_named_pipes", false, "whether the server will use named pipes. if true, lsptrace will expect an initial named pipe handshake.")
+	keepTiming := flags.Bool("original_timing", false, "keep the recorded delays between client messages.")
+	serverEnv := flags.String("server_env", "", "environment variables to set for the language server e.g. 'DOTNET_ROOT=~/.dotnet LOG_LEVEL=debug'.")
+	responseTimeout := flags.Duration("response_timeout", 30*time.Second, "how long to wait for each server response before giving up.")
+	flags.Parse(args)
+	if flags.NArg() < 2 || len(*traceOutput) < 1 {
+		flags.Usage()
+		return errors.New("replay: a recorded trace, a language server command and --trace_output are required")
+	}
+
+	logCloser, err := setupSubcommandLogger(*debugOutput)
+	if err != nil {
+		return err
+	}
+	defer logCloser()
+
+	recorded, err := readTraceFile(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	// ids of different sessions overlap and can't be sent over one connection
+	recorded, err = internal.SessionTraces(recorded, *sessionId)
+	if err != nil {
+		return err
+	}
+
+	tracePath, err := resolveLocalPath(*traceOutput)
+	if err != nil {
+		return err
+	}
+	traceOut, err := os.OpenFile(tracePath, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0666)
+	if err != nil {
+		return errors.Join(errors.New("error opening trace output file"), err)
+	}
+	defer traceOut.Close()
+
+	env, err := languageServerEnv(*serverEnv)
+	if err != nil {
+		return err
+	}
+	execCmd := setupLanguageServerCommand(flags.Args()[1:], env)
+	log.Printf("execCmd created.: %s\n", execCmd.String())
+	serverStderr, err := execCmd.StderrPipe()
+	if err != nil {
+		return err
+	}
+	pipes := NewLocalClientLSPPipe(execCmd, *handleNamedPipes)
+	if err := pipes.Setup(); err != nil {
+		return errors.Join(errors.New("replay: could not start language server"), err)
+	}
+	defer pipes.Close()
+
+	lspTracer := internal.NewLSPTracer(internal.NewRequestMap())
+	traceWriter := pipeline.NewTraceWriter(traceOut)
+	clientPipeline := pipeline.NewPipeline(pipes.COut(), pipes.SIn(), traceWriter, lspTracer, "client")
+	serverPipeline := pipeline.NewPipeline(pipes.SOut(), pipes.CIn(), traceWriter, lspTracer, "server")
+	clientDone := clientPipeline.Run()
+	serverDone := serverPipeline.Run()
+	stderrDone := pipeline.RunStderrStage(serverStderr, nil, traceWriter, lspTracer, nil)
+
+	clientIn, clientOut := pipes.Client()
+	client := replay.NewClient(recorded, clientIn, clientOut)
+	client.KeepTiming = *keepTiming
+	client.ResponseTimeout = *responseTimeout
+	replayErr := client.Run()
+
+	// the recorded session normally ends with shutdown/exit. either way
+	// stop sending and give the server some time to exit on its own.
+	pipes.CloseClient()
+	<-clientDone
+	pipes.CloseServerInput()
+	select {
+	case <-serverDone:
+	case <-time.After(REPLAY_EXIT_TIMEOUT):
+		log.Println("replay: server did not exit. killing it.")
+		execCmd.Process.Kill()
+		<-serverDone
+	}
+	select {
+	case <-stderrDone:
+	case <-time.After(STDERR_CLOSE_TIMEOUT):
+	}
+	execCmd.Wait()
+	return replayErr
+}
+
+// LocalClientLSPPipe is an LSPPipe where the client is lsptrace itself instead of
+// the process which started lsptrace. Client() gives the client's ends of the pipe.
+type LocalClientLSPPipe struct {
+	execCmd          *exec.Cmd
+	handleNamedPipes bool
+	sIn              io.WriteCloser
+	sOut             io.ReadCloser
+	// server -> client
+	cInReader *io.PipeReader
+	cInWriter *io.PipeWriter
+	// client -> server
+	cOutReader *io.PipeReader
+	cOutWriter *io.PipeWriter
+}
+
+func NewLocalClientLSPPipe(execCmd *exec.Cmd, handleNamedPipes bool) *LocalClientLSPPipe {
+	cInReader, cInWriter := io.Pipe()
+	cOutReader, cOutWriter := io.Pipe()
+	return &LocalClientLSPPipe{
+		execCmd:          execCmd,
+		handleNamedPipes: handleNamedPipes,
+		cInReader:        cInReader,
+		cInWriter:        cInWriter,
+		cOutReader:       cOutReader,
+		cOutWriter:       cOutWriter,
+	}
+}
+
+func (p *LocalClientLSPPipe) Setup() error {
+	if !p.handleNamedPipes {
+		sIn, err := p.execCmd.StdinPipe()
+		if err != nil {
+			return err
+		}
+		p.sIn = sIn
+		sOut, err := p.execCmd.StdoutPipe()
+		if err != nil {
+			return err
+		}
+		p.sOut = sOut
+		err = p.execCmd.Start()
+		if err != nil {
+			return errors.Join(errors.New("error starting lsp command"), err)
+		}
+		return nil
+	}
+
+	stdout, err := p.execCmd.StdoutPipe()
+	if err != nil {
+		return errors.Join(errors.New("could not get stdout pipe of lsp command"), err)
+	}
+	err = p.execCmd.Start()
+	if err != nil {
+		return errors.Join(errors.New("could not start lsp command"), err)
+	}
+	pipeName, err := pollForInitialPipeMsg(stdout)
+	if err != nil {
+		return errors.Join(errors.New("error polling for initial pipe message"), err)
+	}
+	log.Printf("Found initial pipeName: %s\n", pipeName)
+	conn, err := net.Dial("unix", pipeName)
+	if err != nil {
+		return errors.Join(errors.New("unable to connect to original pipe given from server"), err)
+	}
+	p.sIn, p.sOut = conn, conn
+	return nil
+}
+
+// Client returns the writer the local client sends messages to the
+// server with and the reader it receives server messages from.
+func (p *LocalClientLSPPipe) Client() (io.Writer, io.Reader) {
+	return p.cOutWriter, p.cInReader
+}
+
+// CloseClient signals that the local client won't send anything else.
+func (p *LocalClientLSPPipe) CloseClient() {
+	p.cOutWriter.Close()
+}
+
+// CloseServerInput closes the server's input so it knows that the
+// client is gone.
+func (p *LocalClientLSPPipe) CloseServerInput() {
+	if conn, ok := p.sIn.(*net.UnixConn); ok {
+		conn.CloseWrite()
+		return
+	}
+	p.sIn.Close()
+}
+
+func (p *LocalClientLSPPipe) CIn() io.Writer {
+	return p.cInWriter
+}
+
+func (p *LocalClientLSPPipe) COut() io.Reader {
+	return p.cOutReader
+}
+
+func (p *LocalClientLSPPipe) SIn() io.Writer {
+	return p.sIn
+}
+
+func (p *LocalClientLSPPipe) SOut() io.Reader {
+	return p.sOut
+}
+
+func (p *LocalClientLSPPipe) Close() {
+	p.cOutWriter.Close()
+	p.cInWriter.Close()
+	if p.sIn != nil {
+		p.sIn.Close()
+	}
+	if p.sOut != nil {
+		p.sOut.Close()
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/mparq/lsptrace/internal"
+	"github.com/mparq/lsptrace/internal/pipeline"
+	"github.com/mparq/lsptrace/internal/redact"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+const (
+	// how long a restarted server has to respond to the replayed initialize
+	HANDSHAKE_TIMEOUT = 30 * time.Second
+	// lsp error code for requests which failed although they were valid
+	REQUEST_FAILED = -32803
+)
+
+var (
+	ENOCLIENT = errors.New("restart: client is no longer connected")
+)
+
+// serverExit describes how a language server process exited. crashed is
+// whether it exited without the client asking it to.
+func serverExit(state *os.ProcessState, crashed bool) *internal.ServerExit {
+	exit := &internal.ServerExit{Code: state.ExitCode(), Crashed: crashed}
+	if status, ok := state.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		exit.Signal = status.Signal().String()
+	}
+	return exit
+}
+
+// restartedServer is a language server started in place of one which
+// crashed. Its output has to be read from sOut rather than from pipes since
+// some of it may have been read during the handshake.
+type restartedServer struct {
+	execCmd *exec.Cmd
+	pipes   *StdInOutLSPPipe
+	sOut    io.Reader
+	stderr  io.Reader
+}
+
+// serverRestarter starts a new language server over stdin/stdout when the
+// traced one crashes and brings it to the state of the session, so that the
+// client doesn't notice anything but the requests which were lost.
+type serverRestarter struct {
+	serverArgv []string
+	serverEnv  []string
+	// the client pipeline is held while the server restarts
+	clientPipeline *pipeline.Pipeline
+	clientIn       io.Writer
+	state          *internal.SessionState
+	lspTracer      *internal.LSPTracer
+	traceWriter    *pipeline.TraceWriter
+	redactor       *redact.Redactor
+	restarts       int
+}
+
+// Restart starts a new language server. Client requests which the crashed
+// server didn't respond to are answered with an error, then the handshake
+// of the session is replayed to the new server before the client messages
+// which were held in the meantime are forwarded to it.
+func (r *serverRestarter) Restart() (*restartedServer, error) {
+	r.restarts++
+	initializeId := internal.NewStringId(fmt.Sprintf("lsptrace-restart-%d", r.restarts))
+	var initialize *internal.RawLSPMessage
+	var handshake []*internal.RawLSPMessage
+	var pending []internal.RequestId
+	synced := make(chan struct{})
+	// what was sent to the crashed server is only known once the client
+	// pipeline traced everything it forwarded
+	held := r.clientPipeline.Hold(func() {
+		initialize, handshake = r.state.Handshake(initializeId)
+		pending = r.lspTracer.PendingClientRequests()
+		close(synced)
+	})
+	if !held {
+		return nil, ENOCLIENT
+	}
+	<-synced
+	for _, id := range pending {
+		if err := r.failRequest(id); err != nil {
+			return nil, errors.Join(errors.New("error responding to client request"), err)
+		}
+	}
+
+	execCmd := setupLanguageServerCommand(r.serverArgv, r.serverEnv)
+	log.Printf("restarting language server: %s\n", execCmd.String())
+	stderr, err := execCmd.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+	pipes := NewStdInOutLSPPipe(execCmd)
+	if err := pipes.Setup(); err != nil {
+		return nil, err
+	}
+	server := &restartedServer{execCmd: execCmd, pipes: pipes, sOut: pipes.SOut(), stderr: stderr}
+	if initialize != nil {
+		sOut := bufio.NewReader(pipes.SOut())
+		early, err := r.replayHandshake(pipes.SIn(), sOut, initialize, handshake)
+		if err != nil {
+			execCmd.Process.Kill()
+			execCmd.Wait()
+			return nil, errors.Join(errors.New("error replaying handshake to restarted language server"), err)
+		}
+		// messages sent in front of the initialize response are passed on
+		server.sOut = io.MultiReader(bytes.NewReader(early), sOut)
+	}
+	r.clientPipeline.Resume(pipes.SIn())
+	return server, nil
+}
+
+// failRequest answers a client request in place of the crashed server.
+func (r *serverRestarter) failRequest(id internal.RequestId) error {
+	errorJson, err := json.Marshal(map[string]any{
+		"code":    REQUEST_FAILED,
+		"message": "lsptrace: language server exited before responding",
+	})
+	if err != nil {
+		return err
+	}
+	response := &internal.RawLSPMessage{JsonRpc: "2.0", Id: &id, Error: errorJson}
+	if err := r.send(r.clientIn, response, "server"); err != nil {
+		return err
+	}
+	log.Printf("responded to pending client request %s\n", id)
+	return nil
+}
+
+// replayHandshake sends initialize and waits for the response, which isn't
+// passed on to the client, before sending the rest of the handshake. The
+// frames the server sent in front of the response are returned.
+func (r *serverRestarter) replayHandshake(sIn io.Writer, sOut *bufio.Reader, initialize *internal.RawLSPMessage, handshake []*internal.RawLSPMessage) (early []byte, err error) {
+	if err := r.send(sIn, initialize, "client"); err != nil {
+		return nil, err
+	}
+	type response struct {
+		early []byte
+		err   error
+	}
+	responded := make(chan response, 1)
+	go func() {
+		var early []byte
+		for {
+			frame, msg, err := pipeline.ReadJsonRpcMessage(sOut)
+			if err != nil {
+				responded <- response{err: err}
+				return
+			}
+			kind := internal.MessageKind(msg)
+			if (kind == internal.RESPONSE || kind == internal.ERROR) && msg.Id.Equal(*initialize.Id) {
+				r.trace(msg, "server")
+				if kind == internal.ERROR {
+					err = fmt.Errorf("initialize failed: %s", msg.Error)
+				}
+				responded <- response{early, err}
+				return
+			}
+			early = append(early, frame...)
+		}
+	}()
+	select {
+	case res := <-responded:
+		if res.err != nil {
+			return nil, res.err
+		}
+		early = res.early
+	case <-time.After(HANDSHAKE_TIMEOUT):
+		return nil, fmt.Errorf("no initialize response after %s", HANDSHAKE_TIMEOUT)
+	}
+	for _, msg := range handshake {
+		if err := r.send(sIn, msg, "client"); err != nil {
+			return nil, err
+		}
+	}
+	log.Printf("replayed handshake with %d messages to restarted language server\n", len(handshake)+1)
+	return early, nil
+}
+
+// send writes a message lsptrace made itself to w and traces it.
+func (r *serverRestarter) send(w io.Writer, msg *internal.RawLSPMessage, sentFrom string) error {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	if err := pipeline.WriteJsonRpcMessage(w, body); err != nil {
+		return err
+	}
+	r.trace(msg, sentFrom)
+	return nil
+}
+
+func (r *serverRestarter) trace(msg *internal.RawLSPMessage, sentFrom string) {
+	r.traceWriter.Trace(func() *internal.LSPTrace {
+		return r.lspTracer.MakeInjectedTrace(msg, sentFrom)
+	}, r.redactor)
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/mparq/lsptrace/internal"
+	"github.com/mparq/lsptrace/internal/pipeline"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+const (
+	FAKE_SERVER_ENV = "LSPTRACE_FAKE_SERVER"
+	// FAKE_SERVER_ENV value for a server which never answers. it creates
+	// the file at FAKE_SERVER_STARTED_ENV once it runs
+	FAKE_SERVER_HANG        = "hang"
+	FAKE_SERVER_STARTED_ENV = "LSPTRACE_FAKE_SERVER_STARTED"
+	// FAKE_SERVER_ENV values for a server using the socket transport on the
+	// port in its --port/--socket argument
+	FAKE_SERVER_SOCKET_CONNECT = "socket-connect"
+	FAKE_SERVER_SOCKET_LISTEN  = "socket-listen"
+)
+
+// the test binary runs itself as a language server
+func TestMain(m *testing.M) {
+	switch os.Getenv(FAKE_SERVER_ENV) {
+	case "":
+		os.Exit(m.Run())
+	case FAKE_SERVER_HANG:
+		os.WriteFile(os.Getenv(FAKE_SERVER_STARTED_ENV), nil, 0666)
+		time.Sleep(time.Hour)
+	case FAKE_SERVER_SOCKET_CONNECT, FAKE_SERVER_SOCKET_LISTEN:
+		if err := runFakeSocketServer(os.Getenv(FAKE_SERVER_ENV), os.Args); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	default:
+		runFakeLanguageServer(os.Stdin, os.Stdout)
+	}
+	os.Exit(0)
+}
+
+type receivedNotification struct {
+	Method string `json:"method"`
+	Text   string `json:"text,omitempty"`
+}
+
+// runFakeLanguageServer logs a message before answering initialize and
+// answers a "documents" request with the notifications it received.
+func runFakeLanguageServer(in io.Reader, out io.Writer) {
+	r := bufio.NewReader(in)
+	received := make([]receivedNotification, 0)
+	respond := func(id *internal.RequestId, result any) {
+		resultJson, _ := json.Marshal(result)
+		body, _ := json.Marshal(internal.RawLSPMessage{JsonRpc: "2.0", Id: id, Result: resultJson})
+		pipeline.WriteJsonRpcMessage(out, body)
+	}
+	for {
+		_, msg, err := pipeline.ReadJsonRpcMessage(r)
+		if err != nil {
+			return
+		}
+		switch internal.MessageKind(msg) {
+		case internal.NOTIFICATION:
+			var params struct {
+				TextDocument struct {
+					Text string `json:"text"`
+				} `json:"textDocument"`
+			}
+			json.Unmarshal(msg.Params, &params)
+			received = append(received, receivedNotification{*msg.Method, params.TextDocument.Text})
+		case internal.REQUEST:
+			switch *msg.Method {
+			case "initialize":
+				pipeline.WriteJsonRpcMessage(out, []byte(`{"jsonrpc":"2.0","method":"window/logMessage","params":{"type":3,"message":"starting"}}`))
+				respond(msg.Id, map[string]any{"capabilities": map[string]any{}})
+			case "documents":
+				respond(msg.Id, received)
+			}
+		}
+	}
+}
+
+// runFakeSocketServer connects to or listens on the port in args and runs
+// the fake language server over the connection.
+func runFakeSocketServer(mode string, args []string) error {
+	_, port, err := findPortArg(args)
+	if err != nil {
+		return err
+	}
+	address := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+	var conn net.Conn
+	if mode == FAKE_SERVER_SOCKET_CONNECT {
+		conn, err = net.Dial("tcp", address)
+	} else {
+		var l net.Listener
+		if l, err = net.Listen("tcp", address); err != nil {
+			return err
+		}
+		defer l.Close()
+		conn, err = l.Accept()
+	}
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	runFakeLanguageServer(conn, conn)
+	return nil
+}
+
+func frames(t *testing.T, bodies ...string) []byte {
+	buf := new(bytes.Buffer)
+	for _, body := range bodies {
+		if err := pipeline.WriteJsonRpcMessage(buf, []byte(body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+func nextMessage(t *testing.T, received chan *internal.RawLSPMessage) *internal.RawLSPMessage {
+	t.Helper()
+	select {
+	case msg, ok := <-received:
+		if !ok {
+			t.Fatal("expected a message for the client, got end of output")
+		}
+		return msg
+	case <-time.After(10 * time.Second):
+		t.Fatal("expected a message for the client")
+	}
+	return nil
+}
+
+func TestRestartReplaysHandshake(t *testing.T) {
+	state := internal.NewSessionState(true)
+	lspTracer := internal.NewLSPTracer(nil)
+	lspTracer.SetSessionState(state)
+	traceOut := new(bytes.Buffer)
+	traceWriter := pipeline.NewTraceWriter(traceOut)
+
+	cOut, clientWriter := io.Pipe()
+	crashedIn, crashedInWriter := io.Pipe()
+	crashedOut, crashedOutWriter := io.Pipe()
+	clientReader, cIn := io.Pipe()
+	received := make(chan *internal.RawLSPMessage)
+	go func() {
+		defer close(received)
+		r := bufio.NewReader(clientReader)
+		for {
+			_, msg, err := pipeline.ReadJsonRpcMessage(r)
+			if err != nil {
+				return
+			}
+			received <- msg
+		}
+	}()
+	clientPipeline := pipeline.NewPipeline(cOut, crashedInWriter, traceWriter, lspTracer, "client")
+	clientDone := clientPipeline.Run()
+	serverPipeline := pipeline.NewPipeline(crashedOut, cIn, traceWriter, lspTracer, "server")
+	serverDone := serverPipeline.Run()
+
+	session := frames(t,
+		`{"jsonrpc":"2.0","id":1,"method":"initialize","params":{"rootUri":"file:///a"}}`,
+		`{"jsonrpc":"2.0","method":"initialized","params":{}}`,
+		`{"jsonrpc":"2.0","method":"textDocument/didOpen","params":{"textDocument":{"uri":"file:///a/x.go","languageId":"go","version":1,"text":"package a\n"}}}`,
+		`{"jsonrpc":"2.0","method":"textDocument/didChange","params":{"textDocument":{"uri":"file:///a/x.go","version":2},"contentChanges":[{"range":{"start":{"line":0,"character":8},"end":{"line":0,"character":9}},"text":"b"}]}}`,
+		`{"jsonrpc":"2.0","id":2,"method":"textDocument/hover","params":{"textDocument":{"uri":"file:///a/x.go"},"position":{"line":0,"character":8}}}`,
+	)
+	go clientWriter.Write(session)
+	// the crashed server read everything and answered initialize only
+	if _, err := io.ReadFull(crashedIn, make([]byte, len(session))); err != nil {
+		t.Fatal(err)
+	}
+	// the response can only be matched once the request was traced
+	for deadline := time.Now().Add(10 * time.Second); len(lspTracer.PendingClientRequests()) < 2; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the client requests to be traced")
+		}
+	}
+	crashedOutWriter.Write(frames(t, `{"jsonrpc":"2.0","id":1,"result":{"capabilities":{}}}`))
+	if msg := nextMessage(t, received); internal.MessageKind(msg) != internal.RESPONSE || !msg.Id.Equal(*internal.NewIntId(1)) {
+		t.Fatalf("expected the initialize response, got %v", msg)
+	}
+	crashedOutWriter.Close()
+	<-serverDone
+
+	restarter := &serverRestarter{
+		serverArgv:     []string{os.Args[0]},
+		serverEnv:      []string{FAKE_SERVER_ENV + "=1"},
+		clientPipeline: clientPipeline,
+		clientIn:       cIn,
+		state:          state,
+		lspTracer:      lspTracer,
+		traceWriter:    traceWriter,
+	}
+	// the pending hover is failed while restarting
+	restarted := make(chan *restartedServer, 1)
+	go func() {
+		server, err := restarter.Restart()
+		if err != nil {
+			t.Error(err)
+		}
+		restarted <- server
+	}()
+	msg := nextMessage(t, received)
+	var responseError struct {
+		Code int `json:"code"`
+	}
+	json.Unmarshal(msg.Error, &responseError)
+	if internal.MessageKind(msg) != internal.ERROR || !msg.Id.Equal(*internal.NewIntId(2)) || responseError.Code != REQUEST_FAILED {
+		t.Fatalf("expected the pending request to fail, got %v", msg)
+	}
+	server := <-restarted
+	if server == nil {
+		t.FailNow()
+	}
+	defer func() {
+		server.execCmd.Process.Kill()
+		server.execCmd.Wait()
+	}()
+	serverPipeline = pipeline.NewPipeline(server.sOut, cIn, traceWriter, lspTracer, "server")
+	serverDone = serverPipeline.Run()
+
+	// what the server sent in front of the initialize response is passed on
+	if msg := nextMessage(t, received); msg.Method == nil || *msg.Method != "window/logMessage" {
+		t.Fatalf("expected the message sent before the initialize response, got %v", msg)
+	}
+	clientWriter.Write(frames(t, `{"jsonrpc":"2.0","id":3,"method":"documents"}`))
+	msg = nextMessage(t, received)
+	var documents []receivedNotification
+	if err := json.Unmarshal(msg.Result, &documents); err != nil || !msg.Id.Equal(*internal.NewIntId(3)) {
+		t.Fatalf("expected the documents response, got %v %v", msg, err)
+	}
+	expected := []receivedNotification{{Method: "initialized"}, {Method: "textDocument/didOpen", Text: "package b\n"}}
+	if len(documents) != len(expected) || documents[0] != expected[0] || documents[1] != expected[1] {
+		t.Fatalf("expected the handshake with the current text to be replayed, got %v", documents)
+	}
+
+	clientWriter.Close()
+	<-clientDone
+	server.pipes.CloseServerInput()
+	<-serverDone
+	traces, err := internal.ReadTraces(traceOut)
+	if err != nil {
+		t.Fatal(err)
+	}
+	injected := make([]string, 0)
+	for _, trace := range traces {
+		if trace.Injected {
+			injected = append(injected, trace.SentFrom+" "+trace.MessageKind)
+		}
+	}
+	expectedInjected := []string{"server error", "client request", "server response", "client notification", "client notification"}
+	if len(injected) != len(expectedInjected) {
+		t.Fatalf("expected %v to be traced as injected, got %v", expectedInjected, injected)
+	}
+	for i := range injected {
+		if injected[i] != expectedInjected[i] {
+			t.Fatalf("expected %v to be traced as injected, got %v", expectedInjected, injected)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"github.com/mparq/lsptrace/internal"
+	"github.com/mparq/lsptrace/internal/replay"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+)
+
+const (
+	SERVE_TRACE_HELP_MESSAGE = `Usage:
+  $ ./lsptrace serve-trace [flags] <recorded-trace>
+`
+)
+
+// runServeTrace acts as a language server which answers the client from
+// the server messages in a recorded trace.
+func runServeTrace(args []string) error {
+	flags := flag.NewFlagSet("serve-trace", flag.ExitOnError)
+	flags.Usage = func() {
+		flags.Output().Write([]byte(SERVE_TRACE_HELP_MESSAGE))
+		flags.PrintDefaults()
+	}
+	debugOutput := flags.String("debug_output", "", "filepath to write debug logs to.")
+	sessionId := flags.String("session_id", "", "the session to serve from a daemon trace with several sessions.")
+	handleNamedPipes := flags.Bool("handle_named_pipes", false, "whether to start with the named pipe handshake. if true, a pipe is created and its name sent to the client over stdout.")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return errors.New("serve-trace: expected a single recorded trace")
+	}
+
+	logCloser, err := setupSubcommandLogger(*debugOutput)
+	if err != nil {
+		return err
+	}
+	defer logCloser()
+
+	recorded, err := readTraceFile(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	// ids of different sessions overlap and can't be sent over one connection
+	recorded, err = internal.SessionTraces(recorded, *sessionId)
+	if err != nil {
+		return err
+	}
+
+	if !*handleNamedPipes {
+		return replay.NewServer(recorded, os.Stdout, os.Stdin).Run()
+	}
+
+	// named pipe handshake as done by roslyn. send the pipe name over stdout
+	// and wait for the client to connect to it.
+	tmpDir, err := os.MkdirTemp("", "lsp-trace-serve")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+	pipeName := filepath.Join(tmpDir, "lsptrace.sock")
+	l, err := net.Listen("unix", pipeName)
+	if err != nil {
+		return errors.Join(errors.New("could not setup serve-trace pipe"), err)
+	}
+	defer l.Close()
+	pipeJson, err := json.Marshal(PipeMsg{PipeName: pipeName})
+	if err != nil {
+		return err
+	}
+	os.Stdout.Write(pipeJson)
+	os.Stdout.WriteString("\n")
+	log.Println("Listening for connections on serve-trace pipe...")
+	conn, err := l.Accept()
+	if err != nil {
+		return errors.Join(errors.New("error listening for connection from client on serve-trace pipe"), err)
+	}
+	defer conn.Close()
+	log.Println("Accepted connection on serve-trace pipe.")
+	return replay.NewServer(recorded, conn, conn).Run()
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// the side which listens on the port given to the server
+	SOCKET_LISTENER_CLIENT = "client"
+	SOCKET_LISTENER_SERVER = "server"
+
+	// how long to wait for the client or server to connect or be connectable
+	SOCKET_CONNECT_TIMEOUT = 30 * time.Second
+	SOCKET_DIAL_INTERVAL   = 100 * time.Millisecond
+)
+
+var (
+	// server args which the lsp socket transport port is passed in
+	SOCKET_PORT_ARGS = []string{"--socket", "--port"}
+
+	EMISSINGPORT = errors.New("socket: no --socket=<port> or --port=<port> argument found in language server args")
+)
+
+// SocketLSPPipe traces the lsp TCP socket transport. The port is taken from
+// the --socket or --port argument of the language server and is rewritten to
+// a free port so that lsptrace sits between the client and server.
+// With listener 'client' the client listens on the port and the server
+// connects to it (e.g. vscode-languageclient's socket transport). With
+// listener 'server' the server listens on the port and the client connects.
+type SocketLSPPipe struct {
+	execCmd  *exec.Cmd
+	listener string
+
+	clientConnection net.Conn
+	serverConnection net.Conn
+	// listens for the client (listener 'server') or server (listener 'client')
+	interceptListener net.Listener
+	closers           setupClosers
+}
+
+func NewSocketLSPPipe(execCmd *exec.Cmd, listener string) *SocketLSPPipe {
+	return &SocketLSPPipe{execCmd: execCmd, listener: listener}
+}
+
+func (p *SocketLSPPipe) Setup() error {
+	argIndex, port, err := findPortArg(p.execCmd.Args)
+	if err != nil {
+		return err
+	}
+	clientAddress := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+	switch p.listener {
+	case SOCKET_LISTENER_CLIENT:
+		return p.setupClientListener(argIndex, clientAddress)
+	case SOCKET_LISTENER_SERVER:
+		return p.setupServerListener(argIndex, clientAddress)
+	}
+	return fmt.Errorf("socket: unknown socket listener %q. expected %q or %q", p.listener, SOCKET_LISTENER_CLIENT, SOCKET_LISTENER_SERVER)
+}
+
+// setupClientListener connects to the client and has the server connect to
+// lsptrace instead.
+func (p *SocketLSPPipe) setupClientListener(argIndex int, clientAddress string) error {
+	log.Printf("Connecting to client at %s...\n", clientAddress)
+	conn, err := dialWithRetry(clientAddress, SOCKET_CONNECT_TIMEOUT, p.closers.isClosed)
+	if err != nil {
+		return errors.Join(errors.New("socket: could not connect to client"), err)
+	}
+	p.clientConnection = conn
+	if err := p.closers.add(conn); err != nil {
+		return err
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return errors.Join(errors.New("socket: could not listen for server"), err)
+	}
+	p.interceptListener = l
+	if err := p.closers.add(l); err != nil {
+		return err
+	}
+	serverPort := l.Addr().(*net.TCPAddr).Port
+	rewritePortArg(p.execCmd.Args, argIndex, serverPort)
+	log.Printf("Starting server with intercept port %d: %s\n", serverPort, p.execCmd.String())
+	if err := p.execCmd.Start(); err != nil {
+		return errors.Join(errors.New("error starting lsp command"), err)
+	}
+
+	log.Println("Listening for connection from server...")
+	l.(*net.TCPListener).SetDeadline(time.Now().Add(SOCKET_CONNECT_TIMEOUT))
+	conn, err = l.Accept()
+	if err != nil {
+		return errors.Join(errors.New("socket: server did not connect"), err)
+	}
+	p.serverConnection = conn
+	if err := p.closers.add(conn); err != nil {
+		return err
+	}
+	log.Println("Accepted connection from server.")
+	return nil
+}
+
+// setupServerListener listens for the client on the port it expects the
+// server on and connects to the server on a free port.
+func (p *SocketLSPPipe) setupServerListener(argIndex int, clientAddress string) error {
+	l, err := net.Listen("tcp", clientAddress)
+	if err != nil {
+		return errors.Join(errors.New("socket: could not listen for client"), err)
+	}
+	p.interceptListener = l
+	if err := p.closers.add(l); err != nil {
+		return err
+	}
+
+	serverPort, err := freePort()
+	if err != nil {
+		return err
+	}
+	rewritePortArg(p.execCmd.Args, argIndex, serverPort)
+	log.Printf("Starting server with intercept port %d: %s\n", serverPort, p.execCmd.String())
+	if err := p.execCmd.Start(); err != nil {
+		return errors.Join(errors.New("error starting lsp command"), err)
+	}
+	serverAddress := net.JoinHostPort("127.0.0.1", strconv.Itoa(serverPort))
+	log.Printf("Connecting to server at %s...\n", serverAddress)
+	conn, err := dialWithRetry(serverAddress, SOCKET_CONNECT_TIMEOUT, p.closers.isClosed)
+	if err != nil {
+		return errors.Join(errors.New("socket: could not connect to server"), err)
+	}
+	p.serverConnection = conn
+	if err := p.closers.add(conn); err != nil {
+		return err
+	}
+
+	log.Printf("Listening for connection from client on %s...\n", clientAddress)
+	l.(*net.TCPListener).SetDeadline(time.Now().Add(SOCKET_CONNECT_TIMEOUT))
+	conn, err = l.Accept()
+	if err != nil {
+		return errors.Join(errors.New("socket: client did not connect"), err)
+	}
+	p.clientConnection = conn
+	if err := p.closers.add(conn); err != nil {
+		return err
+	}
+	log.Println("Accepted connection from client.")
+	return nil
+}
+
+func (p *SocketLSPPipe) CIn() io.Writer {
+	return p.clientConnection
+}
+
+func (p *SocketLSPPipe) COut() io.Reader {
+	return p.clientConnection
+}
+
+func (p *SocketLSPPipe) SIn() io.Writer {
+	return p.serverConnection
+}
+
+func (p *SocketLSPPipe) SOut() io.Reader {
+	return p.serverConnection
+}
+
+func (p *SocketLSPPipe) CloseServerInput() {
+	closeWrite(p.serverConnection)
+}
+
+func (p *SocketLSPPipe) Close() {
+	p.closers.closeAll()
+}
+
+// findPortArg finds the port passed as --socket=<port>, --port=<port> or with
+// the port as the next argument. Returns the index of the argument holding
+// the port.
+func findPortArg(args []string) (int, int, error) {
+	for i, arg := range args {
+		for _, name := range SOCKET_PORT_ARGS {
+			value, index := "", -1
+			switch {
+			case strings.HasPrefix(arg, name+"="):
+				value, index = arg[len(name)+1:], i
+			case arg == name && i+1 < len(args):
+				value, index = args[i+1], i+1
+			default:
+				continue
+			}
+			port, err := strconv.Atoi(value)
+			if err != nil {
+				return -1, 0, errors.Join(fmt.Errorf("socket: invalid port in %s argument", name), err)
+			}
+			return index, port, nil
+		}
+	}
+	return -1, 0, EMISSINGPORT
+}
+
+func rewritePortArg(args []string, index int, port int) {
+	if name, _, ok := strings.Cut(args[index], "="); ok {
+		args[index] = fmt.Sprintf("%s=%d", name, port)
+	} else {
+		args[index] = strconv.Itoa(port)
+	}
+}
+
+// freePort finds a port for the server to listen on.
+func freePort() (int, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, errors.Join(errors.New("socket: could not find a free port"), err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
+
+// dialWithRetry connects to address, retrying until timeout since the other
+// side may still be starting up. Retrying stops once closed returns true.
+func dialWithRetry(address string, timeout time.Duration, closed func() bool) (net.Conn, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		conn, err := net.DialTimeout("tcp", address, timeout)
+		if err == nil || time.Now().After(deadline) {
+			return conn, err
+		}
+		if closed() {
+			return nil, ESETUPCLOSED
+		}
+		time.Sleep(SOCKET_DIAL_INTERVAL)
+	}
+}
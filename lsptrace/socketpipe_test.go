@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"github.com/mparq/lsptrace/internal"
+	"github.com/mparq/lsptrace/internal/pipeline"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestPortArg(t *testing.T) {
+	tests := []struct {
+		args      []string
+		index     int
+		port      int
+		rewritten []string
+		err       error
+	}{
+		{[]string{"server", "--stdio=false", "--port", "5007"}, 3, 5007, []string{"server", "--stdio=false", "--port", "6000"}, nil},
+		{[]string{"server", "--port=5007", "--log"}, 1, 5007, []string{"server", "--port=6000", "--log"}, nil},
+		{[]string{"server", "--socket=5007"}, 1, 5007, []string{"server", "--socket=6000"}, nil},
+		{[]string{"server", "--stdio"}, -1, 0, nil, EMISSINGPORT},
+		// a trailing --port has no value
+		{[]string{"server", "--port"}, -1, 0, nil, EMISSINGPORT},
+	}
+	for _, test := range tests {
+		index, port, err := findPortArg(test.args)
+		if index != test.index || port != test.port || !errors.Is(err, test.err) {
+			t.Fatalf("%v: expected %d %d %v, got %d %d %v", test.args, test.index, test.port, test.err, index, port, err)
+		}
+		if err != nil {
+			continue
+		}
+		rewritePortArg(test.args, index, 6000)
+		if !slices.Equal(test.args, test.rewritten) {
+			t.Fatalf("expected the port to be rewritten to %v, got %v", test.rewritten, test.args)
+		}
+	}
+
+	for _, args := range [][]string{{"server", "--port=abc"}, {"server", "--socket", "50x7"}} {
+		if _, _, err := findPortArg(args); err == nil || errors.Is(err, EMISSINGPORT) {
+			t.Fatalf("%v: expected an invalid port error, got %v", args, err)
+		}
+	}
+}
+
+// traceLoopback sends initialize through pipes to the fake language server
+// and returns what was traced once both sides closed.
+func traceLoopback(t *testing.T, pipes LSPPipe, client net.Conn) []*internal.LSPTrace {
+	t.Helper()
+	traceOut := new(bytes.Buffer)
+	traceWriter := pipeline.NewTraceWriter(traceOut)
+	lspTracer := internal.NewLSPTracer(internal.NewRequestMap())
+	clientDone := pipeline.NewPipeline(pipes.COut(), pipes.SIn(), traceWriter, lspTracer, "client").Run()
+	serverDone := pipeline.NewPipeline(pipes.SOut(), pipes.CIn(), traceWriter, lspTracer, "server").Run()
+
+	client.SetDeadline(time.Now().Add(10 * time.Second))
+	client.Write(frames(t, `{"jsonrpc":"2.0","id":1,"method":"initialize","params":{}}`))
+	r := bufio.NewReader(client)
+	if _, msg, err := pipeline.ReadJsonRpcMessage(r); err != nil || msg.Method == nil || *msg.Method != "window/logMessage" {
+		t.Fatalf("expected the server's log message, got %v %v", msg, err)
+	}
+	if _, msg, err := pipeline.ReadJsonRpcMessage(r); err != nil || internal.MessageKind(msg) != internal.RESPONSE {
+		t.Fatalf("expected the initialize response, got %v %v", msg, err)
+	}
+	closeWrite(client)
+	<-clientDone
+	pipes.CloseServerInput()
+	<-serverDone
+
+	traces, err := internal.ReadTraces(traceOut)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return traces
+}
+
+// checkLoopbackTraces checks that the initialize request, the log message and
+// the response were traced.
+func checkLoopbackTraces(t *testing.T, traces []*internal.LSPTrace) {
+	t.Helper()
+	traced := make([]string, 0)
+	for _, trace := range traces {
+		traced = append(traced, trace.SentFrom+" "+trace.MessageKind)
+	}
+	slices.Sort(traced)
+	expected := []string{"client request", "server notification", "server response"}
+	if !slices.Equal(traced, expected) {
+		t.Fatalf("expected %v to be traced, got %v", expected, traced)
+	}
+}
+
+func TestSocketClientListener(t *testing.T) {
+	// the client listens on the port given to the server
+	client, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	port := client.Addr().(*net.TCPAddr).Port
+	execCmd := setupLanguageServerCommand([]string{os.Args[0], "--port=" + strconv.Itoa(port)}, []string{FAKE_SERVER_ENV + "=" + FAKE_SERVER_SOCKET_CONNECT})
+	pipes := NewSocketLSPPipe(execCmd, SOCKET_LISTENER_CLIENT)
+	defer pipes.Close()
+	setupDone := make(chan error, 1)
+	go func() {
+		setupDone <- pipes.Setup()
+	}()
+	conn, err := client.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := <-setupDone; err != nil {
+		t.Fatal(err)
+	}
+	if execCmd.Args[1] == "--port="+strconv.Itoa(port) {
+		t.Fatal("expected the server to be given lsptrace's port")
+	}
+
+	checkLoopbackTraces(t, traceLoopback(t, pipes, conn))
+	if err := execCmd.Wait(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSocketServerListener(t *testing.T) {
+	// the server listens on the port the client connects to
+	port, err := freePort()
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+	execCmd := setupLanguageServerCommand([]string{os.Args[0], "--socket", strconv.Itoa(port)}, []string{FAKE_SERVER_ENV + "=" + FAKE_SERVER_SOCKET_LISTEN})
+	pipes := NewSocketLSPPipe(execCmd, SOCKET_LISTENER_SERVER)
+	defer pipes.Close()
+	setupDone := make(chan error, 1)
+	go func() {
+		setupDone <- pipes.Setup()
+	}()
+	conn, err := dialWithRetry(address, 10*time.Second, func() bool { return false })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := <-setupDone; err != nil {
+		t.Fatal(err)
+	}
+	if execCmd.Args[2] == strconv.Itoa(port) {
+		t.Fatal("expected the server to be given lsptrace's port")
+	}
+
+	checkLoopbackTraces(t, traceLoopback(t, pipes, conn))
+	if err := execCmd.Wait(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"github.com/mparq/lsptrace/internal/stats"
+	"os"
+)
+
+// runStats prints a summary report of an existing trace file.
+func runStats(args []string) error {
+	flags := flag.NewFlagSet("stats", flag.ExitOnError)
+	flags.Usage = func() {
+		flags.Output().Write([]byte("Usage:\n  $ ./lsptrace stats <trace-file>\n"))
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return errors.New("stats: expected a single trace file")
+	}
+	traces, err := readTraceFile(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	return stats.Compute(traces).Write(os.Stdout)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/mparq/lsptrace/internal"
+	"github.com/mparq/lsptrace/internal/view"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+const (
+	VIEW_HELP_MESSAGE = `Usage:
+  $ ./lsptrace view [flags] <trace-file>
+  $ ./lsptrace view [flags] --connect <endpoint>
+
+Keys:
+  j/k, up/down    select message       J/K       scroll detail pane
+  d/u, pgdn/pgup  page                 g/G       first/last message (G follows new messages)
+  p               jump to request/response pair
+  /               filter by method (glob, or substring without glob characters)
+  f               cycle direction filter (all, client, server)
+  q               quit
+`
+)
+
+// runView opens a terminal viewer on a trace file. The file is tailed so
+// it can be pointed at the trace output of a running lsptrace. With
+// --connect the traces are streamed from the --view_listen endpoint of a
+// running lsptrace instead.
+func runView(args []string) error {
+	flags := flag.NewFlagSet("view", flag.ExitOnError)
+	flags.Usage = func() {
+		flags.Output().Write([]byte(VIEW_HELP_MESSAGE))
+		flags.PrintDefaults()
+	}
+	methodFilter := flags.String("method", "", "only show messages with a matching method.")
+	fromFilter := flags.String("from", "", "only show messages sent from 'client' or 'server'.")
+	debugOutput := flags.String("debug_output", "", "filepath to write debug logs to.")
+	connect := flags.String("connect", "", "--view_listen endpoint of a running lsptrace to show the traces of, tcp:<host>:<port> or unix:<path>.")
+	flags.Parse(args)
+	if (len(*connect) > 0) == (flags.NArg() == 1) || flags.NArg() > 1 {
+		flags.Usage()
+		return errors.New("view: expected a single trace file or --connect")
+	}
+	if *fromFilter != "" && *fromFilter != "client" && *fromFilter != "server" {
+		return errors.New("view: --from must be 'client' or 'server'")
+	}
+
+	logCloser, err := setupSubcommandLogger(*debugOutput)
+	if err != nil {
+		return err
+	}
+	defer logCloser()
+
+	var traceIn io.ReadCloser
+	if len(*connect) > 0 {
+		network, address, err := parseEndpoint(*connect)
+		if err != nil {
+			return err
+		}
+		if traceIn, err = net.Dial(network, address); err != nil {
+			return errors.Join(errors.New("view: could not connect to lsptrace"), err)
+		}
+	} else {
+		tracePath, err := resolveLocalPath(flags.Arg(0))
+		if err != nil {
+			return err
+		}
+		if traceIn, err = os.Open(tracePath); err != nil {
+			return errors.Join(errors.New("view: could not open trace file"), err)
+		}
+	}
+	defer traceIn.Close()
+
+	restore, err := makeTerminalRaw()
+	if err != nil {
+		return errors.Join(errors.New("view: stdin must be a terminal"), err)
+	}
+	defer restore()
+
+	traces := make(chan *internal.LSPTrace, 1024)
+	stop := make(chan struct{})
+	defer close(stop)
+	go view.Tail(traceIn, traces, stop)
+	keys := make(chan string)
+	go view.ReadKeys(os.Stdin, keys)
+
+	model := view.NewModel()
+	model.SetFilters(*methodFilter, *fromFilter)
+	view.NewUI(model, os.Stdout, terminalSize).Run(traces, keys)
+	return nil
+}
+
+// makeTerminalRaw puts the terminal into raw mode through stty and returns
+// a function restoring the previous mode.
+func makeTerminalRaw() (func(), error) {
+	state, err := stty("-g")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := stty("raw", "-echo"); err != nil {
+		return nil, err
+	}
+	return func() {
+		stty(strings.TrimSpace(state))
+	}, nil
+}
+
+func terminalSize() (int, int) {
+	size, err := stty("size")
+	var rows, cols int
+	if err != nil {
+		return 80, 24
+	}
+	if _, err := fmt.Sscan(size, &rows, &cols); err != nil || rows < 1 || cols < 1 {
+		return 80, 24
+	}
+	return cols, rows
+}
+
+func stty(args ...string) (string, error) {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = os.Stdin
+	out, err := cmd.Output()
+	return string(out), err
+}